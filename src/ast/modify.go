@@ -0,0 +1,186 @@
+package ast
+
+type ModifierFunc func(Node) Node
+
+// Modify walks node depth-first and replaces every node with the result of
+// calling modifier on it, children first. It never changes node itself:
+// every node with children is copied before they are replaced, so a tree
+// can be modified many times, e.g. each time a macro is expanded. Leaves are
+// passed to modifier as is.
+func Modify(node Node, modifier ModifierFunc) Node {
+	switch node := node.(type) {
+
+	case *Program:
+		n := *node
+		n.Statements = modifyStatements(node.Statements, modifier)
+		return modifier(&n)
+
+	case *ExpressionStatement:
+		n := *node
+		n.Expression = modifyExpression(node.Expression, modifier)
+		return modifier(&n)
+
+	case *BlockStatement:
+		return modifyBlock(node, modifier)
+
+	case *ThrowStatement:
+		n := *node
+		n.Value = modifyExpression(node.Value, modifier)
+		return modifier(&n)
+
+	case *ReturnStatement:
+		n := *node
+		n.ReturnValue = modifyExpression(node.ReturnValue, modifier)
+		return modifier(&n)
+
+	case *LetStatement:
+		n := *node
+		n.Name = modifyIdentifier(node.Name, modifier)
+		n.Value = modifyExpression(node.Value, modifier)
+		return modifier(&n)
+
+	case *AssignExpression:
+		n := *node
+		n.Name = modifyIdentifier(node.Name, modifier)
+		n.Value = modifyExpression(node.Value, modifier)
+		return modifier(&n)
+
+	case *PrefixExpression:
+		n := *node
+		n.Right = modifyExpression(node.Right, modifier)
+		return modifier(&n)
+
+	case *InfixExpression:
+		n := *node
+		n.Left = modifyExpression(node.Left, modifier)
+		n.Right = modifyExpression(node.Right, modifier)
+		return modifier(&n)
+
+	case *IfExpression:
+		n := *node
+		n.Condition = modifyExpression(node.Condition, modifier)
+		n.Consequence = modifyBlock(node.Consequence, modifier)
+		if node.Alternative != nil {
+			n.Alternative = modifyBlock(node.Alternative, modifier)
+		}
+		return modifier(&n)
+
+	case *TryExpression:
+		n := *node
+		n.Body = modifyBlock(node.Body, modifier)
+		if node.Catch != nil {
+			n.Parameter = modifyIdentifier(node.Parameter, modifier)
+			n.Catch = modifyBlock(node.Catch, modifier)
+		}
+		if node.Finally != nil {
+			n.Finally = modifyBlock(node.Finally, modifier)
+		}
+		return modifier(&n)
+
+	case *FunctionLiteral:
+		n := *node
+		n.Parameters = modifyIdentifiers(node.Parameters, modifier)
+		n.Body = modifyBlock(node.Body, modifier)
+		return modifier(&n)
+
+	case *MacroLiteral:
+		n := *node
+		n.Parameters = modifyIdentifiers(node.Parameters, modifier)
+		n.Body = modifyBlock(node.Body, modifier)
+		return modifier(&n)
+
+	case *CallExpression:
+		n := *node
+		n.Function = modifyExpression(node.Function, modifier)
+		n.Arguments = modifyExpressions(node.Arguments, modifier)
+		return modifier(&n)
+
+	case *MethodCallExpression:
+		// The method name is not a variable, so it is left alone
+		n := *node
+		n.Receiver = modifyExpression(node.Receiver, modifier)
+		n.Arguments = modifyExpressions(node.Arguments, modifier)
+		return modifier(&n)
+
+	case *ArrayLiteral:
+		n := *node
+		n.Elements = modifyExpressions(node.Elements, modifier)
+		return modifier(&n)
+
+	case *IndexExpression:
+		n := *node
+		n.Left = modifyExpression(node.Left, modifier)
+		n.Index = modifyExpression(node.Index, modifier)
+		return modifier(&n)
+
+	case *SliceExpression:
+		n := *node
+		n.Left = modifyExpression(node.Left, modifier)
+		n.Start = modifyExpression(node.Start, modifier)
+		n.End = modifyExpression(node.End, modifier)
+		n.Step = modifyExpression(node.Step, modifier)
+		return modifier(&n)
+
+	case *HashLiteral:
+		n := *node
+		n.Pairs = make(map[Expression]Expression, len(node.Pairs))
+		for key, val := range node.Pairs {
+			n.Pairs[modifyExpression(key, modifier)] = modifyExpression(val, modifier)
+		}
+		return modifier(&n)
+
+	}
+
+	return modifier(node)
+}
+
+func modifyExpression(exp Expression, modifier ModifierFunc) Expression {
+	if exp == nil {
+		return nil
+	}
+	modified, _ := Modify(exp, modifier).(Expression)
+	return modified
+}
+
+func modifyExpressions(exps []Expression, modifier ModifierFunc) []Expression {
+	modified := make([]Expression, len(exps))
+	for i, exp := range exps {
+		modified[i] = modifyExpression(exp, modifier)
+	}
+	return modified
+}
+
+func modifyStatements(stmts []Statement, modifier ModifierFunc) []Statement {
+	modified := make([]Statement, 0, len(stmts))
+	for _, stmt := range stmts {
+		// A modifier may remove a statement by returning nil
+		if s, ok := Modify(stmt, modifier).(Statement); ok {
+			modified = append(modified, s)
+		}
+	}
+	return modified
+}
+
+func modifyIdentifier(ident *Identifier, modifier ModifierFunc) *Identifier {
+	if modified, ok := Modify(ident, modifier).(*Identifier); ok {
+		return modified
+	}
+	return ident
+}
+
+func modifyIdentifiers(idents []*Identifier, modifier ModifierFunc) []*Identifier {
+	modified := make([]*Identifier, len(idents))
+	for i, ident := range idents {
+		modified[i] = modifyIdentifier(ident, modifier)
+	}
+	return modified
+}
+
+func modifyBlock(block *BlockStatement, modifier ModifierFunc) *BlockStatement {
+	n := *block
+	n.Statements = modifyStatements(block.Statements, modifier)
+	if modified, ok := modifier(&n).(*BlockStatement); ok {
+		return modified
+	}
+	return &n
+}
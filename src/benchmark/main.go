@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"time"
 
+	"ash/ast"
 	"ash/compiler"
 	"ash/evaluator"
 	"ash/lexer"
@@ -13,9 +15,15 @@ import (
 	"ash/vm"
 )
 
-var engine = flag.String("engine", "vm", "use 'vm' or 'eval'")
+var (
+	engine       = flag.String("engine", "vm", "use 'vm' or 'eval'")
+	optimization = flag.Int("O", int(compiler.MaxOptimization), "the optimization level of the vm")
+	name         = flag.String("program", "fib", "the program to run: 'fib' or 'branches'")
+	compare      = flag.Bool("compare", false, "run the vm at each optimization level")
+)
 
-var input = `
+var programs = map[string]string{
+	"fib": `
 let fib = fn(n) {
     if n == 0 {
         0
@@ -28,38 +36,69 @@ let fib = fn(n) {
     }
 };
 fib(35)
-`
+`,
+
+	// Nested branches and discarded values, which the peephole optimizer
+	// rewrites
+	"branches": `
+let classify = fn(n) {
+    n;
+    if n < 10 {
+        0
+    } else {
+        if n < 100 {
+            1
+        } else {
+            if n < 1000 { 2 } else { 3 }
+        }
+    }
+};
+let count = fn(n, sum) {
+    if n == 0 {
+        return sum
+    }
+    count(n - 1, sum + classify(n))
+};
+count(3000000, 0)
+`,
+}
 
 func main() {
 	flag.Parse()
 
-	var duration time.Duration
-	var result object.Object
+	input, ok := programs[*name]
+	if !ok {
+		fmt.Printf("unknown program: %s\n", *name)
+		os.Exit(1)
+	}
 
 	l := lexer.New(input)
 	p := parser.New(l)
 	program := p.ParseProgram()
 
-	if *engine == "vm" {
-		comp := compiler.New()
-		err := comp.Compile(program)
-		if err != nil {
-			fmt.Printf("compiler error: %s", err)
-			return
+	if *compare {
+		for level := compiler.NoOptimization; level <= compiler.MaxOptimization; level++ {
+			result, duration, err := runVM(program, level)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			fmt.Printf("engine=vm, O=%d, result=%s, duration=%s\n",
+				level, result.Inspect(), duration)
 		}
+		return
+	}
 
-		vm := vm.New(comp.Bytecode())
-
-		start := time.Now()
+	var duration time.Duration
+	var result object.Object
 
-		err = vm.Run()
+	if *engine == "vm" {
+		var err error
+		result, duration, err = runVM(program, compiler.OptimizationLevel(*optimization))
 		if err != nil {
-			fmt.Printf("vm error: %s", err)
+			fmt.Println(err)
 			return
 		}
-
-		duration = time.Since(start)
-		result = vm.LastPoppedStackElem()
 	} else {
 		env := object.NewEnvironment()
 		start := time.Now()
@@ -70,3 +109,23 @@ func main() {
 	fmt.Printf("engine=%s, result=%s, duration=%s\n",
 		*engine, result.Inspect(), duration)
 }
+
+func runVM(program *ast.Program, level compiler.OptimizationLevel) (object.Object, time.Duration, error) {
+	comp := compiler.New()
+	comp.SetOptimization(level)
+	err := comp.Compile(program)
+	if err != nil {
+		return nil, 0, fmt.Errorf("compiler error: %s", err)
+	}
+
+	vm := vm.New(comp.Bytecode())
+
+	start := time.Now()
+
+	err = vm.Run()
+	if err != nil {
+		return nil, 0, fmt.Errorf("vm error: %s", err)
+	}
+
+	return vm.LastPoppedStackElem(), time.Since(start), nil
+}
@@ -13,17 +13,20 @@ func (ins Instructions) String() string {
 
 	i := 0
 	for i < len(ins) {
-		def, err := Lookup(ins[i])
+		prefix := ""
+		if Opcode(ins[i]) == OpWide {
+			prefix = "OpWide "
+		}
+
+		op, operands, read, err := ReadInstruction(ins[i:])
 		if err != nil {
 			fmt.Fprintf(&out, "ERROR: %s\n", err)
-			continue
+			break
 		}
 
-		operands, read := ReadOperands(def, ins[i+1:])
-
-		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
+		fmt.Fprintf(&out, "%04d %s%s\n", i, prefix, ins.fmtInstruction(definitions[op], operands))
 
-		i += 1 + read
+		i += read
 	}
 
 	return out.String()
@@ -67,12 +70,15 @@ const (
 	OpEqual
 	OpNotEqual
 	OpGreaterThan
+	OpLessThan
 
 	OpMinus
 	OpBang
 
 	OpJumpNotTruthy
 	OpJump
+	OpJumpNull
+	OpJumpNotNull
 
 	OpNull
 
@@ -82,8 +88,11 @@ const (
 	OpArray
 	OpHash
 	OpIndex
+	OpSlice
 
 	OpCall
+	OpTailCall
+	OpMethodCall
 
 	OpReturnValue
 	OpReturn
@@ -92,12 +101,31 @@ const (
 	OpSetLocal
 
 	OpGetBuiltin
+	OpGetPrelude
 
 	OpClosure
 
 	OpGetFree
 
 	OpCurrentClosure
+
+	OpThrow
+
+	OpWide
+
+	// Superinstructions, which the compiler selects for common sequences
+	OpGetLocal0
+	OpGetLocal1
+	OpGetLocal2
+	OpGetLocal3
+	OpAddConst
+	OpSubConst
+	OpLessThanConst
+	OpEqualConst
+	OpCall0
+	OpCall1
+	OpCall2
+	OpCall3
 )
 
 type Definition struct {
@@ -121,12 +149,15 @@ var definitions = map[Opcode]*Definition{
 	OpEqual:       {"OpEqual", []int{}},
 	OpNotEqual:    {"OpNotEqual", []int{}},
 	OpGreaterThan: {"OpGreaterThan", []int{}},
+	OpLessThan:    {"OpLessThan", []int{}},
 
 	OpMinus: {"OpMinus", []int{}},
 	OpBang:  {"OpBang", []int{}},
 
 	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
 	OpJump:          {"OpJump", []int{2}},
+	OpJumpNull:      {"OpJumpNull", []int{2}},    // jumps if the top of the stack is null, without popping it
+	OpJumpNotNull:   {"OpJumpNotNull", []int{2}}, // jumps if the top of the stack is not null, without popping it
 
 	OpNull: {"OpNull", []int{}},
 
@@ -136,8 +167,11 @@ var definitions = map[Opcode]*Definition{
 	OpArray: {"OpArray", []int{2}},
 	OpHash:  {"OpHash", []int{2}},
 	OpIndex: {"OpIndex", []int{}},
+	OpSlice: {"OpSlice", []int{}},
 
-	OpCall: {"OpCall", []int{1}},
+	OpCall:       {"OpCall", []int{1}},
+	OpTailCall:   {"OpTailCall", []int{1}},
+	OpMethodCall: {"OpMethodCall", []int{2, 1}}, // {method name constant index, num arguments}
 
 	OpReturnValue: {"OpReturnValue", []int{}},
 	OpReturn:      {"OpReturn", []int{}},
@@ -146,12 +180,32 @@ var definitions = map[Opcode]*Definition{
 	OpSetLocal: {"OpSetLocal", []int{1}},
 
 	OpGetBuiltin: {"OpGetBuiltin", []int{1}},
+	OpGetPrelude: {"OpGetPrelude", []int{1}},
 
 	OpClosure: {"OpClosure", []int{2, 1}}, // {constant index, num free variables}
 
 	OpGetFree: {"OpGetFree", []int{1}},
 
 	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+
+	OpThrow: {"OpThrow", []int{}},
+
+	OpWide: {"OpWide", []int{}}, // prefixes an instruction whose operands are twice as wide
+
+	OpGetLocal0: {"OpGetLocal0", []int{}},
+	OpGetLocal1: {"OpGetLocal1", []int{}},
+	OpGetLocal2: {"OpGetLocal2", []int{}},
+	OpGetLocal3: {"OpGetLocal3", []int{}},
+
+	OpAddConst:      {"OpAddConst", []int{2}},      // OpConstant, OpAdd
+	OpSubConst:      {"OpSubConst", []int{2}},      // OpConstant, OpSub
+	OpLessThanConst: {"OpLessThanConst", []int{2}}, // OpConstant, OpLessThan
+	OpEqualConst:    {"OpEqualConst", []int{2}},    // OpConstant, OpEqual
+
+	OpCall0: {"OpCall0", []int{}},
+	OpCall1: {"OpCall1", []int{}},
+	OpCall2: {"OpCall2", []int{}},
+	OpCall3: {"OpCall3", []int{}},
 }
 
 func Lookup(op byte) (*Definition, error) {
@@ -163,24 +217,39 @@ func Lookup(op byte) (*Definition, error) {
 	return def, nil
 }
 
+// Make encodes op with operands. If an operand doesn't fit its width, the
+// instruction is prefixed with OpWide and all its operands are twice as
+// wide. Operands that don't fit even then are truncated; see MaxOperand.
 func Make(op Opcode, operands ...int) []byte {
 	def, ok := definitions[op]
 	if !ok {
 		return []byte{}
 	}
 
-	instructionLen := 1
-	for _, w := range def.OperandWidths {
+	prefix := 0
+	widths := def.OperandWidths
+	if IsWide(op, operands...) {
+		prefix = 1
+		widths = def.wide().OperandWidths
+	}
+
+	instructionLen := prefix + 1
+	for _, w := range widths {
 		instructionLen += w
 	}
 
 	instruction := make([]byte, instructionLen)
-	instruction[0] = byte(op)
+	if prefix == 1 {
+		instruction[0] = byte(OpWide)
+	}
+	instruction[prefix] = byte(op)
 
-	offset := 1
+	offset := prefix + 1
 	for i, o := range operands {
-		width := def.OperandWidths[i]
+		width := widths[i]
 		switch width {
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
 		case 1:
@@ -192,12 +261,48 @@ func Make(op Opcode, operands ...int) []byte {
 	return instruction
 }
 
+// IsWide reports whether op needs the OpWide prefix for operands.
+func IsWide(op Opcode, operands ...int) bool {
+	def, ok := definitions[op]
+	if !ok {
+		return false
+	}
+
+	for i, o := range operands {
+		if o > maxOperand(def.OperandWidths[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxOperand returns the largest i-th operand op can have, with the OpWide
+// prefix.
+func MaxOperand(op Opcode, i int) int {
+	return maxOperand(2 * definitions[op].OperandWidths[i])
+}
+
+func maxOperand(width int) int {
+	return 1<<(8*width) - 1
+}
+
+// wide returns the definition of def's instruction after an OpWide prefix.
+func (def *Definition) wide() *Definition {
+	widths := make([]int, len(def.OperandWidths))
+	for i, w := range def.OperandWidths {
+		widths[i] = 2 * w
+	}
+	return &Definition{Name: def.Name, OperandWidths: widths}
+}
+
 func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 	operands := make([]int, len(def.OperandWidths))
 	offset := 0
 
 	for i, width := range def.OperandWidths {
 		switch width {
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
 		case 2:
 			operands[i] = int(ReadUint16(ins[offset:]))
 		case 1:
@@ -210,8 +315,33 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 	return operands, offset
 }
 
+// ReadInstruction decodes the instruction at the start of ins, with its
+// OpWide prefix if it has one. It returns the opcode, the operands and the
+// length of the instruction.
+func ReadInstruction(ins Instructions) (Opcode, []int, int, error) {
+	prefix := 0
+	if Opcode(ins[0]) == OpWide {
+		prefix = 1
+	}
+
+	def, err := Lookup(ins[prefix])
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if prefix == 1 {
+		def = def.wide()
+	}
+
+	operands, read := ReadOperands(def, ins[prefix+1:])
+	return Opcode(ins[prefix]), operands, prefix + 1 + read, nil
+}
+
 func ReadUint8(ins Instructions) uint8 { return uint8(ins[0]) }
 
 func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
+
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
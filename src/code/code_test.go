@@ -12,6 +12,9 @@ func TestMake(t *testing.T) {
 		{OpAdd, []int{}, []byte{byte(OpAdd)}},
 		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
 		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpConstant, []int{65536}, []byte{byte(OpWide), byte(OpConstant), 0, 1, 0, 0}},
+		{OpGetLocal, []int{256}, []byte{byte(OpWide), byte(OpGetLocal), 1, 0}},
+		{OpClosure, []int{1, 256}, []byte{byte(OpWide), byte(OpClosure), 0, 0, 0, 1, 1, 0}},
 	}
 
 	for _, tt := range tests {
@@ -38,6 +41,8 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpConstant, 2),
 		Make(OpConstant, 65535),
 		Make(OpClosure, 65535, 255),
+		Make(OpConstant, 65536),
+		Make(OpCall, 300),
 	}
 
 	expected := `0000 OpAdd
@@ -45,6 +50,8 @@ func TestInstructionsString(t *testing.T) {
 0003 OpConstant 2
 0006 OpConstant 65535
 0009 OpClosure 65535 255
+0013 OpWide OpConstant 65536
+0019 OpWide OpCall 300
 `
 
 	concatted := Instructions{}
@@ -89,3 +96,35 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestReadInstruction(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		length   int
+	}{
+		{OpAdd, []int{}, 1},
+		{OpConstant, []int{65535}, 3},
+		{OpConstant, []int{1 << 20}, 6},
+		{OpMethodCall, []int{1, 256}, 8},
+		{OpCall, []int{MaxOperand(OpCall, 0)}, 4},
+	}
+
+	for _, tt := range tests {
+		op, operands, length, err := ReadInstruction(Make(tt.op, tt.operands...))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if op != tt.op {
+			t.Errorf("op wrong. want=%d, got=%d", tt.op, op)
+		}
+		if length != tt.length {
+			t.Errorf("length wrong. want=%d, got=%d", tt.length, length)
+		}
+		for i, want := range tt.operands {
+			if operands[i] != want {
+				t.Errorf("operand wrong. want=%d, got=%d", want, operands[i])
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"ash/ast"
 	"ash/code"
 	"ash/object"
+	"ash/token"
 	"fmt"
 	"sort"
 )
@@ -11,41 +12,74 @@ import (
 type Compiler struct {
 	constants []object.Object
 
+	// constantIndexes indexes the constants by value, see addConstant
+	constantIndexes map[constantKey]int
+
 	symbolTable *SymbolTable
 
 	scopes     []CompilationScope
 	scopeIndex int
+
+	// pos is the token of the innermost node being compiled whose
+	// instructions can raise errors, which they are attributed to
+	pos token.Token
+
+	optimization OptimizationLevel
+
+	// err is the first error of an operand out of range even for a wide
+	// instruction, which Compile returns
+	err error
 }
 
 func New() *Compiler {
-	mainScope := CompilationScope{
-		instructions:        code.Instructions{},
-		lastInstruction:     EmittedInstruction{},
-		previousInstruction: EmittedInstruction{},
-	}
-
 	symbolTable := NewSymbolTable()
 
 	for i, v := range object.Builtins {
 		symbolTable.DefineBuiltin(i, v.Name)
 	}
 
-	return &Compiler{
-		constants:   []object.Object{},
-		symbolTable: symbolTable,
-		scopes:      []CompilationScope{mainScope},
-		scopeIndex:  0,
+	for _, s := range PreludeSymbols() {
+		symbolTable.DefinePrelude(s.Index, s.Name)
 	}
+
+	return NewWithState(symbolTable, []object.Object{})
 }
 
 func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
-	compiler := New()
-	compiler.symbolTable = s
-	compiler.constants = constants
-	return compiler
+	mainScope := CompilationScope{
+		instructions:        code.Instructions{},
+		lastInstruction:     EmittedInstruction{},
+		previousInstruction: EmittedInstruction{},
+	}
+
+	c := &Compiler{
+		constants:       constants,
+		constantIndexes: make(map[constantKey]int),
+		symbolTable:     s,
+		scopes:          []CompilationScope{mainScope},
+		scopeIndex:      0,
+	}
+
+	// Constants from earlier compilations, like the REPL's previous lines,
+	// are reused too
+	for i, constant := range constants {
+		if key, ok := keyOf(constant); ok {
+			if _, found := c.constantIndexes[key]; !found {
+				c.constantIndexes[key] = i
+			}
+		}
+	}
+
+	return c
 }
 
 func (c *Compiler) Compile(node ast.Node) error {
+	if tok, ok := position(node); ok {
+		outer := c.pos
+		c.pos = tok
+		defer func() { c.pos = outer }()
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
 		for _, s := range node.Statements {
@@ -63,17 +97,26 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpPop)
 
 	case *ast.InfixExpression:
-		if node.Operator == "<" {
-			err := c.Compile(node.Right)
+		if c.emitFolded(node) {
+			return nil
+		}
+
+		if node.Operator == "??" {
+			err := c.Compile(node.Left)
 			if err != nil {
 				return err
 			}
 
-			err = c.Compile(node.Left)
+			// Keep the left value unless it is null
+			jumpNotNullPos := c.emit(code.OpJumpNotNull, 9999)
+			c.emit(code.OpPop)
+
+			err = c.Compile(node.Right)
 			if err != nil {
 				return err
 			}
-			c.emit(code.OpGreaterThan)
+
+			c.changeOperand(jumpNotNullPos, len(c.currentInstructions()))
 			return nil
 		}
 
@@ -98,6 +141,8 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpDiv)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case "<":
+			c.emit(code.OpLessThan)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
@@ -117,7 +162,14 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpFalse)
 		}
 
+	case *ast.NullLiteral:
+		c.emit(code.OpNull)
+
 	case *ast.PrefixExpression:
+		if c.emitFolded(node) {
+			return nil
+		}
+
 		err := c.Compile(node.Right)
 		if err != nil {
 			return err
@@ -140,21 +192,22 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		// Emit an `OpJumpNotTruthy` with a bogus value
 		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+		depth := c.depth()
 
 		err = c.Compile(node.Consequence)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
-		}
+		c.keepBlockValue()
+		c.setDepth(depth + 1)
 
 		// Emit an `OpJump` with a bogus value
 		jumpPos := c.emit(code.OpJump, 9999)
 
 		afterConsequencePos := len(c.currentInstructions())
 		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
+		c.setDepth(depth)
 
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
@@ -164,39 +217,121 @@ func (c *Compiler) Compile(node ast.Node) error {
 				return err
 			}
 
-			if c.lastInstructionIs(code.OpPop) {
-				c.removeLastPop()
-			}
+			c.keepBlockValue()
+			c.setDepth(depth + 1)
 		}
 
 		afterAlternativePos := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterAlternativePos)
 
+	case *ast.TryExpression:
+		return c.compileTry(node)
+
+	case *ast.ThrowStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpThrow)
+
 	case *ast.BlockStatement:
-		for _, s := range node.Statements {
-			err := c.Compile(s)
-			if err != nil {
-				return err
-			}
+		c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+
+		err := c.compileStatements(node.Statements)
+		if err != nil {
+			return err
 		}
 
+		c.symbolTable = c.symbolTable.Outer
+
+	case *ast.ImportStatement:
+		return c.compileImport(node)
+
 	case *ast.LetStatement:
-		symbol := c.symbolTable.Define(node.Name.Value)
+		if node.Exported && !c.atTopLevel() {
+			return errorf(node.Token, "exports must be at the top level")
+		}
+
+		existing, ok := c.symbolTable.store[node.Name.Value]
+		if ok && existing.Const && existing.Scope != FreeScope {
+			return errorf(node.Name.Token, "cannot redeclare constant %s", node.Name.Value)
+		}
+
+		// A name is defined before its value is compiled, so functions can
+		// refer to themselves. When it shadows an outer binding, it is
+		// defined afterwards instead, so the value still sees the outer one.
+		shadows := !ok && c.symbolTable.isDefined(node.Name.Value)
+
+		define := c.symbolTable.Define
+		if node.Const {
+			define = c.symbolTable.DefineConst
+		}
+
+		var symbol Symbol
+		if !shadows {
+			symbol = define(node.Name.Value)
+		}
+
+		// Until the value of a new name is stored, only functions the value
+		// defines can read it
+		scope := &c.scopes[c.scopeIndex]
+		previous := scope.unset
+		if !ok && !shadows {
+			scope.unset = &symbol
+		}
 		err := c.Compile(node.Value)
+		c.scopes[c.scopeIndex].unset = previous
 		if err != nil {
 			return err
 		}
 
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
+		if shadows {
+			symbol = define(node.Name.Value)
+		}
+
+		c.storeSymbol(symbol)
+
+	case *ast.AssignExpression:
+		symbol, ok := c.symbolTable.Resolve(node.Name.Value)
+		if !ok {
+			return errorf(node.Name.Token, "cannot assign to undefined variable %s", node.Name.Value)
+		}
+
+		// Inside a named function its own name resolves to the closure being
+		// run; the binding it refers to is the one in the enclosing scope.
+		// Only a global one can be assigned from here, a local of the
+		// enclosing function is captured.
+		if symbol.Scope == FunctionScope {
+			if outer, ok := c.symbolTable.Outer.Resolve(node.Name.Value); ok && outer.Scope == GlobalScope {
+				symbol = outer
+			}
+		}
+
+		switch {
+		case symbol.Const:
+			return errorf(node.Name.Token, "cannot assign to constant %s", symbol.Name)
+		case symbol.Scope == BuiltinScope:
+			return errorf(node.Name.Token, "cannot assign to builtin %s", symbol.Name)
+		case symbol.Scope == PreludeScope:
+			return errorf(node.Name.Token, "cannot assign to prelude function %s", symbol.Name)
+		case symbol.Scope == FreeScope || symbol.Scope == FunctionScope:
+			return errorf(node.Name.Token, "cannot assign to captured variable %s", symbol.Name)
+		}
+
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
 		}
 
+		c.storeSymbol(symbol)
+		c.loadSymbol(symbol)
+
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
-		if !ok {
-			return fmt.Errorf("undefined variable %s", node.Value)
+		unset := c.scopes[c.scopeIndex].unset
+		if !ok || unset != nil && *unset == symbol {
+			return errorf(node.Token, "undefined variable %s", node.Value)
 		}
 
 		c.loadSymbol(symbol)
@@ -237,19 +372,16 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpHash, len(node.Pairs)*2)
 
-	case *ast.IndexExpression:
-		err := c.Compile(node.Left)
+	case *ast.IndexExpression, *ast.SliceExpression, *ast.CallExpression, *ast.MethodCallExpression:
+		jumps, err := c.compileChain(node.(ast.Expression))
 		if err != nil {
 			return err
 		}
 
-		err = c.Compile(node.Index)
-		if err != nil {
-			return err
+		for _, pos := range jumps {
+			c.changeOperand(pos, len(c.currentInstructions()))
 		}
 
-		c.emit(code.OpIndex)
-
 	case *ast.FunctionLiteral:
 		c.enterScope()
 
@@ -261,7 +393,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.symbolTable.Define(p.Value)
 		}
 
-		err := c.Compile(node.Body)
+		// The body shares the function's scope, so it can't shadow parameters
+		c.scopes[c.scopeIndex].tailCalls = tailCalls(node.Body.Statements)
+		err := c.compileStatements(node.Body.Statements)
 		if err != nil {
 			return err
 		}
@@ -274,71 +408,420 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 		freeSymbols := c.symbolTable.FreeSymbols
-		numLocals := c.symbolTable.numDefinitions
-		instructions := c.leaveScope()
+		numLocals := c.symbolTable.NumLocals()
+		instructions, handlers, positions := c.assemble()
+		c.leaveScope()
 
 		for _, s := range freeSymbols {
 			c.loadSymbol(s)
 		}
 
 		compiledFn := &object.CompiledFunction{
+			Name:          functionName(node),
 			Instructions:  instructions,
 			NumLocals:     numLocals,
 			NumParameters: len(node.Parameters),
+			Handlers:      handlers,
+			Positions:     object.NewPositionTable(positions),
 		}
 
 		fnIndex := c.addConstant(compiledFn)
 		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
 
+	case *ast.MacroLiteral:
+		return errorf(node.Token, "macros must be defined at the top level with let")
+
 	case *ast.ReturnStatement:
 		err := c.Compile(node.ReturnValue)
 		if err != nil {
 			return err
 		}
 
-		c.emit(code.OpReturnValue)
+		return c.emitReturn()
 
-	case *ast.CallExpression:
-		err := c.Compile(node.Function)
+	}
+
+	return c.err
+}
+
+// compileImport binds the exports of an imported module to its alias. The
+// first import of a module also compiles the module in place, so its code
+// runs once, before any code that uses it.
+func (c *Compiler) compileImport(node *ast.ImportStatement) error {
+	if !c.atTopLevel() {
+		return errorf(node.Token, "imports must be at the top level")
+	}
+	if node.Module == nil {
+		return errorf(node.Token, "unresolved import %q", node.Path)
+	}
+
+	existing, ok := c.symbolTable.store[node.Alias.Value]
+	if ok && existing.Const {
+		return errorf(node.Alias.Token, "cannot redeclare constant %s", node.Alias.Value)
+	}
+
+	exports, ok := c.symbolTable.modules[node.Resolved]
+	if !ok {
+		var err error
+		exports, err = c.compileModule(node.Module, node.Resolved)
 		if err != nil {
 			return err
 		}
+	}
 
-		for _, a := range node.Arguments {
-			err := c.Compile(a)
-			if err != nil {
-				return err
-			}
+	alias := c.symbolTable.Define(node.Alias.Value)
+	c.loadSymbol(exports)
+	c.storeSymbol(alias)
+
+	return nil
+}
+
+// compileModule compiles module with its own global symbol table and stores
+// a hash of its exported bindings in a new global, which it returns.
+func (c *Compiler) compileModule(module *ast.Program, path string) (Symbol, error) {
+	importer := c.symbolTable
+	c.symbolTable = NewModuleSymbolTable(importer)
+	defer func() { c.symbolTable = importer }()
+
+	err := c.compileStatements(module.Statements)
+	if err != nil {
+		return Symbol{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	exported := 0
+	for _, stmt := range module.Statements {
+		if let, ok := stmt.(*ast.LetStatement); ok && let.Exported {
+			name := &object.String{Value: let.Name.Value}
+			symbol, _ := c.symbolTable.Resolve(let.Name.Value)
+
+			c.emit(code.OpConstant, c.addConstant(name))
+			c.loadSymbol(symbol)
+			exported++
 		}
+	}
+	c.emit(code.OpHash, exported*2)
+
+	// The name can't clash with the module's own, since it can't be lexed
+	exports := c.symbolTable.Define("<exports>")
+	c.storeSymbol(exports)
+
+	importer.numDefinitions = c.symbolTable.numDefinitions
+	importer.modules[path] = exports
+
+	return exports, nil
+}
+
+// compileTry compiles a try expression. No instructions guard its blocks:
+// entries of the function's handler table cover them instead. The finally
+// block is compiled into every way out of them: after the try and the catch
+// blocks, before each return in them, and in a handler that runs it and
+// throws again the errors they don't catch.
+func (c *Compiler) compileTry(node *ast.TryExpression) error {
+	depth := c.depth()
+	exits := []int{}
+
+	body := c.enterTry(node.Finally)
+
+	start := len(c.currentInstructions())
+	err := c.Compile(node.Body)
+	if err != nil {
+		return err
+	}
+
+	if len(c.currentInstructions()) == start {
+		c.emit(code.OpNull)
+	} else {
+		c.keepBlockValue()
+	}
+	c.setDepth(depth + 1)
+
+	c.leaveTry(body)
+
+	err = c.compileFinally(node.Finally)
+	if err != nil {
+		return err
+	}
+	exits = append(exits, c.emit(code.OpJump, 9999))
+
+	var catch *tryBlock
+	if node.Catch != nil {
+		// The handler pushes the caught value, which is bound to the parameter
+		body.target = len(c.currentInstructions())
+		c.setDepth(depth + 1)
+
+		if node.Finally != nil {
+			catch = c.enterTry(node.Finally)
+		}
+
+		c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+		c.storeSymbol(c.symbolTable.Define(node.Parameter.Value))
 
-		c.emit(code.OpCall, len(node.Arguments))
+		err := c.compileStatements(node.Catch.Statements)
+		if err != nil {
+			return err
+		}
+
+		c.keepBlockValue()
+		c.setDepth(depth + 1)
+		c.symbolTable = c.symbolTable.Outer
+
+		if catch != nil {
+			c.leaveTry(catch)
+		}
+
+		err = c.compileFinally(node.Finally)
+		if err != nil {
+			return err
+		}
+		exits = append(exits, c.emit(code.OpJump, 9999))
+	}
+
+	if node.Finally != nil {
+		rethrow := body
+		if catch != nil {
+			rethrow = catch
+		}
+		rethrow.target = len(c.currentInstructions())
+		rethrow.rethrow = true
+		c.setDepth(depth + 1)
+
+		err := c.compileFinally(node.Finally)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
+	}
 
+	for _, pos := range exits {
+		c.changeOperand(pos, len(c.currentInstructions()))
 	}
+	c.setDepth(depth + 1)
 
+	c.addHandlers(body, depth)
+	if catch != nil {
+		c.addHandlers(catch, depth)
+	}
+
+	return nil
+}
+
+// compileFinally compiles a finally block, if any, discarding its value.
+func (c *Compiler) compileFinally(finally *ast.BlockStatement) error {
+	if finally == nil {
+		return nil
+	}
+	return c.Compile(finally)
+}
+
+// emitReturn returns the value on top of the stack, running the finally
+// blocks of the try blocks being returned from first, innermost first.
+func (c *Compiler) emitReturn() error {
+	tries := c.scopes[c.scopeIndex].tries
+
+	for i := len(tries) - 1; i >= 0; i-- {
+		// Errors in the finally block are left to the outer handlers
+		tries[i].close(len(c.currentInstructions()))
+		c.scopes[c.scopeIndex].tries = tries[:i]
+
+		err := c.compileFinally(tries[i].finally)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.scopes[c.scopeIndex].tries = tries
+	c.emit(code.OpReturnValue)
+
+	for _, try := range tries {
+		try.open(len(c.currentInstructions()))
+	}
+
+	return nil
+}
+
+// tryBlock tracks the instructions covered by a try or catch block, which
+// are split into several ranges around the finally blocks run by returns.
+type tryBlock struct {
+	finally *ast.BlockStatement
+	start   int
+	ranges  [][2]int
+	target  int
+	rethrow bool // the target runs the finally block and throws again
+}
+
+func (t *tryBlock) open(pos int) {
+	t.start = pos
+}
+
+func (t *tryBlock) close(pos int) {
+	if pos > t.start {
+		t.ranges = append(t.ranges, [2]int{t.start, pos})
+	}
+}
+
+func (c *Compiler) enterTry(finally *ast.BlockStatement) *tryBlock {
+	try := &tryBlock{finally: finally, start: len(c.currentInstructions())}
+	c.scopes[c.scopeIndex].tries = append(c.scopes[c.scopeIndex].tries, try)
+	return try
+}
+
+func (c *Compiler) leaveTry(try *tryBlock) {
+	try.close(len(c.currentInstructions()))
+
+	tries := c.scopes[c.scopeIndex].tries
+	c.scopes[c.scopeIndex].tries = tries[:len(tries)-1]
+}
+
+// addHandlers adds the handler table entries of try, which restore the
+// stack to depth.
+func (c *Compiler) addHandlers(try *tryBlock, depth int) {
+	for _, r := range try.ranges {
+		handler := object.Handler{
+			Start:      r[0],
+			End:        r[1],
+			Target:     try.target,
+			StackDepth: depth,
+			Rethrow:    try.rethrow,
+		}
+		c.scopes[c.scopeIndex].handlers = append(c.scopes[c.scopeIndex].handlers, handler)
+	}
+}
+
+// atTopLevel reports whether the code being compiled is a top-level
+// statement, outside any function or block.
+func (c *Compiler) atTopLevel() bool {
+	return c.scopeIndex == 0 && !c.symbolTable.block
+}
+
+func (c *Compiler) compileStatements(statements []ast.Statement) error {
+	for _, s := range statements {
+		err := c.Compile(s)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// keepBlockValue leaves the value of the block just compiled on the stack:
+// the value of its last expression statement, or null when it is empty or
+// ends with a let statement.
+func (c *Compiler) keepBlockValue() {
+	switch {
+	case c.lastInstructionIs(code.OpPop):
+		c.removeLastPop()
+	case !c.lastInstructionIs(code.OpReturnValue):
+		c.emit(code.OpNull)
+	}
+}
+
 func (c *Compiler) Bytecode() *Bytecode {
+	instructions, handlers, positions := c.assemble()
+
 	return &Bytecode{
-		Instructions: c.currentInstructions(),
+		Instructions: instructions,
 		Constants:    c.constants,
+		Handlers:     handlers,
+		Positions:    object.NewPositionTable(positions),
 	}
 }
 
-func (c *Compiler) addConstant(obj object.Object) int {
-	c.constants = append(c.constants, obj)
-	return len(c.constants) - 1
-}
-
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
+	c.checkOperands(op, operands)
+
 	ins := code.Make(op, operands...)
 	pos := c.addInstruction(ins)
 
+	c.addPosition(pos)
 	c.setLastInstruction(op, pos)
+	c.scopes[c.scopeIndex].depth += stackEffect(op, operands)
 
 	return pos
 }
 
+// operandNames names what the operands of instructions count or index, for
+// the errors of operands out of range.
+var operandNames = map[code.Opcode][]string{
+	code.OpConstant:      {"constants"},
+	code.OpJump:          {"instructions"},
+	code.OpJumpNotTruthy: {"instructions"},
+	code.OpJumpNull:      {"instructions"},
+	code.OpJumpNotNull:   {"instructions"},
+	code.OpGetGlobal:     {"global variables"},
+	code.OpSetGlobal:     {"global variables"},
+	code.OpArray:         {"array elements"},
+	code.OpHash:          {"hash elements"},
+	code.OpCall:          {"arguments"},
+	code.OpTailCall:      {"arguments"},
+	code.OpMethodCall:    {"constants", "arguments"},
+	code.OpGetLocal:      {"local variables"},
+	code.OpSetLocal:      {"local variables"},
+	code.OpGetBuiltin:    {"builtins"},
+	code.OpGetPrelude:    {"prelude functions"},
+	code.OpClosure:       {"constants", "free variables"},
+	code.OpGetFree:       {"free variables"},
+}
+
+// checkOperands records an error if an operand of op is out of range even
+// for a wide instruction, which code.Make would truncate.
+func (c *Compiler) checkOperands(op code.Opcode, operands []int) {
+	for i, operand := range operands {
+		if operand <= code.MaxOperand(op, i) || c.err != nil {
+			continue
+		}
+
+		name := "operands"
+		if names, ok := operandNames[op]; ok {
+			name = names[i]
+		}
+		c.err = errorf(c.pos, "too many %s: the limit is %d", name, code.MaxOperand(op, i))
+	}
+}
+
+// stackEffect returns how many values op pushes on the stack, less the ones
+// it pops.
+func stackEffect(op code.Opcode, operands []int) int {
+	switch op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull,
+		code.OpGetGlobal, code.OpGetLocal, code.OpGetBuiltin, code.OpGetPrelude,
+		code.OpGetFree, code.OpCurrentClosure,
+		code.OpGetLocal0, code.OpGetLocal1, code.OpGetLocal2, code.OpGetLocal3:
+		return 1
+	case code.OpPop, code.OpAdd, code.OpSub, code.OpMul, code.OpDiv,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan,
+		code.OpJumpNotTruthy,
+		code.OpSetGlobal, code.OpSetLocal, code.OpIndex, code.OpReturnValue,
+		code.OpThrow:
+		return -1
+	case code.OpArray, code.OpHash:
+		return 1 - operands[0]
+	case code.OpClosure:
+		return 1 - operands[1]
+	case code.OpCall, code.OpTailCall:
+		return -operands[0]
+	case code.OpCall0, code.OpCall1, code.OpCall2, code.OpCall3:
+		return -int(op - code.OpCall0)
+	case code.OpMethodCall:
+		return -operands[1]
+	case code.OpSlice:
+		return -3
+	default:
+		return 0
+	}
+}
+
+// depth returns the number of values the code compiled so far leaves on the
+// stack above the function's locals. Handlers restore it.
+func (c *Compiler) depth() int {
+	return c.scopes[c.scopeIndex].depth
+}
+
+// setDepth sets the depth where control flow joins, e.g. after an if
+// expression, since emit can only follow straight-line code.
+func (c *Compiler) setDepth(depth int) {
+	c.scopes[c.scopeIndex].depth = depth
+}
+
 func (c *Compiler) addInstruction(ins []byte) int {
 	posNewInstruction := len(c.currentInstructions())
 	updatedInstructions := append(c.currentInstructions(), ins...)
@@ -348,6 +831,60 @@ func (c *Compiler) addInstruction(ins []byte) int {
 	return posNewInstruction
 }
 
+// addPosition attributes the instruction at offset to the source position
+// of the node being compiled. Only changes of position are recorded.
+func (c *Compiler) addPosition(offset int) {
+	scope := &c.scopes[c.scopeIndex]
+	pos := object.Position{Offset: offset, File: c.pos.File, Line: c.pos.Line, Column: c.pos.Column}
+
+	last := object.Position{}
+	if n := len(scope.positions); n > 0 {
+		last = scope.positions[n-1]
+	}
+	if pos.File == last.File && pos.Line == last.Line && pos.Column == last.Column {
+		return
+	}
+
+	scope.positions = append(scope.positions, pos)
+}
+
+// functionName returns the name a function literal is known by at run
+// time, the same in the VM as in the evaluator.
+func functionName(node *ast.FunctionLiteral) string {
+	if node.Name != "" {
+		return node.Name
+	}
+	return object.AnonymousName(node.Token.Line, node.Token.Column)
+}
+
+// position returns the token that errors raised by the instructions node
+// compiles to are reported at, if it can raise any. The evaluator reports
+// its errors at the same tokens.
+func position(node ast.Node) (token.Token, bool) {
+	switch node := node.(type) {
+	case *ast.PrefixExpression:
+		return node.Token, true
+	case *ast.InfixExpression:
+		return node.Token, true
+	case *ast.CallExpression:
+		return node.Token, true
+	case *ast.MethodCallExpression:
+		return node.Token, true
+	case *ast.IndexExpression:
+		return node.Token, true
+	case *ast.SliceExpression:
+		return node.Token, true
+	case *ast.HashLiteral:
+		return node.Token, true
+	case *ast.ThrowStatement:
+		return node.Token, true
+	case *ast.FunctionLiteral:
+		return node.Token, true
+	default:
+		return token.Token{}, false
+	}
+}
+
 func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
 	previous := c.scopes[c.scopeIndex].lastInstruction
 	last := EmittedInstruction{Opcode: op, Position: pos}
@@ -373,6 +910,12 @@ func (c *Compiler) removeLastPop() {
 
 	c.scopes[c.scopeIndex].instructions = new
 	c.scopes[c.scopeIndex].lastInstruction = previous
+	c.scopes[c.scopeIndex].depth++
+
+	positions := c.scopes[c.scopeIndex].positions
+	if n := len(positions); n > 0 && positions[n-1].Offset == last.Position {
+		c.scopes[c.scopeIndex].positions = positions[:n-1]
+	}
 }
 
 func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
@@ -383,13 +926,114 @@ func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
 	}
 }
 
+// changeOperand sets the target of the jump at opPos. A target too far for
+// the jump's operand is set when the scope's instructions are assembled,
+// since the wide jump is longer and moves the instructions after it.
 func (c *Compiler) changeOperand(opPos int, operand int) {
 	op := code.Opcode(c.currentInstructions()[opPos])
-	newInstruction := code.Make(op, operand)
 
+	if code.IsWide(op, operand) {
+		c.checkOperands(op, []int{operand})
+
+		scope := &c.scopes[c.scopeIndex]
+		if scope.farJumps == nil {
+			scope.farJumps = make(map[int]int)
+		}
+		scope.farJumps[opPos] = operand
+		return
+	}
+
+	newInstruction := code.Make(op, operand)
 	c.replaceInstruction(opPos, newInstruction)
 }
 
+// compileChain compiles a chain of accesses and calls, like a?.b.c(d), and
+// returns its optional jumps (`?.`, `?[`). Each one skips the rest of the
+// whole chain when the value before it is null, leaving the null as the
+// chain's result, so the caller patches them to the end of the chain.
+func (c *Compiler) compileChain(node ast.Expression) ([]int, error) {
+	var left ast.Expression
+	var optional bool
+	switch node := node.(type) {
+	case *ast.IndexExpression:
+		left, optional = node.Left, node.Optional
+	case *ast.SliceExpression:
+		left, optional = node.Left, node.Optional
+	case *ast.MethodCallExpression:
+		left, optional = node.Receiver, node.Optional
+	case *ast.CallExpression:
+		left = node.Function
+	default:
+		return nil, c.Compile(node)
+	}
+
+	if tok, ok := position(node); ok {
+		outer := c.pos
+		c.pos = tok
+		defer func() { c.pos = outer }()
+	}
+
+	jumps, err := c.compileChain(left)
+	if err != nil {
+		return nil, err
+	}
+	if optional {
+		jumps = append(jumps, c.emit(code.OpJumpNull, 9999))
+	}
+
+	switch node := node.(type) {
+	case *ast.IndexExpression:
+		err := c.Compile(node.Index)
+		if err != nil {
+			return nil, err
+		}
+
+		c.emit(code.OpIndex)
+
+	case *ast.SliceExpression:
+		for _, bound := range []ast.Expression{node.Start, node.End, node.Step} {
+			if bound == nil {
+				c.emit(code.OpNull)
+				continue
+			}
+
+			err := c.Compile(bound)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		c.emit(code.OpSlice)
+
+	case *ast.MethodCallExpression:
+		for _, a := range node.Arguments {
+			err := c.Compile(a)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		name := &object.String{Value: node.Method.Value}
+		c.emit(code.OpMethodCall, c.addConstant(name), len(node.Arguments))
+
+	case *ast.CallExpression:
+		for _, a := range node.Arguments {
+			err := c.Compile(a)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		op := code.OpCall
+		if c.scopes[c.scopeIndex].tailCalls[node] {
+			op = code.OpTailCall
+		}
+		c.emit(op, len(node.Arguments))
+	}
+
+	return jumps, c.err
+}
+
 func (c *Compiler) currentInstructions() code.Instructions {
 	return c.scopes[c.scopeIndex].instructions
 }
@@ -417,6 +1061,54 @@ func (c *Compiler) leaveScope() code.Instructions {
 	return instructions
 }
 
+// tailCalls returns the calls in tail position of a function body: the call
+// ending it, or ending a branch of an if expression that ends it, and so on,
+// and the calls returned by its return statements, outside of expressions
+// other than if and of try blocks that handle their errors. The function returns their value, so
+// they are made as tail calls, which the VM makes in the caller's frame. The
+// evaluator makes the same calls in tail position.
+func tailCalls(body []ast.Statement) map[*ast.CallExpression]bool {
+	calls := map[*ast.CallExpression]bool{}
+
+	var collect func(statements []ast.Statement, tail bool)
+	collect = func(statements []ast.Statement, tail bool) {
+		for i, stmt := range statements {
+			last := tail && i == len(statements)-1
+
+			switch stmt := stmt.(type) {
+			case *ast.ReturnStatement:
+				if call, ok := stmt.ReturnValue.(*ast.CallExpression); ok {
+					calls[call] = true
+				}
+
+			case *ast.ExpressionStatement:
+				switch node := stmt.Expression.(type) {
+				case *ast.CallExpression:
+					if last {
+						calls[node] = true
+					}
+				case *ast.IfExpression:
+					collect(node.Consequence.Statements, last)
+					if node.Alternative != nil {
+						collect(node.Alternative.Statements, last)
+					}
+				case *ast.TryExpression:
+					// The finally block must run after the catch block
+					if node.Catch != nil && node.Finally == nil {
+						collect(node.Catch.Statements, false)
+					}
+					if node.Finally != nil {
+						collect(node.Finally.Statements, false)
+					}
+				}
+			}
+		}
+	}
+	collect(body, true)
+
+	return calls
+}
+
 func (c *Compiler) replaceLastPopWithReturn() {
 	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
 	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
@@ -432,6 +1124,8 @@ func (c *Compiler) loadSymbol(s Symbol) {
 		c.emit(code.OpGetLocal, s.Index)
 	case BuiltinScope:
 		c.emit(code.OpGetBuiltin, s.Index)
+	case PreludeScope:
+		c.emit(code.OpGetPrelude, s.Index)
 	case FreeScope:
 		c.emit(code.OpGetFree, s.Index)
 	case FunctionScope:
@@ -439,9 +1133,24 @@ func (c *Compiler) loadSymbol(s Symbol) {
 	}
 }
 
+func (c *Compiler) storeSymbol(s Symbol) {
+	if s.Scope == GlobalScope {
+		c.emit(code.OpSetGlobal, s.Index)
+	} else {
+		c.emit(code.OpSetLocal, s.Index)
+	}
+}
+
+// errorf returns a compile error prefixed with the line and column of tok.
+func errorf(tok token.Token, format string, a ...interface{}) error {
+	return fmt.Errorf("%d:%d: %s", tok.Line, tok.Column, fmt.Sprintf(format, a...))
+}
+
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	Handlers     []object.Handler
+	Positions    *object.PositionTable // of the main program's instructions
 }
 
 type EmittedInstruction struct {
@@ -453,4 +1162,12 @@ type CompilationScope struct {
 	instructions        code.Instructions
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+
+	depth     int // values on the stack after instructions run
+	handlers  []object.Handler
+	positions []object.Position
+	tries     []*tryBlock                  // the try and catch blocks being compiled
+	farJumps  map[int]int                  // the targets of the jumps too far for their operand
+	tailCalls map[*ast.CallExpression]bool // the calls made as tail calls
+	unset     *Symbol                      // the binding whose value is being compiled
 }
@@ -7,7 +7,10 @@ import (
 	"ash/object"
 	"ash/parser"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCompilerScopes(t *testing.T) {
@@ -170,11 +173,11 @@ func TestBooleanExpressions(t *testing.T) {
 		},
 		{
 			input:             "1 < 2",
-			expectedConstants: []interface{}{2, 1},
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
+				code.Make(code.OpLessThan),
 				code.Make(code.OpPop),
 			},
 		},
@@ -336,6 +339,155 @@ func TestGlobalLetStatements(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestAssignments(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			let x = 1;
+			x = 2;
+			`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			fn() { let x = 1; x = 2 }
+			`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompilerErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"const x = 1;\nx = 2;", "2:1: cannot assign to constant x"},
+		{"const x = 1; fn() { x = 2 }", "1:21: cannot assign to constant x"},
+		{"const x = 1; let x = 2;", "1:18: cannot redeclare constant x"},
+		{"y = 1", "1:1: cannot assign to undefined variable y"},
+		{"len = 1", "1:1: cannot assign to builtin len"},
+		{"fn(x) { fn() { x = 1 } }", "1:16: cannot assign to captured variable x"},
+		{"let outer = fn() { let a = 10; let f = fn(p, q) { f = 99; p + q }; f(1, 2) }; outer()", "1:51: cannot assign to captured variable f"},
+		{"map = 1", "1:1: cannot assign to prelude function map"},
+		{"loop", "1:1: undefined variable loop"},
+		{"unstack(null)", "1:1: undefined variable unstack"},
+		{"let x = x; print(x)", "1:9: undefined variable x"},
+		{"let y = y + 1", "1:9: undefined variable y"},
+		{"fn() { let y = if (true) { y } }", "1:28: undefined variable y"},
+		{"fn() { macro(x) { x } }", "1:8: macros must be defined at the top level with let"},
+		{`import "m" as m;`, `1:1: unresolved import "m"`},
+		{`fn() { import "m" as m; }`, "1:8: imports must be at the top level"},
+		{"if (true) { export let x = 1; }", "1:20: exports must be at the top level"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err == nil {
+			t.Fatalf("expected compiler error for %q", tt.input)
+		}
+
+		if err.Error() != tt.expectedError {
+			t.Errorf("wrong compiler error. want=%q, got=%q",
+				tt.expectedError, err.Error())
+		}
+	}
+}
+
+func TestOperandLimits(t *testing.T) {
+	var params []string
+	for i := 0; i < 70000; i++ {
+		params = append(params, identifier(i))
+	}
+	input := "fn(" + strings.Join(params, ", ") + ") { " + identifier(69999) + " }"
+
+	err := New().Compile(parse(input))
+	if err == nil {
+		t.Fatalf("expected compiler error for a function of %d parameters", len(params))
+	}
+	if err.Error() != "1:1: too many local variables: the limit is 65535" {
+		t.Errorf("wrong compiler error. got=%q", err)
+	}
+}
+
+// identifier returns a distinct identifier for i, which spells its digits
+// in letters since identifiers can't have digits.
+func identifier(i int) string {
+	return "p" + strings.Map(func(r rune) rune { return r - '0' + 'a' }, fmt.Sprint(i))
+}
+
+func TestConstantReuse(t *testing.T) {
+	tests := []struct {
+		input             string
+		expectedConstants []interface{}
+	}{
+		{`1; "a"; 1; "a"; 2 - 1`, []interface{}{1, "a", 2}},
+		{`fn() { "a" }; fn() { "a" }`, []interface{}{
+			"a",
+			[]code.Instructions{code.Make(code.OpConstant, 0), code.Make(code.OpReturnValue)},
+			// Its position differs from the first function's
+			[]code.Instructions{code.Make(code.OpConstant, 0), code.Make(code.OpReturnValue)},
+		}},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err := testConstants(t, tt.expectedConstants, compiler.Bytecode().Constants)
+		if err != nil {
+			t.Errorf("testConstants failed for %q: %s", tt.input, err)
+		}
+	}
+
+	// The REPL compiles each line with the constants of the previous ones,
+	// which the same line must not add to again
+	input := `let x = "a"; x + "b" + 1`
+	first := New()
+	if err := first.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	constants := first.Bytecode().Constants
+
+	second := NewWithState(first.symbolTable, constants)
+	if err := second.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	if n := len(second.Bytecode().Constants); n != len(constants) {
+		t.Errorf("wrong number of constants. want=%d, got=%d", len(constants), n)
+	}
+}
+
 func TestFunctions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -420,7 +572,7 @@ func TestBuiltins(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpGetBuiltin, 0),
 					code.Make(code.OpArray, 0),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -434,6 +586,44 @@ func TestBuiltins(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		tailCall bool
+	}{
+		{"fn(f) { f(1) }", true},
+		{"fn(f) { if (true) { return f(1) }; 2 }", true},
+		{"fn(f) { f(1); 2 }", false},
+		{"fn(f) { f(1) + 2 }", false},
+		{"fn(f) { if (true) { f(1) } }", true},
+		{"fn(f) { if (true) { 1 } else { if (false) { 2 } else { f(1) } } }", true},
+		{"fn(f) { if (true) { f(1) }; 2 }", false},
+		{"fn(f) { let x = if (true) { f(1) }; x }", false},
+		{"fn(f) { if (f(1)) { 2 } }", false},
+		{"fn(f) { try { if (true) { f(1) } } catch (e) { 2 } }", false},
+		{"fn(f) { try { return f(1) } catch (e) { 2 } }", false},
+		{"fn(f) { try { 1 } catch (e) { return f(1) } }", true},
+		{"fn(f) { try { 1 } catch (e) { return f(1) } finally { 2 } }", false},
+		{"fn(f) { try { 1 } finally { return f(1) } }", true},
+		{"fn(f) { [if (true) { return f(1) }] }", false},
+		{"fn(f) { 1 + if (true) { return f(1) } else { 2 } }", false},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		fn := compiler.Bytecode().Constants[len(compiler.Bytecode().Constants)-1]
+		instructions := fn.(*object.CompiledFunction).Instructions.String()
+		if strings.Contains(instructions, "OpTailCall") != tt.tailCall {
+			t.Errorf("wrong tail call for %q. want=%t, got:\n%s", tt.input, tt.tailCall, instructions)
+		}
+	}
+}
+
 func TestRecursiveFunctions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -448,16 +638,15 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
 					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
-				1,
 			},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpClosure, 1, 0),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpCall, 1),
 				code.Make(code.OpPop),
 			},
@@ -477,21 +666,20 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
 					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
-				1,
 				[]code.Instructions{
 					code.Make(code.OpClosure, 1, 0),
 					code.Make(code.OpSetLocal, 0),
 					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpConstant, 2),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpCall, 0),
@@ -509,6 +697,297 @@ type compilerTestCase struct {
 	expectedInstructions []code.Instructions
 }
 
+func TestConstantFolding(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 + 2 * 3",
+			expectedConstants: []interface{}{7},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-(10 / 3) < 2",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"as" + "h" == "ash"`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "!(true != false) == !5",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = 1; x + (2 - 1)",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 / 0",
+			expectedConstants: []interface{}{1, 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `1 + "a"`,
+			expectedConstants: []interface{}{1, "a"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		unoptimized := New()
+		if err := unoptimized.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		compiler := New()
+		compiler.SetOptimization(FoldConstants)
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := compiler.Bytecode()
+
+		if err := testInstructions(tt.expectedInstructions, bytecode.Instructions); err != nil {
+			t.Fatalf("testInstructions failed for %q: %s", tt.input, err)
+		}
+		if err := testConstants(t, tt.expectedConstants, bytecode.Constants); err != nil {
+			t.Fatalf("testConstants failed for %q: %s", tt.input, err)
+		}
+
+		before := len(unoptimized.Bytecode().Instructions)
+		if after := len(bytecode.Instructions); after > before {
+			t.Errorf("folding %q grew the bytecode from %d to %d bytes", tt.input, before, after)
+		}
+	}
+}
+
+func TestPeephole(t *testing.T) {
+	tests := []struct {
+		input                string
+		expectedInstructions []code.Instructions
+		expectedHandlers     []object.Handler
+	}{
+		{
+			// The jumps to the return are returns
+			input: "fn(n) { if (n) { 1 } else { 2 } }",
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpJumpNotTruthy, 9),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpReturnValue),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpReturnValue),
+			},
+		},
+		{
+			input: "fn(x) { x; 1 }",
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpReturnValue),
+			},
+		},
+		{
+			input: "fn() { return 1; 2 }",
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpReturnValue),
+			},
+		},
+		{
+			input: "fn(x) { x; try { x / 0 } catch (e) { 1 } }",
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpGetLocal, 0),
+				// 0002
+				code.Make(code.OpConstant, 0),
+				// 0005
+				code.Make(code.OpDiv),
+				// 0006
+				code.Make(code.OpReturnValue),
+				// 0007
+				code.Make(code.OpSetLocal, 1),
+				// 0009
+				code.Make(code.OpConstant, 1),
+				// 0012
+				code.Make(code.OpReturnValue),
+			},
+			expectedHandlers: []object.Handler{{Start: 0, End: 6, Target: 7}},
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		compiler.SetOptimization(Peephole)
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		constants := compiler.Bytecode().Constants
+		fn := constants[len(constants)-1].(*object.CompiledFunction)
+		if err := testInstructions(tt.expectedInstructions, fn.Instructions); err != nil {
+			t.Fatalf("testInstructions failed for %q: %s", tt.input, err)
+		}
+		if err := testHandlers(tt.expectedHandlers, fn.Handlers); err != nil {
+			t.Fatalf("testHandlers failed for %q: %s", tt.input, err)
+		}
+	}
+
+	// Positions move with the instructions they belong to
+	compiler := New()
+	compiler.SetOptimization(Peephole)
+	if err := compiler.Compile(parse("fn(x) {\n  x;\n  x / 0\n}")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	fn := compiler.Bytecode().Constants[1].(*object.CompiledFunction)
+	if pos := fn.Positions.Lookup(5); pos.Line != 3 || pos.Column != 5 {
+		t.Errorf("wrong position of OpDiv. want=3:5, got=%d:%d", pos.Line, pos.Column)
+	}
+}
+
+func TestOptimizingLargeFunctions(t *testing.T) {
+	var body strings.Builder
+	for i := 0; i < 4000; i++ {
+		fmt.Fprintf(&body, "if (x == %d) { x } else { %d };\n", i, i)
+	}
+	program := parse("let x = 1;\n" + body.String() + "let f = fn(x) {\n" + body.String() + "};")
+
+	// The best of a few runs, so a slow one doesn't fail the test
+	compileTime := func(level OptimizationLevel) time.Duration {
+		best := time.Duration(math.MaxInt64)
+		for i := 0; i < 3; i++ {
+			compiler := New()
+			compiler.SetOptimization(level)
+			start := time.Now()
+			if err := compiler.Compile(program); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+			compiler.Bytecode()
+			best = min(best, time.Since(start))
+		}
+		return best
+	}
+
+	// The optimizer runs a few passes, each linear in the instructions
+	unoptimized, optimized := compileTime(NoOptimization), compileTime(MaxOptimization)
+	if optimized > 5*unoptimized {
+		t.Errorf("optimizing takes too long. unoptimized=%s, optimized=%s", unoptimized, optimized)
+	}
+}
+
+func TestSuperinstructions(t *testing.T) {
+	tests := []struct {
+		input                string
+		level                OptimizationLevel
+		expectedInstructions []code.Instructions
+	}{
+		{
+			input: "fn(n, f) { if (n < 2) { return n }; f(n - 1) + 1 }",
+			level: Superinstructions,
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetLocal0),
+				code.Make(code.OpLessThanConst, 0),
+				code.Make(code.OpJumpNotTruthy, 9),
+				code.Make(code.OpGetLocal0),
+				code.Make(code.OpReturnValue),
+				code.Make(code.OpGetLocal1),
+				code.Make(code.OpGetLocal0),
+				code.Make(code.OpSubConst, 1),
+				code.Make(code.OpCall1),
+				code.Make(code.OpAddConst, 1),
+				code.Make(code.OpReturnValue),
+			},
+		},
+		{
+			input: "fn(n, f) { if (n < 2) { return n }; f(n - 1) + 1 }",
+			level: Peephole,
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpLessThan),
+				code.Make(code.OpJumpNotTruthy, 12),
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpReturnValue),
+				code.Make(code.OpGetLocal, 1),
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSub),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpReturnValue),
+			},
+		},
+		{
+			// The addition is a jump target, so its operand may not be the
+			// constant just before it
+			input: "let f = fn(a, b, c, d) { d + (if (a) { 1 } else { 2 }); f(a, b, c, d) }",
+			level: Superinstructions,
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetLocal3),
+				code.Make(code.OpGetLocal0),
+				code.Make(code.OpJumpNotTruthy, 11),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpJump, 14),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+				code.Make(code.OpCurrentClosure),
+				code.Make(code.OpGetLocal0),
+				code.Make(code.OpGetLocal1),
+				code.Make(code.OpGetLocal2),
+				code.Make(code.OpGetLocal3),
+				code.Make(code.OpTailCall, 4),
+				code.Make(code.OpReturnValue),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		compiler.SetOptimization(tt.level)
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		constants := compiler.Bytecode().Constants
+		fn := constants[len(constants)-1].(*object.CompiledFunction)
+		if err := testInstructions(tt.expectedInstructions, fn.Instructions); err != nil {
+			t.Fatalf("testInstructions failed for %q at level %d: %s", tt.input, tt.level, err)
+		}
+	}
+}
+
 func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	t.Helper()
 
@@ -652,14 +1131,14 @@ func TestIndexExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input:             "[1, 2, 3][1 + 1]",
-			expectedConstants: []interface{}{1, 2, 3, 1, 1},
+			expectedConstants: []interface{}{1, 2, 3},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpArray, 3),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpAdd),
 				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
@@ -667,13 +1146,13 @@ func TestIndexExpressions(t *testing.T) {
 		},
 		{
 			input:             "{1: 2}[2 - 1]",
-			expectedConstants: []interface{}{1, 2, 2, 1},
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpHash, 2),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSub),
 				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
@@ -684,6 +1163,152 @@ func TestIndexExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestSliceExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "[1, 2][1:]",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpNull),
+				code.Make(code.OpNull),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "[1, 2][:1:2]",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpNull),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestDotExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `{"a": 1}.a`,
+			expectedConstants: []interface{}{"a", 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"a".upper()`,
+			expectedConstants: []interface{}{"a", "upper"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMethodCall, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `[].push(1)`,
+			expectedConstants: []interface{}{1, "push"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMethodCall, 1, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestNullishAndOptionalExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `1 ?? 2`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpJumpNotNull, 10),
+				// 0006
+				code.Make(code.OpPop),
+				// 0007
+				code.Make(code.OpConstant, 1),
+				// 0010
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `[]?[0]`,
+			expectedConstants: []interface{}{0},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpArray, 0),
+				// 0003
+				code.Make(code.OpJumpNull, 10),
+				// 0006
+				code.Make(code.OpConstant, 0),
+				// 0009
+				code.Make(code.OpIndex),
+				// 0010
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"a"?.upper()`,
+			expectedConstants: []interface{}{"a", "upper"},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpJumpNull, 10),
+				// 0006
+				code.Make(code.OpMethodCall, 1, 0),
+				// 0010
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `null?.a.b`,
+			expectedConstants: []interface{}{"a", "b"},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpNull),
+				// 0001
+				code.Make(code.OpJumpNull, 12),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpIndex),
+				// 0008
+				code.Make(code.OpConstant, 1),
+				// 0011
+				code.Make(code.OpIndex),
+				// 0012
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestFunctionsWithoutReturnValue(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -795,6 +1420,120 @@ func TestFunctionCalls(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestBlockScopes(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			let x = 1;
+			if (true) { let x = x; x };
+			x;
+			`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpTrue),
+				// 0007
+				code.Make(code.OpJumpNotTruthy, 22),
+				// 0010
+				code.Make(code.OpGetGlobal, 0),
+				// 0013
+				code.Make(code.OpSetGlobal, 1),
+				// 0016
+				code.Make(code.OpGetGlobal, 1),
+				// 0019
+				code.Make(code.OpJump, 23),
+				// 0022
+				code.Make(code.OpNull),
+				// 0023
+				code.Make(code.OpPop),
+				// 0024
+				code.Make(code.OpGetGlobal, 0),
+				// 0027
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			let x = 1;
+			let x = 2;
+			`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input: `
+			fn() {
+				if (true) { let a = 1 } else { let b = 2 };
+				let c = 3;
+			}
+			`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				3,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpTrue),
+					// 0001
+					code.Make(code.OpJumpNotTruthy, 13),
+					// 0004
+					code.Make(code.OpConstant, 0),
+					// 0007
+					code.Make(code.OpSetLocal, 0),
+					// 0009
+					code.Make(code.OpNull),
+					// 0010
+					code.Make(code.OpJump, 19),
+					// 0013
+					code.Make(code.OpConstant, 1),
+					// 0016
+					code.Make(code.OpSetLocal, 0),
+					// 0018
+					code.Make(code.OpNull),
+					// 0019
+					code.Make(code.OpPop),
+					// 0020
+					code.Make(code.OpConstant, 2),
+					// 0023
+					code.Make(code.OpSetLocal, 0),
+					// 0025
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestBlockScopeErrors(t *testing.T) {
+	program := parse(`if (true) { let y = 1 }; y`)
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none.")
+	}
+
+	expected := "1:26: undefined variable y"
+	if err.Error() != expected {
+		t.Errorf("wrong compiler error. want=%q, got=%q", expected, err.Error())
+	}
+}
+
 func TestLetStatementScopes(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -975,6 +1714,178 @@ func TestClosures(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestTryExpressions(t *testing.T) {
+	tests := []struct {
+		input                string
+		expectedInstructions []code.Instructions
+		expectedHandlers     []object.Handler
+	}{
+		{
+			input: `try { 1 } catch (e) { e }`,
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpJump, 15),
+				// 0006
+				code.Make(code.OpSetGlobal, 0),
+				// 0009
+				code.Make(code.OpGetGlobal, 0),
+				// 0012
+				code.Make(code.OpJump, 15),
+				// 0015
+				code.Make(code.OpPop),
+			},
+			expectedHandlers: []object.Handler{
+				{Start: 0, End: 3, Target: 6, StackDepth: 0},
+			},
+		},
+		{
+			input: `try { 1 } finally { 2 }`,
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpConstant, 1),
+				// 0006
+				code.Make(code.OpPop),
+				// 0007
+				code.Make(code.OpJump, 15),
+				// 0010
+				code.Make(code.OpConstant, 1),
+				// 0013
+				code.Make(code.OpPop),
+				// 0014
+				code.Make(code.OpThrow),
+				// 0015
+				code.Make(code.OpPop),
+			},
+			expectedHandlers: []object.Handler{
+				{Start: 0, End: 3, Target: 10, StackDepth: 0, Rethrow: true},
+			},
+		},
+		{
+			input: `[1, try { throw 2 } catch (e) { 3 } finally { 4 }]`,
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpConstant, 1),
+				// 0006
+				code.Make(code.OpThrow),
+				// 0007
+				code.Make(code.OpNull),
+				// 0008
+				code.Make(code.OpConstant, 2),
+				// 0011
+				code.Make(code.OpPop),
+				// 0012
+				code.Make(code.OpJump, 33),
+				// 0015
+				code.Make(code.OpSetGlobal, 0),
+				// 0018
+				code.Make(code.OpConstant, 3),
+				// 0021
+				code.Make(code.OpConstant, 2),
+				// 0024
+				code.Make(code.OpPop),
+				// 0025
+				code.Make(code.OpJump, 33),
+				// 0028
+				code.Make(code.OpConstant, 2),
+				// 0031
+				code.Make(code.OpPop),
+				// 0032
+				code.Make(code.OpThrow),
+				// 0033
+				code.Make(code.OpArray, 2),
+				// 0036
+				code.Make(code.OpPop),
+			},
+			expectedHandlers: []object.Handler{
+				{Start: 3, End: 8, Target: 15, StackDepth: 1},
+				{Start: 15, End: 21, Target: 28, StackDepth: 1, Rethrow: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+
+		err = testInstructions(tt.expectedInstructions, bytecode.Instructions)
+		if err != nil {
+			t.Fatalf("testInstructions failed: %s", err)
+		}
+
+		err = testHandlers(tt.expectedHandlers, bytecode.Handlers)
+		if err != nil {
+			t.Fatalf("testHandlers failed: %s", err)
+		}
+	}
+}
+
+func TestReturnInsideTry(t *testing.T) {
+	input := `fn() { try { return 1 } finally { 2 } }`
+
+	program := parse(input)
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	constants := compiler.Bytecode().Constants
+	fn, ok := constants[len(constants)-1].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant is not CompiledFunction. got=%T", constants[len(constants)-1])
+	}
+
+	// The finally block runs before the return, outside of the handler
+	expectedInstructions := []code.Instructions{
+		// 0000
+		code.Make(code.OpConstant, 0),
+		// 0003
+		code.Make(code.OpConstant, 1),
+		// 0006
+		code.Make(code.OpPop),
+		// 0007
+		code.Make(code.OpReturnValue),
+		// 0008
+		code.Make(code.OpConstant, 1),
+		// 0011
+		code.Make(code.OpPop),
+		// 0012
+		code.Make(code.OpJump, 20),
+		// 0015
+		code.Make(code.OpConstant, 1),
+		// 0018
+		code.Make(code.OpPop),
+		// 0019
+		code.Make(code.OpThrow),
+		// 0020
+		code.Make(code.OpReturnValue),
+	}
+
+	err = testInstructions(expectedInstructions, fn.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	err = testHandlers([]object.Handler{{Start: 0, End: 3, Target: 15, Rethrow: true}}, fn.Handlers)
+	if err != nil {
+		t.Fatalf("testHandlers failed: %s", err)
+	}
+}
+
 func parse(input string) *ast.Program {
 	l := lexer.New(input)
 	p := parser.New(l)
@@ -1002,6 +1913,22 @@ func testInstructions(
 	return nil
 }
 
+func testHandlers(expected []object.Handler, actual []object.Handler) error {
+	if len(actual) != len(expected) {
+		return fmt.Errorf("wrong number of handlers.\nwant=%+v\ngot =%+v",
+			expected, actual)
+	}
+
+	for i, handler := range expected {
+		if actual[i] != handler {
+			return fmt.Errorf("wrong handler at %d.\nwant=%+v\ngot =%+v",
+				i, handler, actual[i])
+		}
+	}
+
+	return nil
+}
+
 func concatInstructions(s []code.Instructions) code.Instructions {
 	out := code.Instructions{}
 
@@ -1083,3 +2010,52 @@ func testStringObject(expected string, actual object.Object) error {
 
 	return nil
 }
+
+func TestPositions(t *testing.T) {
+	input := `1 + 2;
+let f = fn(x) {
+  x / 2
+};`
+
+	program := parser.New(lexer.NewFile("main.ash", input)).ParseProgram()
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	// 0000 OpConstant 0, 0003 OpConstant 1, 0006 OpAdd, 0007 OpPop,
+	// 0008 OpClosure 2 0, 0012 OpSetGlobal 0
+	expected := []object.Position{
+		{Offset: 0, File: "main.ash", Line: 1, Column: 3},
+		{Offset: 7, Line: 0, Column: 0},
+		{Offset: 8, File: "main.ash", Line: 2, Column: 9},
+		{Offset: 12, Line: 0, Column: 0},
+	}
+	testPositions(t, expected, bytecode.Positions.Entries())
+
+	// 0000 OpGetLocal 0, 0002 OpConstant 1, 0005 OpDiv, 0006 OpReturnValue
+	fn := bytecode.Constants[2].(*object.CompiledFunction)
+	expected = []object.Position{
+		{Offset: 0, File: "main.ash", Line: 3, Column: 5},
+		{Offset: 6, File: "main.ash", Line: 2, Column: 9},
+	}
+	testPositions(t, expected, fn.Positions.Entries())
+}
+
+func testPositions(t *testing.T, expected []object.Position, actual []object.Position) {
+	t.Helper()
+
+	if len(actual) != len(expected) {
+		t.Fatalf("wrong number of positions.\nwant=%+v\ngot =%+v", expected, actual)
+	}
+
+	for i, pos := range expected {
+		if actual[i] != pos {
+			t.Errorf("wrong position at %d. want=%+v, got=%+v", i, pos, actual[i])
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package compiler
+
+import (
+	"ash/object"
+	"strconv"
+)
+
+// constantKey identifies a constant by value: integers and strings by their
+// value.
+type constantKey struct {
+	typ   object.ObjectType
+	value string
+}
+
+// keyOf returns the key of obj, if constants like it can be reused. Only
+// integers and strings are: compiled functions also hold their names and
+// source positions, which tell apart even functions of the same code.
+func keyOf(obj object.Object) (constantKey, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return constantKey{obj.Type(), strconv.FormatInt(obj.Value, 10)}, true
+	case *object.String:
+		return constantKey{obj.Type(), obj.Value}, true
+	default:
+		return constantKey{}, false
+	}
+}
+
+// addConstant returns the index of obj in the constant pool, adding it
+// unless an equal constant is there already. Constants are immutable, so
+// every literal of a value can share one.
+func (c *Compiler) addConstant(obj object.Object) int {
+	key, ok := keyOf(obj)
+	if ok {
+		if i, found := c.constantIndexes[key]; found {
+			return i
+		}
+	}
+
+	c.constants = append(c.constants, obj)
+	index := len(c.constants) - 1
+
+	if ok {
+		c.constantIndexes[key] = index
+	}
+	return index
+}
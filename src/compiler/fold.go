@@ -0,0 +1,180 @@
+package compiler
+
+import (
+	"ash/ast"
+	"ash/code"
+	"ash/object"
+)
+
+// OptimizationLevel sets which optimizations the compiler makes. Each level
+// makes those of the levels below it too.
+type OptimizationLevel int
+
+const (
+	// NoOptimization compiles programs as written.
+	NoOptimization OptimizationLevel = iota
+	// FoldConstants evaluates operators on constants at compile time.
+	FoldConstants
+	// Peephole rewrites the instructions of each function, see peephole.
+	Peephole
+	// Superinstructions replaces common sequences of instructions with
+	// single ones, which the VM runs faster.
+	Superinstructions
+
+	MaxOptimization = Superinstructions
+)
+
+// SetOptimization sets the optimization level of the code compiled from now
+// on. It is NoOptimization by default.
+func (c *Compiler) SetOptimization(level OptimizationLevel) {
+	c.optimization = level
+}
+
+// emitFolded emits the constant value of node, if the optimization level
+// allows folding it and it has one, and reports whether it did.
+func (c *Compiler) emitFolded(node ast.Expression) bool {
+	if c.optimization < FoldConstants {
+		return false
+	}
+
+	value, ok := fold(node)
+	if !ok {
+		return false
+	}
+
+	switch value {
+	case object.TRUE:
+		c.emit(code.OpTrue)
+	case object.FALSE:
+		c.emit(code.OpFalse)
+	default:
+		c.emit(code.OpConstant, c.addConstant(value))
+	}
+	return true
+}
+
+// fold returns the value of node if it is made of literals and operators
+// which can't fail on them. Operations that raise errors, like division by
+// zero or mixing types, are left to raise them at run time.
+func fold(node ast.Expression) (object.Object, bool) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}, true
+
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}, true
+
+	case *ast.Boolean:
+		if node.Value {
+			return object.TRUE, true
+		}
+		return object.FALSE, true
+
+	case *ast.PrefixExpression:
+		right, ok := fold(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldPrefix(node.Operator, right)
+
+	case *ast.InfixExpression:
+		if node.Operator == "??" {
+			return nil, false
+		}
+
+		left, ok := fold(node.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := fold(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldInfix(node.Operator, left, right)
+
+	default:
+		return nil, false
+	}
+}
+
+func foldPrefix(operator string, right object.Object) (object.Object, bool) {
+	switch operator {
+	case "!":
+		// No constant is null, so only false is falsy
+		return nativeBoolToBooleanObject(right == object.FALSE), true
+	case "-":
+		if right, ok := right.(*object.Integer); ok {
+			return &object.Integer{Value: -right.Value}, true
+		}
+	}
+	return nil, false
+}
+
+func foldInfix(operator string, left, right object.Object) (object.Object, bool) {
+	switch left := left.(type) {
+	case *object.Integer:
+		right, ok := right.(*object.Integer)
+		if !ok {
+			return nil, false
+		}
+
+		switch operator {
+		case "+":
+			return &object.Integer{Value: left.Value + right.Value}, true
+		case "-":
+			return &object.Integer{Value: left.Value - right.Value}, true
+		case "*":
+			return &object.Integer{Value: left.Value * right.Value}, true
+		case "/":
+			if right.Value == 0 {
+				return nil, false
+			}
+			return &object.Integer{Value: left.Value / right.Value}, true
+		case ">":
+			return nativeBoolToBooleanObject(left.Value > right.Value), true
+		case "<":
+			return nativeBoolToBooleanObject(left.Value < right.Value), true
+		case "==":
+			return nativeBoolToBooleanObject(left.Value == right.Value), true
+		case "!=":
+			return nativeBoolToBooleanObject(left.Value != right.Value), true
+		}
+
+	case *object.String:
+		right, ok := right.(*object.String)
+		if !ok {
+			return nil, false
+		}
+
+		switch operator {
+		case "+":
+			return &object.String{Value: left.Value + right.Value}, true
+		case "==":
+			return nativeBoolToBooleanObject(left.Value == right.Value), true
+		case "!=":
+			return nativeBoolToBooleanObject(left.Value != right.Value), true
+		}
+
+	case *object.Boolean:
+		right, ok := right.(*object.Boolean)
+		if !ok {
+			return nil, false
+		}
+
+		switch operator {
+		case "==":
+			return nativeBoolToBooleanObject(left == right), true
+		case "!=":
+			return nativeBoolToBooleanObject(left != right), true
+		}
+	}
+
+	return nil, false
+}
+
+func nativeBoolToBooleanObject(input bool) *object.Boolean {
+	if input {
+		return object.TRUE
+	}
+	return object.FALSE
+}
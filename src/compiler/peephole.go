@@ -0,0 +1,358 @@
+package compiler
+
+import (
+	"ash/code"
+	"ash/object"
+)
+
+// instruction is an instruction decoded for the peephole optimizer.
+type instruction struct {
+	offset   int // in the instructions it was decoded from
+	op       code.Opcode
+	operands []int
+	removed  bool
+}
+
+// jumps are the opcodes whose operand is the offset they jump to.
+var jumps = map[code.Opcode]bool{
+	code.OpJump:          true,
+	code.OpJumpNotTruthy: true,
+	code.OpJumpNull:      true,
+	code.OpJumpNotNull:   true,
+}
+
+// pure are the opcodes that push a value without any other effect, so the
+// value can be dropped with them when it is popped right away.
+var pure = map[code.Opcode]bool{
+	code.OpConstant:       true,
+	code.OpTrue:           true,
+	code.OpFalse:          true,
+	code.OpNull:           true,
+	code.OpGetLocal:       true,
+	code.OpGetFree:        true,
+	code.OpGetBuiltin:     true,
+	code.OpGetPrelude:     true,
+	code.OpCurrentClosure: true,
+}
+
+// assemble returns the final instructions of the current scope, with its
+// handlers and positions. It sets the targets of the jumps too far for
+// their operand and, if the optimization level allows it, runs the
+// peephole optimizer:
+//
+//   - jumps to jumps go straight to the last target, and jumps to returns
+//     are returns;
+//   - jumps to the next instruction and unreachable instructions are
+//     removed;
+//   - in functions, values pushed only to be popped are not pushed;
+//   - common sequences are replaced by superinstructions, at the
+//     Superinstructions level.
+//
+// The main program keeps the values it pops, which the REPL prints.
+func (c *Compiler) assemble() (code.Instructions, []object.Handler, []object.Position) {
+	scope := c.scopes[c.scopeIndex]
+	if c.optimization < Peephole && len(scope.farJumps) == 0 {
+		return scope.instructions, scope.handlers, scope.positions
+	}
+
+	instructions := decode(scope.instructions)
+	for _, ins := range instructions {
+		if target, ok := scope.farJumps[ins.offset]; ok {
+			ins.operands[0] = target
+		}
+	}
+	l := newLayout(instructions, len(scope.instructions))
+
+	for changed := c.optimization >= Peephole; changed; {
+		changed = threadJumps(l)
+		changed = removeJumpsToNext(l) || changed
+		changed = removeUnreachable(l, scope.handlers) || changed
+		if c.scopeIndex > 0 {
+			changed = removePushPops(l, scope.handlers) || changed
+		}
+	}
+	if c.optimization >= Superinstructions {
+		selectSuperinstructions(l, scope.handlers)
+	}
+
+	return encode(instructions, scope.handlers, scope.positions, len(scope.instructions))
+}
+
+func decode(ins code.Instructions) []*instruction {
+	var decoded []*instruction
+
+	for i := 0; i < len(ins); {
+		op, operands, read, _ := code.ReadInstruction(ins[i:])
+		decoded = append(decoded, &instruction{offset: i, op: op, operands: operands})
+		i += read
+	}
+
+	return decoded
+}
+
+// layout looks up decoded instructions by offset, for the passes that
+// follow jumps, in constant time rather than by scanning the instructions,
+// which would make large functions take quadratic time.
+type layout struct {
+	instructions []*instruction
+	indexes      []int // the index of the first instruction at or after each offset
+	next         []int // for removed instructions, an index of a later one
+}
+
+// newLayout returns the layout of instructions decoded from length bytes.
+func newLayout(instructions []*instruction, length int) *layout {
+	l := &layout{
+		instructions: instructions,
+		indexes:      make([]int, length+1),
+		next:         make([]int, len(instructions)),
+	}
+
+	i := 0
+	for offset := range l.indexes {
+		for i < len(instructions) && instructions[i].offset < offset {
+			i++
+		}
+		l.indexes[offset] = i
+	}
+	for i := range l.next {
+		l.next[i] = i + 1
+	}
+
+	return l
+}
+
+// index returns the index of the instruction at offset, or the number of
+// instructions past the last one.
+func (l *layout) index(offset int) int {
+	if offset >= len(l.indexes) {
+		return len(l.instructions)
+	}
+	return l.indexes[offset]
+}
+
+// left returns the index of the instruction left at index i or, if it was
+// removed, of the next one. Instructions are never restored once removed,
+// so the removed ones it skips are pointed straight at the result.
+func (l *layout) left(i int) int {
+	j := i
+	for j < len(l.instructions) && l.instructions[j].removed {
+		j = l.next[j]
+	}
+	for i < j {
+		next := l.next[i]
+		l.next[i] = j
+		i = next
+	}
+	return j
+}
+
+// at returns the instruction left at offset or, if it was removed, the
+// next one. It returns nil past the last instruction.
+func (l *layout) at(offset int) *instruction {
+	if i := l.left(l.index(offset)); i < len(l.instructions) {
+		return l.instructions[i]
+	}
+	return nil
+}
+
+// threadJumps points the jumps to unconditional jumps at their targets,
+// and replaces unconditional jumps to returns with the returns.
+func threadJumps(l *layout) bool {
+	changed := false
+
+	for _, ins := range l.instructions {
+		if ins.removed || !jumps[ins.op] {
+			continue
+		}
+
+		// The bound keeps cycles of jumps from looping forever
+		for i := 0; i < len(l.instructions); i++ {
+			target := l.at(ins.operands[0])
+			if target == nil || target == ins {
+				break
+			}
+
+			if target.op == code.OpJump && target.operands[0] != ins.operands[0] {
+				ins.operands[0] = target.operands[0]
+				changed = true
+				continue
+			}
+			if ins.op == code.OpJump && (target.op == code.OpReturnValue || target.op == code.OpReturn) {
+				ins.op, ins.operands = target.op, nil
+				changed = true
+			}
+			break
+		}
+	}
+
+	return changed
+}
+
+func removeJumpsToNext(l *layout) bool {
+	changed := false
+
+	for i, ins := range l.instructions {
+		if ins.removed || ins.op != code.OpJump {
+			continue
+		}
+		if l.left(l.index(ins.operands[0])) == l.left(i+1) {
+			ins.removed = true
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// removeUnreachable removes the instructions that neither the start, the
+// handlers nor any jump leads to.
+func removeUnreachable(l *layout, handlers []object.Handler) bool {
+	instructions := l.instructions
+	reachable := make(map[*instruction]bool)
+
+	var visit func(i int)
+	visit = func(i int) {
+		for ; i < len(instructions); i++ {
+			ins := instructions[i]
+			if ins.removed {
+				continue
+			}
+			if reachable[ins] {
+				return
+			}
+			reachable[ins] = true
+
+			if jumps[ins.op] {
+				visit(l.index(ins.operands[0]))
+			}
+			switch ins.op {
+			case code.OpJump, code.OpReturnValue, code.OpReturn, code.OpThrow:
+				return
+			}
+		}
+	}
+
+	visit(0)
+	for _, h := range handlers {
+		visit(l.index(h.Target))
+	}
+
+	changed := false
+	for _, ins := range instructions {
+		if !ins.removed && !reachable[ins] {
+			ins.removed = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+// jumpTargets returns the instructions that jumps or handlers lead to.
+func jumpTargets(l *layout, handlers []object.Handler) map[*instruction]bool {
+	targets := make(map[*instruction]bool)
+	for _, ins := range l.instructions {
+		if !ins.removed && jumps[ins.op] {
+			targets[l.at(ins.operands[0])] = true
+		}
+	}
+	for _, h := range handlers {
+		targets[l.at(h.Target)] = true
+	}
+	return targets
+}
+
+// removePushPops removes the pure instructions followed by a pop of their
+// value, unless the pop is the target of a jump, which another value may
+// come from.
+func removePushPops(l *layout, handlers []object.Handler) bool {
+	targets := jumpTargets(l, handlers)
+
+	changed := false
+	var previous *instruction
+	for _, ins := range l.instructions {
+		if ins.removed {
+			continue
+		}
+
+		if ins.op == code.OpPop && previous != nil && pure[previous.op] && !targets[ins] {
+			previous.removed = true
+			ins.removed = true
+			previous = nil
+			changed = true
+			continue
+		}
+		previous = ins
+	}
+
+	return changed
+}
+
+// encode encodes the instructions left, of the length given before the
+// optimizations, and moves the offsets of the jumps, the handlers and the
+// positions to match. Offsets of removed instructions move to the next
+// instruction left.
+func encode(
+	instructions []*instruction,
+	handlers []object.Handler,
+	positions []object.Position,
+	length int,
+) (code.Instructions, []object.Handler, []object.Position) {
+	// Jumps get wide as their targets move too far, which moves the
+	// instructions after them in turn, until the layout settles
+	offsets := make(map[int]int, len(instructions)+1)
+	for size := -1; size != offsets[length]; {
+		size = offsets[length]
+
+		next := make(map[int]int, len(instructions)+1)
+		offset := 0
+		for _, ins := range instructions {
+			next[ins.offset] = offset
+			if ins.removed {
+				continue
+			}
+			if jumps[ins.op] {
+				offset += len(code.Make(ins.op, offsets[ins.operands[0]]))
+			} else {
+				offset += len(code.Make(ins.op, ins.operands...))
+			}
+		}
+		next[length] = offset
+		offsets = next
+	}
+	size := offsets[length]
+
+	encoded := make(code.Instructions, 0, size)
+	for _, ins := range instructions {
+		if ins.removed {
+			continue
+		}
+		if jumps[ins.op] {
+			encoded = append(encoded, code.Make(ins.op, offsets[ins.operands[0]])...)
+		} else {
+			encoded = append(encoded, code.Make(ins.op, ins.operands...)...)
+		}
+	}
+
+	var movedHandlers []object.Handler
+	for _, h := range handlers {
+		h.Start, h.End, h.Target = offsets[h.Start], offsets[h.End], offsets[h.Target]
+		if h.Start < h.End {
+			movedHandlers = append(movedHandlers, h)
+		}
+	}
+
+	// Of the positions moved to the same instruction, the last applies to it
+	var movedPositions []object.Position
+	for _, pos := range positions {
+		pos.Offset = offsets[pos.Offset]
+		if pos.Offset >= len(encoded) {
+			break
+		}
+		if n := len(movedPositions); n > 0 && movedPositions[n-1].Offset == pos.Offset {
+			movedPositions = movedPositions[:n-1]
+		}
+		movedPositions = append(movedPositions, pos)
+	}
+
+	return encoded, movedHandlers, movedPositions
+}
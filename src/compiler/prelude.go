@@ -0,0 +1,72 @@
+package compiler
+
+import (
+	"ash/object"
+	"ash/prelude"
+	"sync"
+)
+
+var (
+	preludeOnce    sync.Once
+	preludeValues  []object.Object
+	preludeSymbols []Symbol
+)
+
+// Prelude returns the values of the prelude, its compiled functions and the
+// builtins only it calls, indexed like the prelude symbols. The prelude is compiled once, the first time it is needed.
+func Prelude() []object.Object {
+	preludeOnce.Do(compilePrelude)
+	return preludeValues
+}
+
+// PreludeSymbols returns the symbols of the prelude's exported functions.
+func PreludeSymbols() []Symbol {
+	preludeOnce.Do(compilePrelude)
+	return preludeSymbols
+}
+
+// compilePrelude compiles each prelude function on its own, so it can be
+// called from any program. The prelude's names resolve to prelude symbols
+// rather than globals, and its functions share a constant pool of their own.
+func compilePrelude() {
+	functions := prelude.Functions()
+
+	symbolTable := NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
+	// The builtins only the prelude calls come before its functions in its
+	// values, but aren't exported
+	for i, v := range object.PreludeBuiltins {
+		symbolTable.DefinePrelude(i, v.Name)
+		preludeValues = append(preludeValues, v.Builtin)
+	}
+	for i, let := range functions {
+		symbolTable.DefinePrelude(len(object.PreludeBuiltins)+i, let.Name.Value)
+	}
+
+	c := NewWithState(symbolTable, []object.Object{})
+	c.SetOptimization(MaxOptimization)
+
+	for _, let := range functions {
+		err := c.Compile(let.Value)
+		if err != nil {
+			panic("prelude: " + err.Error())
+		}
+
+		// A function literal's own constant is added after its body's
+		fn := c.constants[len(c.constants)-1].(*object.CompiledFunction)
+		preludeValues = append(preludeValues, &object.Closure{Fn: fn})
+
+		if let.Exported {
+			preludeSymbols = append(preludeSymbols, symbolTable.store[let.Name.Value])
+		}
+	}
+
+	for _, constant := range c.constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			fn.Constants = c.constants
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package compiler
+
+import (
+	"ash/code"
+	"ash/object"
+	"testing"
+)
+
+func TestPrelude(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `map([], fn(x) { x })`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetPrelude, 4),
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpCall, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { sum }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetPrelude, 7),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `let sum = 1; sum`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestPreludeSymbols(t *testing.T) {
+	expected := []string{
+		"range", "reduce", "map", "filter", "join", "sum", "reverse", "any", "all",
+	}
+
+	symbols := PreludeSymbols()
+	if len(symbols) != len(expected) {
+		t.Fatalf("wrong number of prelude symbols. want=%d, got=%d",
+			len(expected), len(symbols))
+	}
+
+	values := Prelude()
+	for i, name := range expected {
+		symbol := symbols[i]
+		if symbol.Name != name || symbol.Scope != PreludeScope {
+			t.Errorf("symbols[%d] wrong. want=%s in %s, got=%+v",
+				i, name, PreludeScope, symbol)
+		}
+
+		closure, ok := values[symbol.Index].(*object.Closure)
+		if !ok {
+			t.Errorf("prelude function %s is not a closure. got=%T",
+				name, values[symbol.Index])
+			continue
+		}
+
+		if closure.Fn.Constants == nil {
+			t.Errorf("prelude function %s has no constant pool", name)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package compiler
+
+import (
+	"ash/code"
+	"ash/object"
+)
+
+// getLocals are the superinstructions of OpGetLocal by index.
+var getLocals = []code.Opcode{code.OpGetLocal0, code.OpGetLocal1, code.OpGetLocal2, code.OpGetLocal3}
+
+// calls are the superinstructions of OpCall by number of arguments.
+var calls = []code.Opcode{code.OpCall0, code.OpCall1, code.OpCall2, code.OpCall3}
+
+// constantOperations are the superinstructions of an operation on a
+// constant, by operation.
+var constantOperations = map[code.Opcode]code.Opcode{
+	code.OpAdd:      code.OpAddConst,
+	code.OpSub:      code.OpSubConst,
+	code.OpLessThan: code.OpLessThanConst,
+	code.OpEqual:    code.OpEqualConst,
+}
+
+// selectSuperinstructions replaces instructions with superinstructions. An
+// OpConstant and the operation after it are fused into the operation's
+// place, so errors are still located at the operation, unless the
+// operation is a jump target, which its operands may come to from elsewhere.
+func selectSuperinstructions(l *layout, handlers []object.Handler) {
+	targets := jumpTargets(l, handlers)
+
+	var previous *instruction
+	for _, ins := range l.instructions {
+		if ins.removed {
+			continue
+		}
+
+		switch {
+		case ins.op == code.OpGetLocal && ins.operands[0] < len(getLocals):
+			ins.op, ins.operands = getLocals[ins.operands[0]], nil
+
+		case ins.op == code.OpCall && ins.operands[0] < len(calls):
+			ins.op, ins.operands = calls[ins.operands[0]], nil
+
+		default:
+			fused, ok := constantOperations[ins.op]
+			if ok && previous != nil && previous.op == code.OpConstant && !targets[ins] &&
+				!code.IsWide(code.OpConstant, previous.operands...) {
+				previous.removed = true
+				ins.op, ins.operands = fused, previous.operands
+			}
+		}
+
+		previous = ins
+	}
+}
@@ -6,6 +6,7 @@ const (
 	LocalScope    SymbolScope = "LOCAL"
 	GlobalScope   SymbolScope = "GLOBAL"
 	BuiltinScope  SymbolScope = "BUILTIN"
+	PreludeScope  SymbolScope = "PRELUDE"
 	FreeScope     SymbolScope = "FREE"
 	FunctionScope SymbolScope = "FUNCTION"
 )
@@ -14,6 +15,7 @@ type Symbol struct {
 	Name  string
 	Scope SymbolScope
 	Index int
+	Const bool // defined with `const`, so it cannot be assigned to
 }
 
 type SymbolTable struct {
@@ -21,6 +23,12 @@ type SymbolTable struct {
 
 	store          map[string]Symbol
 	numDefinitions int
+	maxDefinitions int
+	block          bool
+
+	// modules maps the path of every module compiled so far to the global
+	// holding its exports. All tables of a compilation share it.
+	modules map[string]Symbol
 
 	FreeSymbols []Symbol
 }
@@ -28,37 +36,95 @@ type SymbolTable struct {
 func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	s := NewSymbolTable()
 	s.Outer = outer
+	s.modules = outer.modules
+	return s
+}
+
+// NewModuleSymbolTable returns the global table of a module imported from a
+// file whose global table is importer. The module has its own namespace, but
+// its globals take the slots after importer's, so both share the VM's
+// globals store.
+func NewModuleSymbolTable(importer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.modules = importer.modules
+	s.numDefinitions = importer.numDefinitions
+
+	for name, symbol := range importer.store {
+		if symbol.Scope == BuiltinScope || symbol.Scope == PreludeScope {
+			s.store[name] = symbol
+		}
+	}
+
+	return s
+}
+
+// NewBlockSymbolTable returns the table of a block nested in outer. The
+// block's symbols shadow outer's and disappear when the block ends. Inside a
+// function they take the local slots after outer's, which later blocks reuse.
+// At the top level they get fresh global slots instead, since closures refer
+// to globals by index.
+func NewBlockSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewEnclosedSymbolTable(outer)
+	s.block = true
+	s.numDefinitions = outer.numDefinitions
 	return s
 }
 
 func NewSymbolTable() *SymbolTable {
 	s := make(map[string]Symbol)
 	free := []Symbol{}
-	return &SymbolTable{store: s, FreeSymbols: free}
+	modules := make(map[string]Symbol)
+	return &SymbolTable{store: s, FreeSymbols: free, modules: modules}
 }
 
+// Define defines name in this table. Redefining a name of the same table
+// reuses its slot.
 func (s *SymbolTable) Define(name string) Symbol {
-	symbol := Symbol{Name: name, Index: s.numDefinitions}
-	if s.Outer == nil {
-		symbol.Scope = GlobalScope
+	if symbol, ok := s.store[name]; ok {
+		if symbol.Scope == GlobalScope || symbol.Scope == LocalScope {
+			symbol.Const = false
+			s.store[name] = symbol
+			return symbol
+		}
+	}
+
+	owner := s.owner()
+
+	var symbol Symbol
+	if owner.Outer == nil {
+		symbol = Symbol{Name: name, Scope: GlobalScope, Index: owner.numDefinitions}
+		owner.numDefinitions++
 	} else {
-		symbol.Scope = LocalScope
+		symbol = Symbol{Name: name, Scope: LocalScope, Index: s.numDefinitions}
+		s.numDefinitions++
+		owner.maxDefinitions = max(owner.maxDefinitions, s.numDefinitions)
 	}
 
 	s.store[name] = symbol
-	s.numDefinitions++
+	return symbol
+}
+
+// DefineConst defines an immutable symbol.
+func (s *SymbolTable) DefineConst(name string) Symbol {
+	symbol := s.Define(name)
+	symbol.Const = true
+	s.store[name] = symbol
 	return symbol
 }
 
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	obj, ok := s.store[name]
+	if !ok && s.block {
+		// Blocks share the frame of the enclosing function
+		return s.Outer.Resolve(name)
+	}
 	if !ok && s.Outer != nil {
 		obj, ok = s.Outer.Resolve(name)
 		if !ok {
 			return obj, ok
 		}
 
-		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope || obj.Scope == PreludeScope {
 			return obj, ok
 		}
 
@@ -74,6 +140,13 @@ func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	return symbol
 }
 
+// DefinePrelude defines name as the prelude function at index.
+func (s *SymbolTable) DefinePrelude(index int, name string) Symbol {
+	symbol := Symbol{Name: name, Index: index, Scope: PreludeScope}
+	s.store[name] = symbol
+	return symbol
+}
+
 func (s *SymbolTable) DefineFunctionName(name string) Symbol {
 	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
 	s.store[name] = symbol
@@ -85,7 +158,33 @@ func (s *SymbolTable) defineFree(original Symbol) Symbol {
 
 	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1}
 	symbol.Scope = FreeScope
+	symbol.Const = original.Const
 
 	s.store[original.Name] = symbol
 	return symbol
 }
+
+// NumLocals returns the number of local slots needed by the function owning
+// this table, including the slots of all its blocks.
+func (s *SymbolTable) NumLocals() int {
+	return max(s.numDefinitions, s.maxDefinitions)
+}
+
+// isDefined reports whether name is defined in this table or an enclosing
+// one. Unlike Resolve, it never defines free symbols.
+func (s *SymbolTable) isDefined(name string) bool {
+	for ; s != nil; s = s.Outer {
+		if _, ok := s.store[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// owner returns the function or global table whose slots this table uses.
+func (s *SymbolTable) owner() *SymbolTable {
+	for s.block {
+		s = s.Outer
+	}
+	return s
+}
@@ -186,6 +186,42 @@ func TestDefineResolveBuiltins(t *testing.T) {
 	}
 }
 
+func TestDefineResolvePrelude(t *testing.T) {
+	global := NewSymbolTable()
+	local := NewEnclosedSymbolTable(global)
+
+	expected := []Symbol{
+		{Name: "a", Scope: PreludeScope, Index: 1},
+		{Name: "b", Scope: PreludeScope, Index: 3},
+	}
+
+	for _, v := range expected {
+		global.DefinePrelude(v.Index, v.Name)
+	}
+
+	module := NewModuleSymbolTable(global)
+
+	for _, table := range []*SymbolTable{global, local, module} {
+		for _, sym := range expected {
+			result, ok := table.Resolve(sym.Name)
+
+			if !ok {
+				t.Errorf("name %s not resolvable", sym.Name)
+				continue
+			}
+
+			if result != sym {
+				t.Errorf("expected %s to resolve to %+v, got=%+v",
+					sym.Name, sym, result)
+			}
+		}
+	}
+
+	if len(local.FreeSymbols) != 0 {
+		t.Errorf("prelude symbols resolved as free. got=%+v", local.FreeSymbols)
+	}
+}
+
 func TestResolveFree(t *testing.T) {
 	global := NewSymbolTable()
 	global.Define("a")
@@ -334,3 +370,128 @@ func TestShadowingFunctionName(t *testing.T) {
 			expected.Name, expected, result)
 	}
 }
+
+func TestDefineConst(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	global.DefineConst("b")
+
+	local := NewEnclosedSymbolTable(global)
+	local.DefineConst("c")
+
+	nested := NewEnclosedSymbolTable(local)
+
+	expected := []struct {
+		table    *SymbolTable
+		expected Symbol
+	}{
+		{global, Symbol{Name: "a", Scope: GlobalScope, Index: 0}},
+		{global, Symbol{Name: "b", Scope: GlobalScope, Index: 1, Const: true}},
+		{local, Symbol{Name: "c", Scope: LocalScope, Index: 0, Const: true}},
+		{nested, Symbol{Name: "b", Scope: GlobalScope, Index: 1, Const: true}},
+		{nested, Symbol{Name: "c", Scope: FreeScope, Index: 0, Const: true}},
+	}
+
+	for _, tt := range expected {
+		result, ok := tt.table.Resolve(tt.expected.Name)
+		if !ok {
+			t.Errorf("name %s not resolvable", tt.expected.Name)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("expected %s to resolve to %+v, got=%+v",
+				tt.expected.Name, tt.expected, result)
+		}
+	}
+}
+
+func TestDefineInBlocks(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	globalBlock := NewBlockSymbolTable(global)
+	globalBlock.Define("a")
+	globalBlock.Define("b")
+
+	global.Define("c")
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("d")
+
+	firstBlock := NewBlockSymbolTable(local)
+	firstBlock.Define("e")
+	nestedBlock := NewBlockSymbolTable(firstBlock)
+	nestedBlock.Define("d")
+
+	secondBlock := NewBlockSymbolTable(local)
+	secondBlock.Define("f")
+
+	expected := []struct {
+		table    *SymbolTable
+		expected Symbol
+	}{
+		{global, Symbol{Name: "a", Scope: GlobalScope, Index: 0}},
+		{globalBlock, Symbol{Name: "a", Scope: GlobalScope, Index: 1}},
+		{globalBlock, Symbol{Name: "b", Scope: GlobalScope, Index: 2}},
+		{global, Symbol{Name: "c", Scope: GlobalScope, Index: 3}},
+		{local, Symbol{Name: "d", Scope: LocalScope, Index: 0}},
+		{firstBlock, Symbol{Name: "e", Scope: LocalScope, Index: 1}},
+		{firstBlock, Symbol{Name: "d", Scope: LocalScope, Index: 0}},
+		{nestedBlock, Symbol{Name: "d", Scope: LocalScope, Index: 2}},
+		{nestedBlock, Symbol{Name: "e", Scope: LocalScope, Index: 1}},
+		{secondBlock, Symbol{Name: "f", Scope: LocalScope, Index: 1}},
+		{secondBlock, Symbol{Name: "a", Scope: GlobalScope, Index: 0}},
+	}
+
+	for _, tt := range expected {
+		result, ok := tt.table.Resolve(tt.expected.Name)
+		if !ok {
+			t.Errorf("name %s not resolvable", tt.expected.Name)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("expected %s to resolve to %+v, got=%+v",
+				tt.expected.Name, tt.expected, result)
+		}
+	}
+
+	for _, name := range []string{"b", "e", "f"} {
+		if _, ok := local.Resolve(name); ok {
+			t.Errorf("block variable %s resolvable outside its block", name)
+		}
+	}
+
+	if local.NumLocals() != 3 {
+		t.Errorf("wrong number of locals. want=3, got=%d", local.NumLocals())
+	}
+}
+
+func TestRedefineReusesSlot(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	global.DefineConst("b")
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("c")
+
+	expected := []struct {
+		table    *SymbolTable
+		expected Symbol
+	}{
+		{global, Symbol{Name: "a", Scope: GlobalScope, Index: 0}},
+		{global, Symbol{Name: "b", Scope: GlobalScope, Index: 1}},
+		{local, Symbol{Name: "c", Scope: LocalScope, Index: 0}},
+	}
+
+	for _, tt := range expected {
+		result := tt.table.Define(tt.expected.Name)
+		if result != tt.expected {
+			t.Errorf("expected %s to be redefined as %+v, got=%+v",
+				tt.expected.Name, tt.expected, result)
+		}
+	}
+
+	if local.NumLocals() != 1 {
+		t.Errorf("wrong number of locals. want=1, got=%d", local.NumLocals())
+	}
+}
@@ -3,16 +3,60 @@ package evaluator
 import (
 	"ash/ast"
 	"ash/object"
+	"ash/token"
+	"context"
 	"fmt"
+	"sort"
 )
 
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL  = object.NULL
+	TRUE  = object.TRUE
+	FALSE = object.FALSE
 )
 
+// MaxFrames is the default limit of the depth of calls, like the VM's: the
+// top level and each call in progress count as a frame, and a call past the
+// limit raises a RuntimeError. It keeps deep recursion from exhausting the
+// Go stack.
+const MaxFrames = 1024
+
+// Options sets the limits of a program evaluated with EvalContext, like
+// vm.Options does for the VM.
+type Options struct {
+	MaxFrames int // MaxFrames if 0
+
+	// The budget of the program, unlimited if 0. See object.Budget.
+	MaxInstructions int64 // the number of nodes evaluated
+	MaxAllocations  int64
+}
+
+// EvalContext evaluates node in env like Eval, but stops it when ctx is done
+// or when it runs out of the budget of options. The error it stops it with
+// wraps ctx.Err(), object.ErrInstructionBudget or
+// object.ErrAllocationBudget, and the program can't catch it.
+func EvalContext(
+	ctx context.Context,
+	node ast.Node,
+	env *object.Environment,
+	options Options,
+) object.Object {
+	outer, outerMaxFrames := env.Budget(), env.MaxFrames()
+	env.SetBudget(object.NewBudget(ctx, options.MaxInstructions, options.MaxAllocations))
+	env.SetMaxFrames(options.MaxFrames)
+	defer func() {
+		env.SetBudget(outer)
+		env.SetMaxFrames(outerMaxFrames)
+	}()
+
+	return Eval(node, env)
+}
+
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	if err := env.Budget().Step(); err != nil {
+		return err
+	}
+
 	switch node := node.(type) {
 
 	// Statements
@@ -27,19 +71,44 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 
 	case *ast.ReturnStatement:
 		val := Eval(node.ReturnValue, env)
-		if isError(val) {
+		if isAbrupt(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
 
+	case *ast.ThrowStatement:
+		val := Eval(node.Value, env)
+		if isAbrupt(val) {
+			return val
+		}
+		return errorAt(node.Token, env, object.Throw(val))
+
+	case *ast.ImportStatement:
+		return evalImportStatement(node, env)
+
 	case *ast.LetStatement:
+		if node.Exported && !env.IsGlobal() {
+			return errorAt(node.Token, env, newError(object.SyntaxError, "exports must be at the top level"))
+		}
+
 		val := Eval(node.Value, env)
-		if isError(val) {
+		if isAbrupt(val) {
 			return val
 		}
-		env.Set(node.Name.Value, val)
+
+		if node.Const {
+			val = env.SetConst(node.Name.Value, val)
+		} else {
+			val = env.Set(node.Name.Value, val)
+		}
+		if err, ok := val.(*object.Error); ok {
+			return errorAt(node.Name.Token, env, err)
+		}
 
 	// Expressions
+	case *ast.AssignExpression:
+		return evalAssignExpression(node, env)
+
 	case *ast.IntegerLiteral:
 		return &object.Integer{Value: node.Value}
 
@@ -49,70 +118,75 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 
+	case *ast.NullLiteral:
+		return NULL
+
 	case *ast.PrefixExpression:
 		right := Eval(node.Right, env)
-		if isError(right) {
+		if isAbrupt(right) {
 			return right
 		}
-		return evalPrefixExpression(node.Operator, right)
+		return errorAt(node.Token, env, evalPrefixExpression(node.Operator, right))
 
 	case *ast.InfixExpression:
 		left := Eval(node.Left, env)
-		if isError(left) {
+		if isAbrupt(left) {
 			return left
 		}
 
+		if node.Operator == "??" {
+			if left != NULL {
+				return left
+			}
+			return Eval(node.Right, env)
+		}
+
 		right := Eval(node.Right, env)
-		if isError(right) {
+		if isAbrupt(right) {
 			return right
 		}
 
-		return evalInfixExpression(node.Operator, left, right)
+		result := evalInfixExpression(node.Operator, left, right)
+		if left.Type() == object.STRING_OBJ && node.Operator == "+" {
+			result = allocate(env, result)
+		}
+		return errorAt(node.Token, env, result)
 
 	case *ast.IfExpression:
 		return evalIfExpression(node, env)
 
+	case *ast.TryExpression:
+		return evalTryExpression(node, env, false)
+
 	case *ast.Identifier:
 		return evalIdentifier(node, env)
 
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Env: env, Body: body}
-
-	case *ast.CallExpression:
-		function := Eval(node.Function, env)
-		if isError(function) {
-			return function
+		name := node.Name
+		if name == "" {
+			name = object.AnonymousName(node.Token.Line, node.Token.Column)
 		}
+		fn := &object.Function{Name: name, Parameters: params, Env: env, Body: body}
+		return errorAt(node.Token, env, allocate(env, fn))
 
-		args := evalExpressions(node.Arguments, env)
-		if len(args) == 1 && isError(args[0]) {
-			return args[0]
-		}
+	case *ast.MacroLiteral:
+		return errorAt(node.Token, env, newError(object.SyntaxError, "macros must be defined at the top level with let"))
 
-		return applyFunction(function, args)
+	case *ast.CallExpression, *ast.MethodCallExpression, *ast.IndexExpression, *ast.SliceExpression:
+		result, _ := evalChain(node.(ast.Expression), env)
+		return result
 
 	case *ast.ArrayLiteral:
 		elements := evalExpressions(node.Elements, env)
-		if len(elements) == 1 && isError(elements[0]) {
+		if len(elements) == 1 && isAbrupt(elements[0]) {
 			return elements[0]
 		}
-		return &object.Array{Elements: elements}
-
-	case *ast.IndexExpression:
-		left := Eval(node.Left, env)
-		if isError(left) {
-			return left
-		}
-		index := Eval(node.Index, env)
-		if isError(index) {
-			return index
-		}
-		return evalIndexExpression(left, index)
+		return errorAt(node.Token, env, allocate(env, &object.Array{Elements: elements}))
 
 	case *ast.HashLiteral:
-		return evalHashLiteral(node, env)
+		return errorAt(node.Token, env, allocate(env, evalHashLiteral(node, env)))
 
 	}
 
@@ -136,13 +210,68 @@ func evalProgram(program *ast.Program, env *object.Environment) object.Object {
 	return result
 }
 
+// evalBlockStatement evaluates block in its own scope, so its let
+// statements shadow outer bindings only until the block ends.
 func evalBlockStatement(
 	block *ast.BlockStatement,
 	env *object.Environment,
+) object.Object {
+	return evalStatements(block.Statements, object.NewEnclosedEnvironment(env))
+}
+
+// evalTryExpression evaluates to the value of the try block, or of the catch
+// block if the try block raised an error. The finally block runs however
+// they end, and its own error or return takes precedence. In a function
+// body, tail evaluates the calls its blocks return in tail position to
+// tailCalls: those of the finally block, and of the catch block if there is
+// no finally block to run after them.
+func evalTryExpression(
+	node *ast.TryExpression,
+	env *object.Environment,
+	tail bool,
+) object.Object {
+	result := evalBlockStatement(node.Body, env)
+
+	// The errors that abort the program can't be caught
+	if err, ok := result.(*object.Error); ok && err.Cause != nil {
+		return err
+	}
+
+	if err, ok := result.(*object.Error); ok && node.Catch != nil {
+		catchEnv := object.NewEnclosedEnvironment(env)
+		catchEnv.Set(node.Parameter.Value, err.Payload())
+		if tail && node.Finally == nil {
+			result = evalTail(node.Catch.Statements, catchEnv, false)
+		} else {
+			result = evalStatements(node.Catch.Statements, catchEnv)
+		}
+		if err, ok := result.(*object.Error); ok && err.Cause != nil {
+			return err
+		}
+	}
+
+	if node.Finally != nil {
+		var finally object.Object
+		if tail {
+			finally = evalTail(node.Finally.Statements, object.NewEnclosedEnvironment(env), false)
+		} else {
+			finally = evalBlockStatement(node.Finally, env)
+		}
+		if rt := finally.Type(); rt == object.ERROR_OBJ || rt == object.RETURN_VALUE_OBJ {
+			return finally
+		}
+	}
+
+	return result
+}
+
+func evalStatements(
+	statements []ast.Statement,
+	env *object.Environment,
 ) object.Object {
 	var result object.Object
 
-	for _, statement := range block.Statements {
+	for _, statement := range statements {
 		result = Eval(statement, env)
 
 		if result != nil {
@@ -153,6 +282,11 @@ func evalBlockStatement(
 		}
 	}
 
+	// Like in the VM, a block without a final expression evaluates to null
+	if result == nil {
+		return NULL
+	}
+
 	return result
 }
 
@@ -170,7 +304,7 @@ func evalPrefixExpression(operator string, right object.Object) object.Object {
 	case "-":
 		return evalMinusPrefixOperatorExpression(right)
 	default:
-		return newError("unknown operator: %s%s", operator, right.Type())
+		return newError(object.TypeError, "unknown operator: %s%s", operator, right.Type())
 	}
 }
 
@@ -188,10 +322,10 @@ func evalInfixExpression(
 	case operator == "!=":
 		return nativeBoolToBooleanObject(left != right)
 	case left.Type() != right.Type():
-		return newError("type mismatch: %s %s %s",
+		return newError(object.TypeError, "type mismatch: %s %s %s",
 			left.Type(), operator, right.Type())
 	default:
-		return newError("unknown operator: %s %s %s",
+		return newError(object.TypeError, "unknown operator: %s %s %s",
 			left.Type(), operator, right.Type())
 	}
 }
@@ -211,7 +345,7 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 
 func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
 	if right.Type() != object.INTEGER_OBJ {
-		return newError("unknown operator: -%s", right.Type())
+		return newError(object.TypeError, "unknown operator: -%s", right.Type())
 	}
 
 	value := right.(*object.Integer).Value
@@ -233,6 +367,9 @@ func evalIntegerInfixExpression(
 	case "*":
 		return &object.Integer{Value: leftVal * rightVal}
 	case "/":
+		if rightVal == 0 {
+			return newError(object.ZeroDivisionError, "division by zero")
+		}
 		return &object.Integer{Value: leftVal / rightVal}
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
@@ -243,28 +380,36 @@ func evalIntegerInfixExpression(
 	case "!=":
 		return nativeBoolToBooleanObject(leftVal != rightVal)
 	default:
-		return newError("unknown operator: %s %s %s",
+		return newError(object.TypeError, "unknown operator: %s %s %s",
 			left.Type(), operator, right.Type())
 	}
 }
 
+// evalStringInfixExpression concatenates strings and compares them by
+// value, unlike other objects, which are equal only to themselves.
 func evalStringInfixExpression(
 	operator string,
 	left, right object.Object,
 ) object.Object {
-	if operator != "+" {
-		return newError("unknown operator: %s %s %s",
-			left.Type(), operator, right.Type())
-	}
-
 	leftVal := left.(*object.String).Value
 	rightVal := right.(*object.String).Value
-	return &object.String{Value: leftVal + rightVal}
+
+	switch operator {
+	case "+":
+		return &object.String{Value: leftVal + rightVal}
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
+		return newError(object.TypeError, "unknown operator: %s %s %s",
+			left.Type(), operator, right.Type())
+	}
 }
 
 func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
 	condition := Eval(ie.Condition, env)
-	if isError(condition) {
+	if isAbrupt(condition) {
 		return condition
 	}
 
@@ -285,11 +430,85 @@ func evalIdentifier(
 		return val
 	}
 
+	if fn, ok := lookupPrelude(node.Value); ok {
+		return fn
+	}
+
 	if builtin, ok := builtins[node.Value]; ok {
 		return builtin
 	}
 
-	return newError("identifier not found: " + node.Value)
+	return errorAt(node.Token, env, newError(object.NameError, "undefined variable %s", node.Value))
+}
+
+// evalImportStatement binds the exports of an imported module to its alias.
+// A module is evaluated in its own global environment the first time it is
+// imported, and its exports are cached for later imports.
+func evalImportStatement(
+	node *ast.ImportStatement,
+	env *object.Environment,
+) object.Object {
+	if !env.IsGlobal() {
+		return errorAt(node.Token, env, newError(object.SyntaxError, "imports must be at the top level"))
+	}
+	if node.Module == nil {
+		return errorAt(node.Token, env, newError(object.ImportError, "unresolved import %q", node.Path))
+	}
+
+	exports, ok := env.Module(node.Resolved)
+	if !ok {
+		moduleEnv := object.NewModuleEnvironment(env)
+
+		result := evalProgram(node.Module, moduleEnv)
+		if isAbrupt(result) {
+			return result
+		}
+
+		hash := &object.Hash{Pairs: map[object.HashKey]object.HashPair{}}
+		for _, stmt := range node.Module.Statements {
+			if let, ok := stmt.(*ast.LetStatement); ok && let.Exported {
+				key := &object.String{Value: let.Name.Value}
+				value, _ := moduleEnv.Get(let.Name.Value)
+				hash.Pairs[key.HashKey()] = object.HashPair{Key: key, Value: value}
+			}
+		}
+
+		exports = hash
+		env.SetModule(node.Resolved, exports)
+	}
+
+	val := env.Set(node.Alias.Value, exports)
+	if err, ok := val.(*object.Error); ok {
+		return errorAt(node.Alias.Token, env, err)
+	}
+
+	return nil
+}
+
+func evalAssignExpression(
+	node *ast.AssignExpression,
+	env *object.Environment,
+) object.Object {
+	val := Eval(node.Value, env)
+	if isAbrupt(val) {
+		return val
+	}
+
+	name := node.Name.Value
+	if _, ok := env.Get(name); !ok {
+		if _, ok := builtins[name]; ok {
+			return errorAt(node.Name.Token, env, newError(object.NameError, "cannot assign to builtin %s", name))
+		}
+		if _, ok := lookupPrelude(name); ok {
+			return errorAt(node.Name.Token, env, newError(object.NameError, "cannot assign to prelude function %s", name))
+		}
+	}
+
+	val = env.Assign(name, val)
+	if err, ok := val.(*object.Error); ok {
+		return errorAt(node.Name.Token, env, err)
+	}
+	return val
 }
 
 func isTruthy(obj object.Object) bool {
@@ -305,8 +524,51 @@ func isTruthy(obj object.Object) bool {
 	}
 }
 
-func newError(format string, a ...interface{}) *object.Error {
-	return &object.Error{Message: fmt.Sprintf(format, a...)}
+func newError(kind object.ErrorKind, format string, a ...interface{}) *object.Error {
+	return &object.Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
+}
+
+// errorAt locates obj at tok and records the calls in progress in env if it
+// is an error raised by the node of tok, rather than passed on from the
+// nodes it evaluated, which already did. The VM locates its errors at the
+// same tokens.
+func errorAt(tok token.Token, env *object.Environment, obj object.Object) object.Object {
+	if err, ok := obj.(*object.Error); ok && err.Trace == nil {
+		err.Locate(tok.File, tok.Line, tok.Column)
+		err.Trace = stackTrace(err, env)
+	}
+	return obj
+}
+
+// stackTrace returns the stack trace of err, raised in env. Each call is
+// at the position of the call it made in turn, and the innermost is where
+// err was raised.
+func stackTrace(err *object.Error, env *object.Environment) []object.TraceFrame {
+	var trace []object.TraceFrame
+
+	file, line, column := err.File, err.Line, err.Column
+	for call := env.Call(); call != nil; call = call.Caller {
+		trace = append(trace, object.TraceFrame{
+			Function: call.Function, File: file, Line: line, Column: column,
+		})
+		file, line, column = call.Token.File, call.Token.Line, call.Token.Column
+	}
+
+	return append(trace, object.TraceFrame{
+		Function: object.MainFunction, File: file, Line: line, Column: column,
+	})
+}
+
+// allocate charges obj, which the evaluator has just allocated, to the
+// budget of the program evaluated in env.
+func allocate(env *object.Environment, obj object.Object) object.Object {
+	if isError(obj) {
+		return obj
+	}
+	if err := env.Budget().Allocate(obj); err != nil {
+		return err
+	}
+	return obj
 }
 
 func isError(obj object.Object) bool {
@@ -316,6 +578,17 @@ func isError(obj object.Object) bool {
 	return false
 }
 
+// isAbrupt reports whether obj, the value of an expression, ends the
+// evaluation of the expressions around it: an error, or the value of a
+// return from inside it, which leaves the function like in the VM.
+func isAbrupt(obj object.Object) bool {
+	if obj != nil {
+		rt := obj.Type()
+		return rt == object.ERROR_OBJ || rt == object.RETURN_VALUE_OBJ
+	}
+	return false
+}
+
 func evalExpressions(
 	exps []ast.Expression,
 	env *object.Environment,
@@ -324,7 +597,7 @@ func evalExpressions(
 
 	for _, e := range exps {
 		evaluated := Eval(e, env)
-		if isError(evaluated) {
+		if isAbrupt(evaluated) {
 			return []object.Object{evaluated}
 		}
 		result = append(result, evaluated)
@@ -333,31 +606,202 @@ func evalExpressions(
 	return result
 }
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
-	switch fn := fn.(type) {
+// evalChain evaluates a chain of accesses and calls, like a?.b.c(d). An
+// optional access (`?.`, `?[`) whose left side is null skips the rest of the
+// whole chain, which is null then, and evalChain reports that it did.
+func evalChain(node ast.Expression, env *object.Environment) (object.Object, bool) {
+	switch node := node.(type) {
+	case *ast.CallExpression:
+		if node.Function.TokenLiteral() == "quote" {
+			if len(node.Arguments) != 1 {
+				return errorAt(node.Token, env, newError(object.ArgumentError,
+					"wrong number of arguments to quote: want=1, got=%d", len(node.Arguments))), false
+			}
+			return quote(node.Arguments[0], env), false
+		}
+
+		function, skipped := evalChain(node.Function, env)
+		if skipped || isAbrupt(function) {
+			return function, skipped
+		}
 
-	case *object.Function:
-		extendedEnv := extendFunctionEnv(fn, args)
-		evaluated := Eval(fn.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
+		args := evalExpressions(node.Arguments, env)
+		if len(args) == 1 && isAbrupt(args[0]) {
+			return args[0], false
+		}
 
-	case *object.Builtin:
-		result := fn.Fn(args...)
-		if result != nil {
-			return result
+		return applyFunction(function, args, node.Token, env), false
+
+	case *ast.MethodCallExpression:
+		receiver, skipped := evalChain(node.Receiver, env)
+		if skipped || isAbrupt(receiver) {
+			return receiver, skipped
 		}
-		return NULL
+		if node.Optional && receiver == NULL {
+			return NULL, true
+		}
+
+		args := evalExpressions(node.Arguments, env)
+		if len(args) == 1 && isAbrupt(args[0]) {
+			return args[0], false
+		}
+
+		return errorAt(node.Token, env, applyMethod(receiver, node.Method.Value, args, node.Token, env)), false
+
+	case *ast.IndexExpression:
+		left, skipped := evalChain(node.Left, env)
+		if skipped || isAbrupt(left) {
+			return left, skipped
+		}
+		if node.Optional && left == NULL {
+			return NULL, true
+		}
+		index := Eval(node.Index, env)
+		if isAbrupt(index) {
+			return index, false
+		}
+		result := evalIndexExpression(left, index)
+		if left.Type() == object.STRING_OBJ {
+			result = allocate(env, result)
+		}
+		return errorAt(node.Token, env, result), false
+
+	case *ast.SliceExpression:
+		left, skipped := evalChain(node.Left, env)
+		if skipped || isAbrupt(left) {
+			return left, skipped
+		}
+		if node.Optional && left == NULL {
+			return NULL, true
+		}
+		bounds := []object.Object{NULL, NULL, NULL}
+		for i, bound := range []ast.Expression{node.Start, node.End, node.Step} {
+			if bound == nil {
+				continue
+			}
+			bounds[i] = Eval(bound, env)
+			if isAbrupt(bounds[i]) {
+				return bounds[i], false
+			}
+		}
+		result := object.Slice(left, bounds[0], bounds[1], bounds[2])
+		return errorAt(node.Token, env, allocate(env, result)), false
 
 	default:
-		return newError("not a function: %s", fn.Type())
+		return Eval(node, env), false
+	}
+}
+
+// evalCallee evaluates the function and the arguments of a call. When that
+// fails, or an optional access before the call skips it, the last result is
+// the value of the call expression instead.
+func evalCallee(
+	node *ast.CallExpression,
+	env *object.Environment,
+) (object.Object, []object.Object, object.Object) {
+	function, skipped := evalChain(node.Function, env)
+	if skipped || isAbrupt(function) {
+		return nil, nil, function
+	}
+
+	args := evalExpressions(node.Arguments, env)
+	if len(args) == 1 && isAbrupt(args[0]) {
+		return nil, nil, args[0]
+	}
+
+	return function, args, nil
+}
+
+// applyFunction calls fn with args for the call expression at tok, made in
+// env. The tail calls of fn are made in turn in a loop, in place of the
+// call to fn, like the VM makes them in its frame.
+func applyFunction(
+	fn object.Object,
+	args []object.Object,
+	tok token.Token,
+	env *object.Environment,
+) object.Object {
+	site, caller := tok, env.Call()
+	depth := 1
+	if caller != nil {
+		depth = caller.Depth + 1
+	}
+	maxFrames := env.MaxFrames()
+	if maxFrames == 0 {
+		maxFrames = MaxFrames
+	}
+
+	for {
+		var result object.Object
+
+		switch fn := fn.(type) {
+		case *object.Function:
+			if len(args) != len(fn.Parameters) {
+				result = newError(object.ArgumentError, "wrong number of arguments to %s: want=%d, got=%d",
+					fn.Name, len(fn.Parameters), len(args))
+				break
+			}
+			if depth >= maxFrames {
+				result = newError(object.RuntimeError, "maximum call depth exceeded")
+				break
+			}
+
+			call := &object.Call{Function: fn.Name, Token: site, Caller: caller, Depth: depth}
+			fnEnv := extendFunctionEnv(fn, args, call)
+			fnEnv.SetBudget(env.Budget())
+			fnEnv.SetMaxFrames(env.MaxFrames())
+			result = evalFunctionBody(fn.Body, fnEnv)
+
+		case *object.Builtin:
+			result = fn.Fn(args...)
+			if result == nil {
+				result = NULL
+			} else {
+				result = allocate(env, result)
+			}
+
+		default:
+			result = newError(object.TypeError, "not a function: %s", fn.Type())
+		}
+
+		tc, ok := result.(*tailCall)
+		if !ok {
+			return errorAt(tok, env, result)
+		}
+		fn, args, tok, env = tc.fn, tc.args, tc.tok, tc.env
 	}
 }
 
+// applyMethod calls name on receiver. A hash field holding a function takes
+// precedence over the builtin methods, so hashes can be used as namespaces.
+func applyMethod(
+	receiver object.Object,
+	name string,
+	args []object.Object,
+	tok token.Token,
+	env *object.Environment,
+) object.Object {
+	if hash, ok := receiver.(*object.Hash); ok {
+		key := &object.String{Value: name}
+		if pair, ok := hash.Pairs[key.HashKey()]; ok {
+			return applyFunction(pair.Value, args, tok, env)
+		}
+	}
+
+	method, ok := object.GetMethod(receiver, name)
+	if !ok {
+		return newError(object.NameError, "undefined method %s for %s", name, receiver.Type())
+	}
+
+	return applyFunction(method, append([]object.Object{receiver}, args...), tok, env)
+}
+
 func extendFunctionEnv(
 	fn *object.Function,
 	args []object.Object,
+	call *object.Call,
 ) *object.Environment {
-	env := object.NewEnclosedEnvironment(fn.Env)
+	env := object.NewCallEnvironment(fn.Env, call)
 
 	for paramIdx, param := range fn.Parameters {
 		env.Set(param.Value, args[paramIdx])
@@ -378,10 +822,12 @@ func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalArrayIndexExpression(left, index)
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return evalStringIndexExpression(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
 	default:
-		return newError("index operator not supported: %s", left.Type())
+		return newError(object.TypeError, "index operator not supported: %s", left.Type())
 	}
 }
 
@@ -390,6 +836,10 @@ func evalArrayIndexExpression(array, index object.Object) object.Object {
 	idx := index.(*object.Integer).Value
 	max := int64(len(arrayObject.Elements) - 1)
 
+	if idx < 0 {
+		idx += max + 1
+	}
+
 	if idx < 0 || idx > max {
 		return NULL
 	}
@@ -397,25 +847,52 @@ func evalArrayIndexExpression(array, index object.Object) object.Object {
 	return arrayObject.Elements[idx]
 }
 
+func evalStringIndexExpression(str, index object.Object) object.Object {
+	value := str.(*object.String).Value
+	idx := index.(*object.Integer).Value
+	max := int64(len(value) - 1)
+
+	if idx < 0 {
+		idx += max + 1
+	}
+
+	if idx < 0 || idx > max {
+		return NULL
+	}
+
+	return &object.String{Value: value[idx : idx+1]}
+}
+
 func evalHashLiteral(
 	node *ast.HashLiteral,
 	env *object.Environment,
 ) object.Object {
 	pairs := make(map[object.HashKey]object.HashPair)
 
-	for keyNode, valueNode := range node.Pairs {
+	// Evaluate the pairs in the order the compiler compiles them, so side
+	// effects and errors come in the same order as in the VM
+	keyNodes := []ast.Expression{}
+	for k := range node.Pairs {
+		keyNodes = append(keyNodes, k)
+	}
+	sort.Slice(keyNodes, func(i, j int) bool {
+		return keyNodes[i].String() < keyNodes[j].String()
+	})
+
+	for _, keyNode := range keyNodes {
+		valueNode := node.Pairs[keyNode]
 		key := Eval(keyNode, env)
-		if isError(key) {
+		if isAbrupt(key) {
 			return key
 		}
 
 		hashKey, ok := key.(object.Hashable)
 		if !ok {
-			return newError("unusable as hash key: %s", key.Type())
+			return newError(object.TypeError, "unusable as hash key: %s", key.Type())
 		}
 
 		value := Eval(valueNode, env)
-		if isError(value) {
+		if isAbrupt(value) {
 			return value
 		}
 
@@ -431,7 +908,7 @@ func evalHashIndexExpression(hash, index object.Object) object.Object {
 
 	key, ok := index.(object.Hashable)
 	if !ok {
-		return newError("unusable as hash key: %s", index.Type())
+		return newError(object.TypeError, "unusable as hash key: %s", index.Type())
 	}
 
 	pair, ok := hashObject.Pairs[key.HashKey()]
@@ -2,8 +2,11 @@ package evaluator
 
 import (
 	"ash/lexer"
+	"ash/module"
 	"ash/object"
 	"ash/parser"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -55,6 +58,9 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"true == false", false},
 		{"true != false", true},
 		{"false != true", true},
+		{`"a" == "a"`, true},
+		{`"a" != "a"`, false},
+		{`"a" == "b"`, false},
 		{"(1 < 2) == true", true},
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
@@ -152,6 +158,10 @@ func TestReturnStatements(t *testing.T) {
             f(10);`,
 			20,
 		},
+		{"let f = fn() { [if (true) { return 7 }] }; f()", 7},
+		{"let g = fn() { 7 }; let f = fn() { [if (true) { return g() }] }; f()", 7},
+		{"let g = fn() { 7 }; fn() { print(if (true) { return g() } else { 2 }) }()", 7},
+		{"let g = fn() { 7 }; fn() { 1 + if (true) { return g() } else { 2 } }()", 7},
 	}
 
 	for _, tt := range tests {
@@ -167,35 +177,79 @@ func TestErrorHandling(t *testing.T) {
 	}{
 		{
 			"5 + true;",
-			"type mismatch: INTEGER + BOOLEAN",
+			"1:3: TypeError: type mismatch: INTEGER + BOOLEAN",
 		},
 		{
 			"5 + true; 5;",
-			"type mismatch: INTEGER + BOOLEAN",
+			"1:3: TypeError: type mismatch: INTEGER + BOOLEAN",
+		},
+		{
+			"const x = 1;\nx = 2;",
+			"2:1: NameError: cannot assign to constant x",
+		},
+		{
+			"const x = 1; let f = fn() { x = 2 }; f()",
+			"1:29: NameError: cannot assign to constant x",
+		},
+		{
+			"const x = 1; let x = 2;",
+			"1:18: NameError: cannot redeclare constant x",
+		},
+		{
+			"y = 1",
+			"1:1: NameError: cannot assign to undefined variable y",
+		},
+		{
+			"if (true) { let y = 1 }; y",
+			"1:26: NameError: undefined variable y",
+		},
+		{
+			"unstack(null)",
+			"1:1: NameError: undefined variable unstack",
+		},
+		{
+			"let x = x; print(x)",
+			"1:9: NameError: undefined variable x",
+		},
+		{
+			"let y = y + 1",
+			"1:9: NameError: undefined variable y",
+		},
+		{
+			"len = 1",
+			"1:1: NameError: cannot assign to builtin len",
+		},
+		{
+			"let f = fn(x) { fn() { x = 1 } }; f(1)()",
+			"1:24: NameError: cannot assign to captured variable x",
+		},
+		{
+			"let outer = fn() { let a = 10; let f = fn(p, q) { f = 99; p + q }; f(1, 2) }; outer()",
+			"1:51: NameError: cannot assign to captured variable f",
 		},
 		{
 			"-true",
-			"unknown operator: -BOOLEAN",
+			"1:1: TypeError: unknown operator: -BOOLEAN",
 		},
 		{
 			"true + false;",
-			"unknown operator: BOOLEAN + BOOLEAN",
+			"1:6: TypeError: unknown operator: BOOLEAN + BOOLEAN",
 		},
 		{
 			"true + false + true + false;",
-			"unknown operator: BOOLEAN + BOOLEAN",
+			"1:6: TypeError: unknown operator: BOOLEAN + BOOLEAN",
 		},
 		{
 			"5; true + false; 5",
-			"unknown operator: BOOLEAN + BOOLEAN",
+			"1:9: TypeError: unknown operator: BOOLEAN + BOOLEAN",
 		},
 		{
 			`"Hello" - "World"`,
-			"unknown operator: STRING - STRING",
+			"1:9: TypeError: unknown operator: STRING - STRING",
 		},
 		{
 			"if 10 > 1 { true + false; }",
-			"unknown operator: BOOLEAN + BOOLEAN",
+			"1:18: TypeError: unknown operator: BOOLEAN + BOOLEAN",
 		},
 		{
 			`
@@ -207,19 +261,51 @@ func TestErrorHandling(t *testing.T) {
                 return 1;
             }
             `,
-			"unknown operator: BOOLEAN + BOOLEAN",
+			"4:33: TypeError: unknown operator: BOOLEAN + BOOLEAN",
 		},
 		{
 			"foobar",
-			"identifier not found: foobar",
+			"1:1: NameError: undefined variable foobar",
 		},
 		{
 			`{"name": "ash"}[fn(x) { x }];`,
-			"unusable as hash key: FUNCTION",
+			"1:16: TypeError: unusable as hash key: FUNCTION",
 		},
 		{
 			`999[1]`,
-			"index operator not supported: INTEGER",
+			"1:4: TypeError: index operator not supported: INTEGER",
+		},
+		{
+			`1.foo()`,
+			"1:2: NameError: undefined method foo for INTEGER",
+		},
+		{
+			`[1, 2, 3][::0]`,
+			"1:10: ValueError: slice step cannot be zero",
+		},
+		{
+			`[1, 2, 3]["a":]`,
+			"1:10: TypeError: slice indices must be INTEGER, got STRING",
+		},
+		{
+			`{}[1:2]`,
+			"1:3: TypeError: slice operator not supported: HASH",
+		},
+		{
+			"map = 1",
+			"1:1: NameError: cannot assign to prelude function map",
+		},
+		{
+			`import "m" as m;`,
+			`1:1: ImportError: unresolved import "m"`,
+		},
+		{
+			`fn() { import "m" as m; }()`,
+			"1:8: SyntaxError: imports must be at the top level",
+		},
+		{
+			"if (true) { export let x = 1; }",
+			"1:20: SyntaxError: exports must be at the top level",
 		},
 	}
 
@@ -233,9 +319,9 @@ func TestErrorHandling(t *testing.T) {
 			continue
 		}
 
-		if errObj.Message != tt.expectedMessage {
+		if errObj.Error() != tt.expectedMessage {
 			t.Errorf("wrong error message. expected=%q, got=%q",
-				tt.expectedMessage, errObj.Message)
+				tt.expectedMessage, errObj.Error())
 		}
 	}
 }
@@ -256,6 +342,51 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestAssignments(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let x = 1; x = 2; x", 2},
+		{"let x = 1; x = x + 1", 2},
+		{"let x = 1; let y = 2; x = y = 3; x + y", 6},
+		{"const x = 1; let y = x; y = 2; x + y", 3},
+		{"let n = 0; let inc = fn() { n = n + 1 }; inc(); inc(); n", 2},
+		{"let f = fn() { let x = 1; x = x + 1; x }; f()", 2},
+		{"let f = fn(x) { x = x * 2; x }; f(4)", 8},
+		{"let f = fn() { 1 }; f = fn() { 2 }; f()", 2},
+		{"let f = fn() { f = 2; 1 }; f() + f", 3},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestBlockScopes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let x = 1; if (true) { let x = 2; }; x", 1},
+		{"let x = 1; if (true) { x = 2 }; x", 2},
+		{"let x = 1; if (true) { let x = x + 1; x }", 2},
+		{"let x = 1; let x = x + 1; x", 2},
+		{"let f = fn() { let a = 1; if (true) { let a = 2; a = 3 }; a }; f()", 1},
+		{"let f = fn() { if (true) { let a = 1; a } + if (true) { let b = 2; b } }; f()", 3},
+		{"let g = if (true) { let v = 5; fn() { v } }; g()", 5},
+		{"let f = fn() { let g = if (true) { let v = 5; fn() { v } }; let w = 6; g() + w }; f()", 11},
+		{"let f = fn(x) { let x = x * 2; x }; f(2)", 4},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+
+	testNullObject(t, testEval("if (true) { let a = 1 }"))
+	testNullObject(t, testEval("if (false) { 1 } else { }"))
+}
+
 func TestFunctionObject(t *testing.T) {
 	input := "fn(x) { x + 2; };"
 
@@ -327,6 +458,155 @@ func TestClosures(t *testing.T) {
 	testIntegerObject(t, testEval(input), 4)
 }
 
+func TestArrowFunctions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let double = x => x * 2; double(4)", 8},
+		{"let add = (a, b) => a + b; add(1, 2)", 3},
+		{"let one = () => 1; one()", 1},
+		{"let apply = (f, x) => f(x); apply(x => x - 1, 10)", 9},
+		{"let adder = a => b => a + b; adder(1)(2)", 3},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestPipelineExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"[1, 2, 3] |> len", 3},
+		{"[1, 2] |> push(3) |> rest |> first", 2},
+		{"let add = (a, b) => a + b; 1 |> add(2) |> add(3)", 6},
+		{"5 |> x => x * 2", 10},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestModules(t *testing.T) {
+	dir := t.TempDir()
+	writeModules(t, dir, map[string]string{
+		"math.ash": `
+			let secret = 42;
+			export let add = fn(a, b) { a + b };
+			export let addSecret = fn(x) { x + secret };
+			export const pi = 3;
+		`,
+		"lib/util.ash": `
+			import "../math" as m;
+			export let twice = fn(x) { m.add(x, x) };
+			export let math = m;
+		`,
+	})
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`import "math" as math; math.add(1, 2)`, 3},
+		{`import "math.ash" as math; math.pi`, 3},
+		{`import "math" as math; math.addSecret(1)`, 43},
+		{`import "math" as math; math.secret`, nil},
+		{`let secret = 1; import "math" as math; math.addSecret(secret) + secret`, 44},
+		{`import "lib/util" as util; util.twice(4)`, 8},
+		{`import "math" as a; import "math" as b; a == b`, true},
+		{`import "math" as a; import "lib/util" as util; a == util.math`, true},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+
+		loader := module.NewLoader(nil)
+		err := loader.Resolve(program, filepath.Join(dir, "main.ash"))
+		if err != nil {
+			t.Fatalf("import error: %s", err)
+		}
+
+		evaluated := Eval(program, object.NewEnvironment())
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestPrelude(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"sum(range(1, 101))", 5050},
+		{"reduce([1, 2, 3], 10, fn(acc, x) { acc * 2 + x })", 91},
+		{"len(filter(range(0, 10), fn(x) { x > 6 }))", 3},
+		{"map([1, 2, 3], fn(x) { x * 2 })[2]", 6},
+		{"any([1, 2, 3], fn(x) { x > 2 })", true},
+		{"let map = fn(x) { x }; map(1)", 1},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		}
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"try { throw 1 } catch (e) { e + 1 }", 2},
+		{"try { 5 + true } catch (e) { e.message }", "type mismatch: INTEGER + BOOLEAN"},
+		{"try { foo } catch (e) { e.message }", "undefined variable foo"},
+		{"let x = 1; try { throw 2 } catch (x) { x }; x", 1},
+		{"let f = fn() { try { return 1 } finally { throw 2 } }; try { f() } catch (e) { e }", 2},
+		{`throw "oops"`, "oops"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			if errObj, ok := evaluated.(*object.Error); ok {
+				if errObj.Message != expected {
+					t.Errorf("wrong error message. expected=%q, got=%q",
+						expected, errObj.Message)
+				}
+				continue
+			}
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("object is not String. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("String has wrong value. got=%q, want=%q", str.Value, expected)
+			}
+		}
+	}
+}
+
 func TestStringLiteral(t *testing.T) {
 	input := `"Hello World!"`
 
@@ -364,7 +644,7 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
 		{`len(1)`, "argument to `len` not supported, got INTEGER"},
-		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
+		{`len("one", "two")`, "wrong number of arguments: want=1, got=2"},
 		{`len([1, 2, 3])`, 3},
 		{`len([])`, 0},
 		{`print("hello", "world!")`, nil},
@@ -452,7 +732,9 @@ func TestArrayIndexExpressions(t *testing.T) {
 		{"let arr = [1, 2, 3]; arr[0] + arr[1] + arr[2];", 6},
 		{"let arr = [1, 2, 3]; let i = arr[0]; arr[i]", 2},
 		{"[1, 2, 3][3]", nil},
-		{"[1, 2, 3][-1]", nil},
+		{"[1, 2, 3][-1]", 3},
+		{"[1, 2, 3][-3]", 1},
+		{"[1, 2, 3][-4]", nil},
 	}
 
 	for _, tt := range tests {
@@ -466,6 +748,101 @@ func TestArrayIndexExpressions(t *testing.T) {
 	}
 }
 
+func TestSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1, 2, 3, 4][1:3]", "[2, 3]"},
+		{"[1, 2, 3, 4][:2]", "[1, 2]"},
+		{"[1, 2, 3, 4][2:]", "[3, 4]"},
+		{"[1, 2, 3, 4][:]", "[1, 2, 3, 4]"},
+		{"[1, 2, 3, 4][-2:]", "[3, 4]"},
+		{"[1, 2, 3, 4][:-1]", "[1, 2, 3]"},
+		{"[1, 2, 3, 4][::2]", "[1, 3]"},
+		{"[1, 2, 3, 4][::-1]", "[4, 3, 2, 1]"},
+		{"[1, 2, 3, 4][2::-1]", "[3, 2, 1]"},
+		{"[1, 2, 3, 4][-100:100]", "[1, 2, 3, 4]"},
+		{"[1, 2, 3, 4][3:1]", "[]"},
+		{`"hello"[1:3]`, "el"},
+		{`"hello"[2:]`, "llo"},
+		{`"hello"[::-1]`, "olleh"},
+		{`"hello"[-1]`, "o"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong slice. want=%q, got=%q",
+				tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestDotExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let person = {"name": "ash"}; person.name`, "ash"},
+		{`let config = {"db": {"port": 5432}}; config.db.port`, "5432"},
+		{`{"a": 1}.b`, "null"},
+		{`"abc".upper()`, "ABC"},
+		{`"a,b,c".split(",").len()`, "3"},
+		{`"abc".contains("b")`, "true"},
+		{`[1, 2].push(3)`, "[1, 2, 3]"},
+		{`[1, 2, 3].join("-")`, "1-2-3"},
+		{`{"a": 1, "b": 2}.keys()`, "[a, b]"},
+		{`let math = {"double": x => x * 2}; math.double(4)`, "8"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong result. want=%q, got=%q",
+				tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestNullishAndOptionalExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`1 ?? 2`, "1"},
+		{`{}.a ?? 2`, "2"},
+		{`false ?? 2`, "false"},
+		{`{}.a ?? {}.b ?? 3`, "3"},
+		{`let cfg = {"db": {"port": 1}}; cfg?.db?.port ?? 0`, "1"},
+		{`let cfg = {"db": {}}; cfg?.db?.port ?? 0`, "0"},
+		{`let cfg = {}; cfg.db?.port`, "null"},
+		{`let cfg = {}; cfg.db?["port"] ?? 80`, "80"},
+		{`let xs = {}; xs.items?[1:]`, "null"},
+		{`let s = {}; s.name?.upper()`, "null"},
+		{`let s = {"name": "ash"}; s.name?.upper()`, "ASH"},
+		{`1 ?? 1.foo()`, "1"},
+		{`let f = fn(x) { x?.y ?? "default" }; f({"y": "set"}) + f({})`, "setdefault"},
+		{`null`, "null"},
+		{`let x = null; x ?? 5`, "5"},
+		{`let h = null; h?.a.b`, "null"},
+		{`let h = null; h?.a.b()`, "null"},
+		{`let h = null; h?["f"](1)[0]`, "null"},
+		{`let h = {"a": {}}; h?.a.b`, "null"},
+		{`let h = {"a": null}; h.a?.b.c ?? 5`, "5"},
+		{`let f = fn(h) { h?.g(1) }; f(null)`, "null"},
+		{`let f = fn(h) { return h?["g"](1) }; f(null)`, "null"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong result. want=%q, got=%q",
+				tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
 func TestHashLiterals(t *testing.T) {
 	input := `
     let two = "two";
@@ -531,6 +908,22 @@ func TestHashIndexExpressions(t *testing.T) {
 		}
 	}
 }
+
+// writeModules writes files, keyed by their path, to dir.
+func writeModules(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func testEval(input string) object.Object {
 	l := lexer.New(input)
 	p := parser.New(l)
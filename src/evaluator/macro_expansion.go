@@ -0,0 +1,164 @@
+package evaluator
+
+import (
+	"ash/ast"
+	"ash/object"
+	"fmt"
+)
+
+// DefineMacros binds the top-level `let name = macro(...) { ... }`
+// statements of program in env and removes them from program.
+func DefineMacros(program *ast.Program, env *object.Environment) {
+	statements := []ast.Statement{}
+
+	for _, statement := range program.Statements {
+		if isMacroDefinition(statement) {
+			addMacro(statement, env)
+			continue
+		}
+		statements = append(statements, statement)
+	}
+
+	program.Statements = statements
+}
+
+func isMacroDefinition(node ast.Statement) bool {
+	letStatement, ok := node.(*ast.LetStatement)
+	if !ok {
+		return false
+	}
+
+	_, ok = letStatement.Value.(*ast.MacroLiteral)
+	return ok
+}
+
+func addMacro(stmt ast.Statement, env *object.Environment) {
+	letStatement := stmt.(*ast.LetStatement)
+	macroLiteral := letStatement.Value.(*ast.MacroLiteral)
+
+	macro := &object.Macro{
+		Parameters: macroLiteral.Parameters,
+		Env:        env,
+		Body:       macroLiteral.Body,
+	}
+
+	env.Set(letStatement.Name.Value, macro)
+}
+
+// Expand defines the macros of program in env and expands their calls,
+// returning the program to compile or evaluate.
+func Expand(program *ast.Program, env *object.Environment) (*ast.Program, error) {
+	DefineMacros(program, env)
+
+	expanded, err := ExpandMacros(program, env)
+	if err != nil {
+		return nil, err
+	}
+
+	return expanded.(*ast.Program), nil
+}
+
+// ExpandMacros replaces every call of a macro defined in env with the code
+// the macro returns, which is expanded in turn. It runs before a program is
+// compiled or evaluated, and leaves program itself unchanged.
+func ExpandMacros(program ast.Node, env *object.Environment) (ast.Node, error) {
+	return expandMacros(program, env, 0)
+}
+
+// maxExpansionDepth bounds how deeply macros may expand into other macro
+// calls, so a macro that always expands into itself fails cleanly.
+const maxExpansionDepth = 256
+
+func expandMacros(
+	program ast.Node,
+	env *object.Environment,
+	depth int,
+) (ast.Node, error) {
+	var err error
+
+	expanded := ast.Modify(program, func(node ast.Node) ast.Node {
+		call, ok := node.(*ast.CallExpression)
+		if !ok || err != nil {
+			return node
+		}
+
+		macro, ok := isMacroCall(call, env)
+		if !ok {
+			return node
+		}
+
+		if depth == maxExpansionDepth {
+			err = fmt.Errorf("%d:%d: macro expansion of %s too deep",
+				call.Token.Line, call.Token.Column, call.Function)
+			return node
+		}
+
+		if len(call.Arguments) != len(macro.Parameters) {
+			err = fmt.Errorf("%d:%d: wrong number of arguments to macro %s: want=%d, got=%d",
+				call.Token.Line, call.Token.Column, call.Function,
+				len(macro.Parameters), len(call.Arguments))
+			return node
+		}
+
+		evalEnv := extendMacroEnv(macro, quoteArgs(call))
+		evaluated := unwrapReturnValue(Eval(macro.Body, evalEnv))
+
+		quote, ok := evaluated.(*object.Quote)
+		if !ok {
+			err = fmt.Errorf("%d:%d: macro %s must return a quote, got %s",
+				call.Token.Line, call.Token.Column, call.Function, evaluated.Inspect())
+			return node
+		}
+
+		var result ast.Node
+		result, err = expandMacros(quote.Node, env, depth+1)
+		return result
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return expanded, nil
+}
+
+func isMacroCall(
+	exp *ast.CallExpression,
+	env *object.Environment,
+) (*object.Macro, bool) {
+	identifier, ok := exp.Function.(*ast.Identifier)
+	if !ok {
+		return nil, false
+	}
+
+	obj, ok := env.Get(identifier.Value)
+	if !ok {
+		return nil, false
+	}
+
+	macro, ok := obj.(*object.Macro)
+	return macro, ok
+}
+
+func quoteArgs(exp *ast.CallExpression) []*object.Quote {
+	args := []*object.Quote{}
+
+	for _, a := range exp.Arguments {
+		args = append(args, &object.Quote{Node: a})
+	}
+
+	return args
+}
+
+func extendMacroEnv(
+	macro *object.Macro,
+	args []*object.Quote,
+) *object.Environment {
+	extended := object.NewMacroEnvironment(macro.Env)
+
+	for paramIdx, param := range macro.Parameters {
+		extended.Set(param.Value, args[paramIdx])
+	}
+
+	return extended
+}
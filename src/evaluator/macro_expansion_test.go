@@ -0,0 +1,295 @@
+package evaluator
+
+import (
+	"ash/ast"
+	"ash/lexer"
+	"ash/object"
+	"ash/parser"
+	"testing"
+)
+
+func TestDefineMacros(t *testing.T) {
+	input := `
+	let number = 1;
+	let function = fn(x, y) { x + y };
+	let mymacro = macro(x, y) { x + y; };
+	`
+
+	env := object.NewEnvironment()
+	program := testParseProgram(input)
+
+	DefineMacros(program, env)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("Wrong number of statements. got=%d",
+			len(program.Statements))
+	}
+
+	_, ok := env.Get("number")
+	if ok {
+		t.Fatalf("number should not be defined")
+	}
+	_, ok = env.Get("function")
+	if ok {
+		t.Fatalf("function should not be defined")
+	}
+
+	obj, ok := env.Get("mymacro")
+	if !ok {
+		t.Fatalf("macro not in environment.")
+	}
+
+	macro, ok := obj.(*object.Macro)
+	if !ok {
+		t.Fatalf("object is not Macro. got=%T (%+v)", obj, obj)
+	}
+
+	if len(macro.Parameters) != 2 {
+		t.Fatalf("Wrong number of macro parameters. got=%d",
+			len(macro.Parameters))
+	}
+
+	if macro.Parameters[0].String() != "x" {
+		t.Fatalf("parameter is not 'x'. got=%q", macro.Parameters[0])
+	}
+	if macro.Parameters[1].String() != "y" {
+		t.Fatalf("parameter is not 'y'. got=%q", macro.Parameters[1])
+	}
+
+	expectedBody := "(x + y)"
+
+	if macro.Body.String() != expectedBody {
+		t.Fatalf("body is not %q. got=%q", expectedBody, macro.Body.String())
+	}
+}
+
+func TestExpandMacros(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`
+			let infixExpression = macro() { quote(1 + 2); };
+
+			infixExpression();
+			`,
+			`(1 + 2)`,
+		},
+		{
+			`
+			let reverse = macro(a, b) { quote(unquote(b) - unquote(a)); };
+
+			reverse(2 + 2, 10 - 5);
+			`,
+			`(10 - 5) - (2 + 2)`,
+		},
+		{
+			`
+			let unless = macro(condition, consequence, alternative) {
+				quote(if (!(unquote(condition))) {
+					unquote(consequence);
+				} else {
+					unquote(alternative);
+				});
+			};
+
+			unless(10 > 5, print("not greater"), print("greater"));
+			`,
+			`if (!(10 > 5)) { print("not greater") } else { print("greater") }`,
+		},
+		{
+			`
+			let double = macro(x) { quote(unquote(x) * 2) };
+			let quadruple = macro(x) { quote(double(double(unquote(x)))) };
+
+			quadruple(1);
+			`,
+			`(1 * 2) * 2`,
+		},
+		{
+			`
+			let assert = macro(cond) {
+				quote(if (!(unquote(cond))) { "failed: " + unquote(str(cond)) });
+			};
+
+			assert(1 + 1 == 3);
+			`,
+			`if (!(1 + 1 == 3)) { "failed: " + "((1 + 1) == 3)" }`,
+		},
+	}
+
+	for _, tt := range tests {
+		expected := testParseProgram(tt.expected)
+		program := testParseProgram(tt.input)
+
+		env := object.NewEnvironment()
+		DefineMacros(program, env)
+		expanded, err := ExpandMacros(program, env)
+		if err != nil {
+			t.Fatalf("macro expansion failed: %s", err)
+		}
+
+		if expanded.String() != expected.String() {
+			t.Errorf("not equal. want=%q, got=%q",
+				expected.String(), expanded.String())
+		}
+	}
+}
+
+func TestExpandMacrosLeavesMacroReusable(t *testing.T) {
+	input := `
+	let double = macro(x) { quote(unquote(x) * 2) };
+	double(1);
+	double(2);
+	`
+
+	program := testParseProgram(input)
+	env := object.NewEnvironment()
+	DefineMacros(program, env)
+
+	expanded, err := ExpandMacros(program, env)
+	if err != nil {
+		t.Fatalf("macro expansion failed: %s", err)
+	}
+
+	expected := "(1 * 2)(2 * 2)"
+	if expanded.String() != expected {
+		t.Errorf("not equal. want=%q, got=%q", expected, expanded.String())
+	}
+}
+
+func TestMacroHygiene(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{
+			// The macro's tmp must not capture the caller's tmp
+			`
+			let withTmp = macro(x) { quote(fn() { let tmp = 100; unquote(x) }()) };
+			let tmp = 7;
+			withTmp(tmp);
+			`,
+			7,
+		},
+		{
+			// Nor may its parameters
+			`
+			let apply = macro(x) { quote(fn(n) { n + unquote(x) }(1)) };
+			let n = 10;
+			apply(n);
+			`,
+			11,
+		},
+		{
+			// Bindings the caller passes in keep their names
+			`
+			let block = macro(body) { quote(fn() { unquote(body) }()) };
+			let x = 2;
+			block(fn(x) { x * 3 }(x));
+			`,
+			6,
+		},
+		{
+			`
+			let swap = macro(a, b) {
+				quote(fn() { let tmp = unquote(a); [unquote(b), tmp] }())
+			};
+			let tmp = 1;
+			let other = 2;
+			swap(tmp, other)[0] * 10 + swap(tmp, other)[1];
+			`,
+			21,
+		},
+		{
+			// A name bound only in an inner scope of the template still
+			// refers to the caller's variable outside of it
+			`
+			let addTwice = macro(x) { quote(n + fn(n) { n * 2 }(unquote(x))) };
+			let n = 10;
+			addTwice(1);
+			`,
+			12,
+		},
+		{
+			// Including before it is bound in the same scope
+			`
+			let m = macro() { quote(fn() { let r = tmp; let tmp = 5; r + tmp }()) };
+			let tmp = 1;
+			m();
+			`,
+			6,
+		},
+		{
+			// Shadowing inside the template renames each binding apart
+			`
+			let m = macro(x) {
+				quote(fn() {
+					let v = 1;
+					let w = if (true) { let v = unquote(x); v * 2 };
+					let f = fn(v) { v + w };
+					f(v) + v
+				}())
+			};
+			let v = 100;
+			m(v);
+			`,
+			202,
+		},
+	}
+
+	for _, tt := range tests {
+		program := testParseProgram(tt.input)
+
+		env := object.NewEnvironment()
+		DefineMacros(program, env)
+		expanded, err := ExpandMacros(program, env)
+		if err != nil {
+			t.Fatalf("macro expansion failed: %s", err)
+		}
+
+		testIntegerObject(t, Eval(expanded, object.NewEnvironment()), tt.expected)
+	}
+}
+
+func TestMacroExpansionErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{
+			"let m = macro(x) { quote(x) };\nm(1, 2);",
+			"2:2: wrong number of arguments to macro m: want=1, got=2",
+		},
+		{
+			"let m = macro() { 1 };\nm();",
+			"2:2: macro m must return a quote, got 1",
+		},
+		{
+			"let m = macro() { quote(m()) };\nm();",
+			"1:26: macro expansion of m too deep",
+		},
+	}
+
+	for _, tt := range tests {
+		program := testParseProgram(tt.input)
+
+		env := object.NewEnvironment()
+		DefineMacros(program, env)
+		_, err := ExpandMacros(program, env)
+		if err == nil {
+			t.Fatalf("expected macro expansion error for %q", tt.input)
+		}
+
+		if err.Error() != tt.expectedError {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expectedError, err.Error())
+		}
+	}
+}
+
+func testParseProgram(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
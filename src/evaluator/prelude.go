@@ -0,0 +1,41 @@
+package evaluator
+
+import (
+	"ash/object"
+	"ash/prelude"
+	"sync"
+)
+
+var (
+	preludeOnce      sync.Once
+	preludeFunctions map[string]object.Object
+)
+
+// lookupPrelude returns the exported prelude function called name. The
+// prelude is evaluated once, the first time it is needed, in an environment
+// of its own.
+func lookupPrelude(name string) (object.Object, bool) {
+	preludeOnce.Do(evalPrelude)
+	fn, ok := preludeFunctions[name]
+	return fn, ok
+}
+
+func evalPrelude() {
+	env := object.NewEnvironment()
+	for _, def := range object.PreludeBuiltins {
+		env.Set(def.Name, def.Builtin)
+	}
+	preludeFunctions = map[string]object.Object{}
+
+	for _, let := range prelude.Functions() {
+		result := Eval(let, env)
+		if isError(result) {
+			panic("prelude: " + result.Inspect())
+		}
+
+		if let.Exported {
+			fn, _ := env.Get(let.Name.Value)
+			preludeFunctions[let.Name.Value] = fn
+		}
+	}
+}
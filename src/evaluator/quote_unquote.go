@@ -0,0 +1,322 @@
+package evaluator
+
+import (
+	"ash/ast"
+	"ash/object"
+	"ash/token"
+	"fmt"
+)
+
+// gensymCounter numbers the fresh names given to variables bound by macros.
+var gensymCounter int
+
+// quote returns node unevaluated, except for the `unquote(expr)` calls in it,
+// which are replaced by the result of evaluating expr. Inside a macro, the
+// variables node binds are renamed first, so the expanded code is hygienic.
+func quote(node ast.Node, env *object.Environment) object.Object {
+	if env.InMacro() {
+		node = renameBindings(node)
+	}
+
+	node, err := evalUnquoteCalls(node, env)
+	if err != nil {
+		return err
+	}
+
+	return &object.Quote{Node: node}
+}
+
+func evalUnquoteCalls(
+	quoted ast.Node,
+	env *object.Environment,
+) (ast.Node, *object.Error) {
+	var err *object.Error
+
+	node := ast.Modify(quoted, func(node ast.Node) ast.Node {
+		call, ok := node.(*ast.CallExpression)
+		if !ok || !isUnquoteCall(call) || err != nil {
+			return node
+		}
+
+		if len(call.Arguments) != 1 {
+			err = newError(object.ArgumentError, "wrong number of arguments to unquote: want=1, got=%d",
+				len(call.Arguments))
+			err.Locate(call.Token.File, call.Token.Line, call.Token.Column)
+			return node
+		}
+
+		unquoted := Eval(call.Arguments[0], env)
+		if e, ok := unquoted.(*object.Error); ok {
+			err = e
+			return node
+		}
+
+		converted := convertObjectToASTNode(unquoted, call.Token)
+		if converted == nil {
+			err = newError(object.TypeError, "cannot unquote %s", unquoted.Type())
+			err.Locate(call.Token.File, call.Token.Line, call.Token.Column)
+			return node
+		}
+
+		return converted
+	})
+
+	return node, err
+}
+
+func convertObjectToASTNode(obj object.Object, tok token.Token) ast.Node {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		t := token.Token{
+			Type:    token.INT,
+			Literal: fmt.Sprintf("%d", obj.Value),
+			Line:    tok.Line,
+			Column:  tok.Column,
+		}
+		return &ast.IntegerLiteral{Token: t, Value: obj.Value}
+
+	case *object.Boolean:
+		t := token.Token{Type: token.FALSE, Literal: "false", Line: tok.Line, Column: tok.Column}
+		if obj.Value {
+			t.Type, t.Literal = token.TRUE, "true"
+		}
+		return &ast.Boolean{Token: t, Value: obj.Value}
+
+	case *object.String:
+		t := token.Token{
+			Type:    token.STRING,
+			Literal: obj.Value,
+			Line:    tok.Line,
+			Column:  tok.Column,
+		}
+		return &ast.StringLiteral{Token: t, Value: obj.Value}
+
+	case *object.Null:
+		t := token.Token{Type: token.NULL, Literal: "null", Line: tok.Line, Column: tok.Column}
+		return &ast.NullLiteral{Token: t}
+
+	case *object.Quote:
+		return obj.Node
+
+	default:
+		return nil
+	}
+}
+
+func isUnquoteCall(call *ast.CallExpression) bool {
+	return call.Function.TokenLiteral() == "unquote"
+}
+
+// renameBindings makes a macro's quoted template hygienic. The variables it
+// binds with let or as function or catch parameters are renamed, along with
+// their uses in their scope, to fresh names the lexer can never produce, so
+// they can't capture or shadow the caller's variables. Names the template
+// uses outside of the scope of a binding keep referring to the caller's
+// variables. Code spliced in with unquote is left as is.
+func renameBindings(template ast.Node) ast.Node {
+	r := &renamer{
+		renamed:  map[*ast.Identifier]string{},
+		original: map[string]string{},
+		scope:    &renameScope{names: map[string]string{}},
+	}
+	r.walk(template)
+
+	if len(r.renamed) == 0 {
+		return template
+	}
+
+	// Identifiers are leaves, which ast.Modify passes on unchanged, so the
+	// renamed ones can be recognized by identity.
+	return ast.Modify(template, func(node ast.Node) ast.Node {
+		switch node := node.(type) {
+		case *ast.Identifier:
+			name, ok := r.renamed[node]
+			if !ok {
+				return node
+			}
+			tok := node.Token
+			tok.Literal = name
+			return &ast.Identifier{Token: tok, Value: name}
+
+		case *ast.LetStatement:
+			// A function bound with let is named after the binding, which
+			// its body refers to itself by
+			fn, ok := node.Value.(*ast.FunctionLiteral)
+			if ok && fn.Name != "" && fn.Name == r.original[node.Name.Value] {
+				fn.Name = node.Name.Value
+			}
+		}
+		return node
+	})
+}
+
+// renamer finds the fresh names of the identifiers of a template, walking it
+// scope by scope.
+type renamer struct {
+	renamed  map[*ast.Identifier]string // the fresh name of each identifier
+	original map[string]string          // the name each fresh name replaces
+	scope    *renameScope
+}
+
+// renameScope holds the fresh names of the variables bound in a scope.
+type renameScope struct {
+	names map[string]string
+	outer *renameScope
+}
+
+func (r *renamer) enterScope() {
+	r.scope = &renameScope{names: map[string]string{}, outer: r.scope}
+}
+
+func (r *renamer) leaveScope() {
+	r.scope = r.scope.outer
+}
+
+// bind gives ident, a variable the template binds, a fresh name, which its
+// uses in the rest of the scope get too.
+func (r *renamer) bind(ident *ast.Identifier) {
+	gensymCounter++
+	name := fmt.Sprintf("%s#%d", ident.Value, gensymCounter)
+	r.scope.names[ident.Value] = name
+	r.original[name] = ident.Value
+	r.renamed[ident] = name
+}
+
+// use renames ident if it refers to a variable the template binds.
+func (r *renamer) use(ident *ast.Identifier) {
+	for s := r.scope; s != nil; s = s.outer {
+		if name, ok := s.names[ident.Value]; ok {
+			r.renamed[ident] = name
+			return
+		}
+	}
+}
+
+func (r *renamer) walk(node ast.Node) {
+	switch node := node.(type) {
+	case *ast.Program:
+		r.walkStatements(node.Statements)
+
+	case *ast.BlockStatement:
+		r.enterScope()
+		r.walkStatements(node.Statements)
+		r.leaveScope()
+
+	case *ast.ExpressionStatement:
+		r.walk(node.Expression)
+
+	case *ast.ReturnStatement:
+		r.walk(node.ReturnValue)
+
+	case *ast.ThrowStatement:
+		r.walk(node.Value)
+
+	case *ast.LetStatement:
+		// The value is in the scope of the binding only if it is a function
+		// named after it
+		if fn, ok := node.Value.(*ast.FunctionLiteral); ok && fn.Name == node.Name.Value {
+			r.bind(node.Name)
+			r.walk(node.Value)
+		} else {
+			r.walk(node.Value)
+			r.bind(node.Name)
+		}
+
+	case *ast.AssignExpression:
+		r.use(node.Name)
+		r.walk(node.Value)
+
+	case *ast.Identifier:
+		r.use(node)
+
+	case *ast.PrefixExpression:
+		r.walk(node.Right)
+
+	case *ast.InfixExpression:
+		r.walk(node.Left)
+		r.walk(node.Right)
+
+	case *ast.IfExpression:
+		r.walk(node.Condition)
+		r.walk(node.Consequence)
+		if node.Alternative != nil {
+			r.walk(node.Alternative)
+		}
+
+	case *ast.TryExpression:
+		r.walk(node.Body)
+		if node.Catch != nil {
+			r.enterScope()
+			if node.Parameter != nil {
+				r.bind(node.Parameter)
+			}
+			r.walk(node.Catch)
+			r.leaveScope()
+		}
+		if node.Finally != nil {
+			r.walk(node.Finally)
+		}
+
+	case *ast.FunctionLiteral:
+		// The body shares the function's scope
+		r.enterScope()
+		for _, param := range node.Parameters {
+			r.bind(param)
+		}
+		r.walkStatements(node.Body.Statements)
+		r.leaveScope()
+
+	case *ast.MacroLiteral:
+		r.enterScope()
+		for _, param := range node.Parameters {
+			r.bind(param)
+		}
+		r.walkStatements(node.Body.Statements)
+		r.leaveScope()
+
+	case *ast.CallExpression:
+		if isUnquoteCall(node) {
+			return
+		}
+		r.walk(node.Function)
+		r.walkExpressions(node.Arguments)
+
+	case *ast.MethodCallExpression:
+		// The method name is not a variable
+		r.walk(node.Receiver)
+		r.walkExpressions(node.Arguments)
+
+	case *ast.ArrayLiteral:
+		r.walkExpressions(node.Elements)
+
+	case *ast.IndexExpression:
+		r.walk(node.Left)
+		r.walk(node.Index)
+
+	case *ast.SliceExpression:
+		r.walk(node.Left)
+		for _, bound := range []ast.Expression{node.Start, node.End, node.Step} {
+			if bound != nil {
+				r.walk(bound)
+			}
+		}
+
+	case *ast.HashLiteral:
+		for key, val := range node.Pairs {
+			r.walk(key)
+			r.walk(val)
+		}
+	}
+}
+
+func (r *renamer) walkStatements(stmts []ast.Statement) {
+	for _, stmt := range stmts {
+		r.walk(stmt)
+	}
+}
+
+func (r *renamer) walkExpressions(exps []ast.Expression) {
+	for _, exp := range exps {
+		r.walk(exp)
+	}
+}
@@ -0,0 +1,114 @@
+package evaluator
+
+import (
+	"ash/ast"
+	"ash/object"
+	"ash/token"
+)
+
+// tailCall is a call in tail position of a function body: the call ending
+// it, or ending a branch of an if expression that ends it, or one it returns
+// outside of expressions other than if and of try blocks that handle their
+// errors, the same calls the compiler turns into tail calls. It is returned
+// from the body rather than made, and applyFunction makes it in place of the
+// call of the function, so recursion in tail position doesn't grow the call
+// stack.
+type tailCall struct {
+	fn   object.Object
+	args []object.Object
+	tok  token.Token
+	env  *object.Environment // the environment the call is made in
+}
+
+func (tc *tailCall) Type() object.ObjectType { return "TAIL_CALL" }
+func (tc *tailCall) Inspect() string         { return "tail call" }
+
+// evalFunctionBody evaluates the statements of a function body in env, the
+// environment of the call, to the value the function returns or to a
+// tailCall.
+func evalFunctionBody(body *ast.BlockStatement, env *object.Environment) object.Object {
+	// The body shares the function's scope, so it can't shadow parameters
+	return unwrapReturnValue(evalTail(body.Statements, env, true))
+}
+
+// evalTail evaluates the statements of a function body, or of a block in it
+// that a return leaves the function from, like evalStatements, except that
+// the calls they return evaluate to tailCalls, and so does the call ending
+// them if tail.
+func evalTail(statements []ast.Statement, env *object.Environment, tail bool) object.Object {
+	var result object.Object
+
+	for i, statement := range statements {
+		result = evalTailStatement(statement, env, tail && i == len(statements)-1)
+
+		if result != nil {
+			rt := result.Type()
+			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+				return result
+			}
+		}
+	}
+
+	if result == nil {
+		return NULL
+	}
+
+	return result
+}
+
+// evalTailStatement evaluates a statement of the statements evalTail
+// evaluates. Only a return, or an if or try expression whose blocks return
+// leave the function from, can hold calls in tail position.
+func evalTailStatement(statement ast.Statement, env *object.Environment, tail bool) object.Object {
+	switch node := statement.(type) {
+	case *ast.ReturnStatement:
+		if call, ok := node.ReturnValue.(*ast.CallExpression); ok {
+			val := evalTailCall(call, env)
+			if isAbrupt(val) {
+				return val
+			}
+			return &object.ReturnValue{Value: val}
+		}
+
+	case *ast.ExpressionStatement:
+		switch expr := node.Expression.(type) {
+		case *ast.CallExpression:
+			if tail {
+				return evalTailCall(expr, env)
+			}
+
+		case *ast.IfExpression:
+			condition := Eval(expr.Condition, env)
+			if isAbrupt(condition) {
+				return condition
+			}
+
+			if isTruthy(condition) {
+				return evalTail(expr.Consequence.Statements, object.NewEnclosedEnvironment(env), tail)
+			} else if expr.Alternative != nil {
+				return evalTail(expr.Alternative.Statements, object.NewEnclosedEnvironment(env), tail)
+			}
+			return NULL
+
+		case *ast.TryExpression:
+			return evalTryExpression(expr, env, true)
+		}
+	}
+
+	return Eval(statement, env)
+}
+
+// evalTailCall evaluates the function and the arguments of a call in tail
+// position to a tailCall.
+func evalTailCall(node *ast.CallExpression, env *object.Environment) object.Object {
+	if node.Function.TokenLiteral() == "quote" {
+		return Eval(node, env)
+	}
+
+	function, args, err := evalCallee(node, env)
+	if err != nil {
+		return err
+	}
+
+	return &tailCall{fn: function, args: args, tok: node.Token, env: env}
+}
@@ -1,62 +1,90 @@
 package main
 
 import (
+	"ash/ast"
 	"ash/compiler"
+	"ash/evaluator"
 	"ash/lexer"
+	"ash/module"
+	"ash/object"
 	"ash/parser"
 	"ash/repl"
 	"ash/utils"
 	"ash/vm"
+	"flag"
 	"fmt"
 	"os"
 	"strings"
 )
 
+var (
+	version      = flag.Bool("version", false, "print the version")
+	optimization = flag.Int("O", int(compiler.MaxOptimization), "the optimization level, 0 to disable optimizations")
+)
+
 func main() {
-	args := os.Args
+	flag.BoolVar(version, "v", false, "print the version")
+	flag.Parse()
+	args := flag.Args()
+	level := compiler.OptimizationLevel(*optimization)
+
+	switch {
+	case *version:
+		fmt.Println("Ash 0.0.1")
 
-	switch len(args) {
-	case 1:
+	case len(args) == 0:
 		fmt.Println("Ash 0.0.1")
-		repl.Start(os.Stdin, os.Stdout)
+		repl.Start(os.Stdin, os.Stdout, level)
 
-	case 2:
-		if args[1] == "-v" || args[1] == "--version" {
-			fmt.Println("Ash 0.0.1")
-		} else {
-			run(args[1])
-		}
+	case len(args) == 1:
+		run(args[0], level)
 
 	}
 }
 
-func run(filename string) {
+func run(filename string, level compiler.OptimizationLevel) {
 	if !strings.HasSuffix(filename, ".ash") {
 		filename += ".ash"
 	}
 
 	data, err := os.ReadFile(filename)
 	if err != nil {
-		fmt.Errorf("could not read %s: %v", filename, err)
+		fmt.Fprintf(os.Stderr, "could not read %s: %v\n", filename, err)
 		os.Exit(1)
 	}
 
-	p := parser.New(lexer.New(string(data)))
+	p := parser.New(lexer.NewFile(filename, string(data)))
 	program := p.ParseProgram()
 	if len(p.Errors()) != 0 {
 		utils.PrintParserErrors(os.Stderr, p.Errors())
 		os.Exit(1)
 	}
 
+	program, err = evaluator.Expand(program, object.NewEnvironment())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Macro expansion failed:\n %s\n", err)
+		os.Exit(1)
+	}
+
+	loader := module.NewLoader(module.SearchPathFromEnv())
+	loader.Transform = func(program *ast.Program) (*ast.Program, error) {
+		return evaluator.Expand(program, object.NewEnvironment())
+	}
+	if err := loader.Resolve(program, filename); err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed:\n %s\n", err)
+		os.Exit(1)
+	}
+
 	c := compiler.New()
+	c.SetOptimization(level)
 	if err := c.Compile(program); err != nil {
-		fmt.Errorf("Compilation failed:\n %s\n", err)
+		fmt.Fprintf(os.Stderr, "Compilation failed:\n %s\n", err)
 		os.Exit(1)
 	}
 
 	machine := vm.New(c.Bytecode())
 	if err := machine.Run(); err != nil {
-		fmt.Errorf("Executing bytecode failed:\n %s\n", err)
+		utils.PrintRuntimeError(os.Stderr, err)
 		os.Exit(1)
 	}
 }
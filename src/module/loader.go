@@ -0,0 +1,177 @@
+// Package module loads ash source files and resolves the modules they
+// import.
+package module
+
+import (
+	"ash/ast"
+	"ash/lexer"
+	"ash/parser"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extension is the extension of ash source files. Import paths may omit it.
+const Extension = ".ash"
+
+// Loader resolves import statements to parsed modules. Each module is
+// loaded once, however many files import it.
+type Loader struct {
+	// SearchPath lists the directories searched for modules not found
+	// relative to the importing file.
+	SearchPath []string
+
+	// Transform, if set, is applied to every module after it is parsed,
+	// e.g. to expand its macros.
+	Transform func(*ast.Program) (*ast.Program, error)
+
+	modules map[string]*ast.Program
+	loading []string // the files being loaded, innermost last
+}
+
+func NewLoader(searchPath []string) *Loader {
+	return &Loader{
+		SearchPath: searchPath,
+		modules:    map[string]*ast.Program{},
+	}
+}
+
+// SearchPathFromEnv returns the search path set in the ASH_PATH environment
+// variable, a list of directories separated like PATH.
+func SearchPathFromEnv() []string {
+	value := os.Getenv("ASH_PATH")
+	if value == "" {
+		return nil
+	}
+	return filepath.SplitList(value)
+}
+
+// Resolve loads the modules imported by the top-level import statements of
+// program, which was read from filename, and stores them in the statements.
+// Imports are looked up relative to filename's directory, or to the working
+// directory if filename is empty, and then in the search path.
+func (l *Loader) Resolve(program *ast.Program, filename string) error {
+	dir := "."
+	if filename != "" {
+		path, err := filepath.Abs(filename)
+		if err != nil {
+			return err
+		}
+
+		l.loading = append(l.loading, path)
+		defer func() { l.loading = l.loading[:len(l.loading)-1] }()
+
+		dir = filepath.Dir(path)
+	}
+
+	for _, stmt := range program.Statements {
+		stmt, ok := stmt.(*ast.ImportStatement)
+		if !ok {
+			continue
+		}
+
+		path, err := l.find(stmt.Path, dir)
+		if err != nil {
+			return fmt.Errorf("%d:%d: %w", stmt.Token.Line, stmt.Token.Column, err)
+		}
+
+		module, err := l.load(path)
+		if err != nil {
+			return err
+		}
+
+		stmt.Resolved = path
+		stmt.Module = module
+	}
+
+	return nil
+}
+
+func (l *Loader) load(path string) (*ast.Program, error) {
+	for i, loading := range l.loading {
+		if loading == path {
+			return nil, l.cycleError(i)
+		}
+	}
+
+	if module, ok := l.modules[path]; ok {
+		return module, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser.New(lexer.NewFile(path, string(data)))
+	module := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("%s: %s", path, strings.Join(p.Errors(), "\n"))
+	}
+
+	if l.Transform != nil {
+		module, err = l.Transform(module)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	err = l.Resolve(module, path)
+	if err != nil {
+		// A cycle error already lists the files involved
+		var cycle *CycleError
+		if errors.As(err, &cycle) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	l.modules[path] = module
+	return module, nil
+}
+
+// find returns the absolute path of the module imported as path from a
+// file in dir.
+func (l *Loader) find(path string, dir string) (string, error) {
+	if filepath.Ext(path) == "" {
+		path += Extension
+	}
+
+	candidates := []string{path}
+	if !filepath.IsAbs(path) {
+		candidates = []string{filepath.Join(dir, path)}
+		for _, searchDir := range l.SearchPath {
+			candidates = append(candidates, filepath.Join(searchDir, path))
+		}
+	}
+
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if err == nil && !info.IsDir() {
+			return filepath.Abs(candidate)
+		}
+	}
+
+	return "", fmt.Errorf("cannot find module %q", path)
+}
+
+// CycleError is returned when modules import each other.
+type CycleError struct {
+	Files []string // the files of the cycle, starting and ending with the same one
+}
+
+func (e *CycleError) Error() string {
+	names := []string{}
+	for _, path := range e.Files {
+		names = append(names, filepath.Base(path))
+	}
+	return "import cycle: " + strings.Join(names, " -> ")
+}
+
+// cycleError returns the import cycle from l.loading[start] back to it.
+func (l *Loader) cycleError(start int) error {
+	files := append([]string{}, l.loading[start:]...)
+	return &CycleError{Files: append(files, l.loading[start])}
+}
@@ -0,0 +1,150 @@
+package module
+
+import (
+	"ash/ast"
+	"ash/lexer"
+	"ash/parser"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"lib/math.ash":   `import "util.ash" as util; export let add = fn(a, b) { a + b };`,
+		"lib/util.ash":   `export let one = 1;`,
+		"vendor/str.ash": `export let empty = "";`,
+	})
+
+	loader := NewLoader([]string{filepath.Join(dir, "vendor")})
+	imports := resolve(t, loader,
+		`import "lib/math.ash" as math; import "lib/math" as again;`,
+		filepath.Join(dir, "main.ash"))
+
+	mathPath := filepath.Join(dir, "lib", "math.ash")
+	for _, stmt := range imports {
+		if stmt.Resolved != mathPath {
+			t.Errorf("stmt.Resolved wrong. want=%q, got=%q", mathPath, stmt.Resolved)
+		}
+	}
+
+	if imports[0].Module != imports[1].Module {
+		t.Errorf("module loaded twice")
+	}
+
+	nested := imports[0].Module.Statements[0].(*ast.ImportStatement)
+	utilPath := filepath.Join(dir, "lib", "util.ash")
+	if nested.Resolved != utilPath {
+		t.Errorf("nested import resolved wrong. want=%q, got=%q", utilPath, nested.Resolved)
+	}
+
+	imports = resolve(t, loader, `import "str" as str;`, filepath.Join(dir, "main.ash"))
+	strPath := filepath.Join(dir, "vendor", "str.ash")
+	if imports[0].Resolved != strPath {
+		t.Errorf("search path import resolved wrong. want=%q, got=%q",
+			strPath, imports[0].Resolved)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.ash": `export let x = 1;`,
+	})
+
+	transformed := 0
+	loader := NewLoader(nil)
+	loader.Transform = func(program *ast.Program) (*ast.Program, error) {
+		transformed++
+		return program, nil
+	}
+
+	resolve(t, loader, `import "a" as a; import "a" as b;`, filepath.Join(dir, "main.ash"))
+
+	if transformed != 1 {
+		t.Errorf("wrong number of transformed modules. want=1, got=%d", transformed)
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.ash":      `import "b" as b;`,
+		"b.ash":      `import "a" as a;`,
+		"self.ash":   `import "self" as self;`,
+		"broken.ash": `(1`,
+	})
+
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{`import "missing" as m;`, `1:1: cannot find module "missing.ash"`},
+		{`import "a" as a;`, "import cycle: a.ash -> b.ash -> a.ash"},
+		{`import "self" as s;`, "import cycle: self.ash -> self.ash"},
+		{`import "broken" as b;`, filepath.Join(dir, "broken.ash") + ": expected next token to be ), got EOF instead"},
+	}
+
+	for _, tt := range tests {
+		program := parse(t, tt.input)
+
+		err := NewLoader(nil).Resolve(program, filepath.Join(dir, "main.ash"))
+		if err == nil {
+			t.Fatalf("expected import error for %q", tt.input)
+		}
+
+		if err.Error() != tt.expectedError {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expectedError, err)
+		}
+	}
+}
+
+// resolve resolves the imports of source, read from filename, and returns
+// its import statements.
+func resolve(
+	t *testing.T,
+	loader *Loader,
+	source string,
+	filename string,
+) []*ast.ImportStatement {
+	t.Helper()
+
+	program := parse(t, source)
+	if err := loader.Resolve(program, filename); err != nil {
+		t.Fatalf("import error: %s", err)
+	}
+
+	imports := []*ast.ImportStatement{}
+	for _, stmt := range program.Statements {
+		imports = append(imports, stmt.(*ast.ImportStatement))
+	}
+	return imports
+}
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %s", strings.Join(p.Errors(), "\n"))
+	}
+	return program
+}
+
+// writeFiles writes files, keyed by their path, to a temporary directory
+// and returns it.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
@@ -0,0 +1,109 @@
+package object
+
+import (
+	"context"
+	"errors"
+)
+
+// The causes of the errors a Budget stops programs with.
+var (
+	ErrInstructionBudget = errors.New("instruction budget exceeded")
+	ErrAllocationBudget  = errors.New("allocation budget exceeded")
+)
+
+// checkInterval is how many instructions run between checks of the context.
+const checkInterval = 1024
+
+// Budget limits the instructions a program runs and the values it
+// allocates, and lets the host cancel it through a context. The VM counts
+// its instructions, the evaluator the nodes it evaluates. When the program
+// runs out of budget or is cancelled it is stopped with an Error whose Cause
+// is ErrInstructionBudget, ErrAllocationBudget or the context's error, which
+// catch clauses can't handle.
+//
+// A nil Budget has no limits.
+type Budget struct {
+	ctx context.Context
+
+	instructions    int64
+	maxInstructions int64
+	nextCheck       int64 // the instruction count of the next check
+
+	allocations    int64
+	maxAllocations int64
+}
+
+// NewBudget returns a budget of maxInstructions and maxAllocations, either
+// unlimited if 0, for a program cancelled with ctx.
+func NewBudget(ctx context.Context, maxInstructions, maxAllocations int64) *Budget {
+	b := &Budget{ctx: ctx, maxInstructions: maxInstructions, maxAllocations: maxAllocations}
+	b.schedule()
+	return b
+}
+
+// Step charges an instruction.
+func (b *Budget) Step() *Error {
+	if b == nil {
+		return nil
+	}
+
+	b.instructions++
+	if b.instructions < b.nextCheck {
+		return nil
+	}
+	return b.check()
+}
+
+func (b *Budget) check() *Error {
+	if b.maxInstructions > 0 && b.instructions > b.maxInstructions {
+		return abort(ErrInstructionBudget)
+	}
+	if err := b.ctx.Err(); err != nil {
+		return abort(err)
+	}
+
+	b.schedule()
+	return nil
+}
+
+// schedule sets the next check, in checkInterval instructions or as the
+// program goes over budget.
+func (b *Budget) schedule() {
+	b.nextCheck = b.instructions + checkInterval
+	if b.maxInstructions > 0 && b.nextCheck > b.maxInstructions+1 {
+		b.nextCheck = b.maxInstructions + 1
+	}
+}
+
+// Allocate charges the allocation of obj: one value, plus one per byte,
+// element, pair or captured variable it holds.
+func (b *Budget) Allocate(obj Object) *Error {
+	if b == nil || b.maxAllocations == 0 {
+		return nil
+	}
+
+	b.allocations += allocationSize(obj)
+	if b.allocations > b.maxAllocations {
+		return abort(ErrAllocationBudget)
+	}
+	return nil
+}
+
+func allocationSize(obj Object) int64 {
+	switch obj := obj.(type) {
+	case *String:
+		return 1 + int64(len(obj.Value))
+	case *Array:
+		return 1 + int64(len(obj.Elements))
+	case *Hash:
+		return 1 + int64(len(obj.Pairs))
+	case *Closure:
+		return 1 + int64(len(obj.Free))
+	default:
+		return 1
+	}
+}
+
+func abort(cause error) *Error {
+	return &Error{Kind: RuntimeError, Message: cause.Error(), Cause: cause}
+}
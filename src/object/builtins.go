@@ -8,7 +8,7 @@ var Builtins = []struct {
 }{
 	{"len", &Builtin{Fn: func(args ...Object) Object {
 		if len(args) != 1 {
-			return newError("wrong number of arguments. got=%d, want=1",
+			return newError(ArgumentError, "wrong number of arguments: want=1, got=%d",
 				len(args))
 		}
 
@@ -18,7 +18,7 @@ var Builtins = []struct {
 		case *String:
 			return &Integer{Value: int64(len(arg.Value))}
 		default:
-			return newError("argument to `len` not supported, got %s",
+			return newError(TypeError, "argument to `len` not supported, got %s",
 				args[0].Type())
 		}
 	}}},
@@ -31,11 +31,11 @@ var Builtins = []struct {
 	}}},
 	{"first", &Builtin{Fn: func(args ...Object) Object {
 		if len(args) != 1 {
-			return newError("wrong number of arguments. got=%d, want=1",
+			return newError(ArgumentError, "wrong number of arguments: want=1, got=%d",
 				len(args))
 		}
 		if args[0].Type() != ARRAY_OBJ {
-			return newError("argument to `first` must be ARRAY, got %s",
+			return newError(TypeError, "argument to `first` must be ARRAY, got %s",
 				args[0].Type())
 		}
 
@@ -48,11 +48,11 @@ var Builtins = []struct {
 	}}},
 	{"last", &Builtin{Fn: func(args ...Object) Object {
 		if len(args) != 1 {
-			return newError("wrong number of arguments. got=%d, want=1",
+			return newError(ArgumentError, "wrong number of arguments: want=1, got=%d",
 				len(args))
 		}
 		if args[0].Type() != ARRAY_OBJ {
-			return newError("argument to `last` must be ARRAY, got %s",
+			return newError(TypeError, "argument to `last` must be ARRAY, got %s",
 				args[0].Type())
 		}
 
@@ -66,11 +66,11 @@ var Builtins = []struct {
 	}}},
 	{"rest", &Builtin{Fn: func(args ...Object) Object {
 		if len(args) != 1 {
-			return newError("wrong number of arguments. got=%d, want=1",
+			return newError(ArgumentError, "wrong number of arguments: want=1, got=%d",
 				len(args))
 		}
 		if args[0].Type() != ARRAY_OBJ {
-			return newError("argument to `rest` must be ARRAY, got %s",
+			return newError(TypeError, "argument to `rest` must be ARRAY, got %s",
 				args[0].Type())
 		}
 
@@ -86,11 +86,11 @@ var Builtins = []struct {
 	}}},
 	{"push", &Builtin{Fn: func(args ...Object) Object {
 		if len(args) != 2 {
-			return newError("wrong number of arguments. got=%d, want=2",
+			return newError(ArgumentError, "wrong number of arguments: want=2, got=%d",
 				len(args))
 		}
 		if args[0].Type() != ARRAY_OBJ {
-			return newError("argument to `push` must be ARRAY, got %s",
+			return newError(TypeError, "argument to `push` must be ARRAY, got %s",
 				args[0].Type())
 		}
 
@@ -105,11 +105,11 @@ var Builtins = []struct {
 	}}},
 	{"set", &Builtin{Fn: func(args ...Object) Object {
 		if len(args) != 3 {
-			return newError("wrong number of arguments. got=%d, want=3",
+			return newError(ArgumentError, "wrong number of arguments: want=3, got=%d",
 				len(args))
 		}
 		if args[0].Type() != HASH_OBJ {
-			return newError("argument to `set` must be HASH, got %s",
+			return newError(TypeError, "argument to `set` must be HASH, got %s",
 				args[0].Type())
 		}
 
@@ -117,17 +117,89 @@ var Builtins = []struct {
 		key := args[1]
 		keyType := key.Type()
 		if keyType != INTEGER_OBJ && keyType != STRING_OBJ {
-			return newError("hash key must be INTEGER or STRING, got %s",
-				args[0].Type())
+			return newError(TypeError, "hash key must be INTEGER or STRING, got %s",
+				keyType)
 		}
 		hash.set(args[1], args[2])
 
 		return &Hash{Pairs: hash.Pairs}
 	}}},
+	{"str", &Builtin{Fn: func(args ...Object) Object {
+		if len(args) != 1 {
+			return newError(ArgumentError, "wrong number of arguments: want=1, got=%d",
+				len(args))
+		}
+
+		switch arg := args[0].(type) {
+		case *String:
+			return arg
+		case *Quote:
+			// The source text of quoted code, e.g. a macro argument
+			return &String{Value: arg.Node.String()}
+		default:
+			return &String{Value: arg.Inspect()}
+		}
+	}}},
+	{"name", &Builtin{Fn: func(args ...Object) Object {
+		if len(args) != 1 {
+			return newError(ArgumentError, "wrong number of arguments: want=1, got=%d",
+				len(args))
+		}
+
+		switch fn := args[0].(type) {
+		case *Function:
+			return &String{Value: fn.Name}
+		case *Closure:
+			return &String{Value: fn.Fn.Name}
+		case *Builtin:
+			return &String{Value: fn.Name}
+		default:
+			return newError(TypeError, "argument to `name` must be FUNCTION, got %s",
+				args[0].Type())
+		}
+	}}},
 }
 
-func newError(format string, a ...interface{}) *Error {
-	return &Error{Message: fmt.Sprintf(format, a...)}
+// PreludeBuiltins are the builtins only the prelude can call. Programs see
+// them through the prelude functions that use them.
+var PreludeBuiltins = []struct {
+	Name    string
+	Builtin *Builtin
+}{
+	{"unstack", &Builtin{Fn: func(args ...Object) Object {
+		if len(args) != 1 {
+			return newError(ArgumentError, "wrong number of arguments: want=1, got=%d",
+				len(args))
+		}
+
+		// A stack is null or a pair [top, rest], so pushing onto it copies
+		// nothing. Its elements come out in the order they were pushed.
+		elements := []Object{}
+		for stack := args[0]; stack.Type() != NULL_OBJ; {
+			pair, ok := stack.(*Array)
+			if !ok || len(pair.Elements) != 2 {
+				return newError(TypeError, "argument to `unstack` must be a stack of [top, rest] pairs, got %s",
+					stack.Type())
+			}
+			elements = append(elements, pair.Elements[0])
+			stack = pair.Elements[1]
+		}
+
+		for i, j := 0, len(elements)-1; i < j; i, j = i+1, j-1 {
+			elements[i], elements[j] = elements[j], elements[i]
+		}
+
+		return &Array{Elements: elements}
+	}}},
+}
+
+func init() {
+	for _, def := range Builtins {
+		def.Builtin.Name = def.Name
+	}
+	for _, def := range PreludeBuiltins {
+		def.Builtin.Name = def.Name
+	}
 }
 
 func GetBuiltinByName(name string) *Builtin {
@@ -1,19 +1,79 @@
 package object
 
+import "ash/token"
+
 func NewEnclosedEnvironment(outer *Environment) *Environment {
 	env := NewEnvironment()
 	env.outer = outer
+	env.modules = outer.modules
+	env.budget = outer.budget
+	env.maxFrames = outer.maxFrames
+	return env
+}
+
+// NewModuleEnvironment returns the global environment of a module imported
+// from importer. It shares importer's cache of evaluated modules, but none
+// of its bindings.
+func NewModuleEnvironment(importer *Environment) *Environment {
+	env := NewEnvironment()
+	env.modules = importer.modules
+	env.budget = importer.budget
+	env.maxFrames = importer.maxFrames
+	return env
+}
+
+// NewFunctionEnvironment returns the environment of a function call. Unlike
+// other enclosed environments, it marks the boundary past which local
+// variables of the outer function can no longer be assigned.
+func NewFunctionEnvironment(outer *Environment) *Environment {
+	env := NewEnclosedEnvironment(outer)
+	env.function = true
+	return env
+}
+
+// NewCallEnvironment returns the environment of call, a call of a function
+// whose environment is outer.
+func NewCallEnvironment(outer *Environment, call *Call) *Environment {
+	env := NewFunctionEnvironment(outer)
+	env.call = call
+	return env
+}
+
+// Call is a function call in progress, which the evaluator keeps to build
+// stack traces like the VM does from its frames.
+type Call struct {
+	Function string      // the name of the function called
+	Token    token.Token // the call expression, in the caller
+	Caller   *Call       // the call the caller is in, nil at the top level
+	Depth    int         // the number of calls in progress, this one included
+}
+
+// NewMacroEnvironment returns the environment a macro body is evaluated in
+// while the macro is expanded.
+func NewMacroEnvironment(outer *Environment) *Environment {
+	env := NewFunctionEnvironment(outer)
+	env.macro = true
 	return env
 }
 
 func NewEnvironment() *Environment {
 	s := make(map[string]Object)
-	return &Environment{store: s, outer: nil}
+	c := make(map[string]bool)
+	m := make(map[string]Object)
+	return &Environment{store: s, consts: c, modules: m, outer: nil}
 }
 
 type Environment struct {
-	store map[string]Object
-	outer *Environment
+	store    map[string]Object
+	consts   map[string]bool
+	modules  map[string]Object // exports of the modules evaluated so far, by path
+	outer    *Environment
+	function bool
+	macro    bool
+	call     *Call   // the call of the function, if this is its environment
+	budget   *Budget // of the program evaluated in it, nil if unlimited
+
+	maxFrames int // the depth of calls allowed in it, 0 for the evaluator's default
 }
 
 func (e *Environment) Get(name string) (Object, bool) {
@@ -24,7 +84,120 @@ func (e *Environment) Get(name string) (Object, bool) {
 	return obj, ok
 }
 
+// Set binds name in this environment. It returns an error if name is a
+// constant of this environment.
 func (e *Environment) Set(name string, val Object) Object {
+	if e.consts[name] {
+		return newError(NameError, "cannot redeclare constant %s", name)
+	}
 	e.store[name] = val
 	return val
 }
+
+// SetConst binds name in this environment as a constant.
+func (e *Environment) SetConst(name string, val Object) Object {
+	result := e.Set(name, val)
+	if _, ok := result.(*Error); !ok {
+		e.consts[name] = true
+	}
+	return result
+}
+
+// Assign updates the existing binding of name, wherever it is defined. It
+// returns an error if there is no such binding, if it is a constant, or if
+// it is a local of an enclosing function, mirroring the compiler, whose
+// closures capture such variables by value.
+func (e *Environment) Assign(name string, val Object) Object {
+	crossedFunction := false
+
+	for env := e; env != nil; env = env.outer {
+		if _, ok := env.store[name]; ok {
+			if env.consts[name] {
+				return newError(NameError, "cannot assign to constant %s", name)
+			}
+			if crossedFunction && env.inFunction() {
+				return newError(NameError, "cannot assign to captured variable %s", name)
+			}
+			env.store[name] = val
+			return val
+		}
+
+		if env.function {
+			crossedFunction = true
+		}
+	}
+
+	return newError(NameError, "cannot assign to undefined variable %s", name)
+}
+
+// inFunction reports whether e belongs to a function call rather than to
+// the top level of the program.
+func (e *Environment) inFunction() bool {
+	for env := e; env != nil; env = env.outer {
+		if env.function {
+			return true
+		}
+	}
+	return false
+}
+
+// Call returns the function call e belongs to, or nil at the top level of
+// the program or of a module.
+func (e *Environment) Call() *Call {
+	for env := e; env != nil; env = env.outer {
+		if env.function {
+			return env.call
+		}
+	}
+	return nil
+}
+
+// InMacro reports whether e belongs to the expansion of a macro.
+func (e *Environment) InMacro() bool {
+	for env := e; env != nil; env = env.outer {
+		if env.macro {
+			return true
+		}
+	}
+	return false
+}
+
+// IsGlobal reports whether e is the global environment of a program or
+// module.
+func (e *Environment) IsGlobal() bool {
+	return e.outer == nil
+}
+
+// Module returns the exports of the module at path, if it was evaluated.
+func (e *Environment) Module(path string) (Object, bool) {
+	exports, ok := e.modules[path]
+	return exports, ok
+}
+
+// SetModule caches the exports of the module at path.
+func (e *Environment) SetModule(path string, exports Object) {
+	e.modules[path] = exports
+}
+
+// Budget returns the budget of the program evaluated in e.
+func (e *Environment) Budget() *Budget {
+	return e.budget
+}
+
+// SetBudget sets the budget of the program evaluated in e. The environments
+// enclosed in e from then on share it.
+func (e *Environment) SetBudget(budget *Budget) {
+	e.budget = budget
+}
+
+// MaxFrames returns the depth of calls allowed in e, or 0 if it is left to
+// the evaluator.
+func (e *Environment) MaxFrames() int {
+	return e.maxFrames
+}
+
+// SetMaxFrames sets the depth of calls allowed in e. The environments
+// enclosed in e from then on share it.
+func (e *Environment) SetMaxFrames(maxFrames int) {
+	e.maxFrames = maxFrames
+}
@@ -0,0 +1,167 @@
+package object
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrorKind classifies runtime errors, so programs can tell them apart when
+// they catch them.
+type ErrorKind string
+
+const (
+	// TypeError is an operation applied to values of the wrong type
+	TypeError ErrorKind = "TypeError"
+	// NameError is an undefined variable or method, or a binding that
+	// can't be assigned
+	NameError ErrorKind = "NameError"
+	// ArgumentError is a call with the wrong number of arguments
+	ArgumentError ErrorKind = "ArgumentError"
+	// ValueError is an argument of the right type but with a bad value
+	ValueError ErrorKind = "ValueError"
+	// ZeroDivisionError is an integer divided by zero
+	ZeroDivisionError ErrorKind = "ZeroDivisionError"
+	// ImportError is an import of a module that wasn't loaded
+	ImportError ErrorKind = "ImportError"
+	// SyntaxError is code the evaluator rejects only when it runs it, like
+	// an import outside the top level, which the compiler rejects before
+	SyntaxError ErrorKind = "SyntaxError"
+	// RuntimeError is a failure of the interpreter itself, e.g. running out
+	// of stack
+	RuntimeError ErrorKind = "RuntimeError"
+	// Exception is a value raised with `throw`
+	Exception ErrorKind = "Exception"
+)
+
+// Error is a runtime error or an exception raised with `throw`, which
+// unwinds the program until a catch clause handles it. The VM and the
+// evaluator raise the same errors, at the same positions, for the same
+// program.
+type Error struct {
+	Kind    ErrorKind
+	Message string
+	Value   Object // the thrown value, nil for runtime errors
+
+	// The position of the expression that raised the error, or 0 if it
+	// hasn't been located yet
+	File   string
+	Line   int
+	Column int
+
+	// Trace holds the calls in progress when the error was raised,
+	// innermost first
+	Trace []TraceFrame
+
+	// Cause is why the host stopped the program, e.g. it ran out of its
+	// Budget. Catch clauses don't handle such errors.
+	Cause error
+}
+
+// TraceFrame is a call in the stack trace of an error: the function called
+// and the position it had reached, the call to the next frame for all but
+// the innermost frame.
+type TraceFrame struct {
+	Function string
+	File     string
+	Line     int
+	Column   int
+}
+
+// MainFunction names the top level of the program in stack traces.
+const MainFunction = "<main>"
+
+func (f TraceFrame) String() string {
+	return fmt.Sprintf("at %s (%s)", f.Function, formatPosition(f.File, f.Line, f.Column))
+}
+
+func (e *Error) Type() ObjectType { return ERROR_OBJ }
+func (e *Error) Inspect() string  { return "ERROR: " + e.Error() }
+
+// Error lets the VM return uncaught errors as Go errors. It formats them
+// like compile errors, with the kind before the message.
+func (e *Error) Error() string {
+	msg := e.Message
+	if e.Kind != "" {
+		msg = string(e.Kind) + ": " + msg
+	}
+	if e.Line > 0 {
+		msg = formatPosition(e.File, e.Line, e.Column) + ": " + msg
+	}
+	return msg
+}
+
+// Unwrap returns the cause of e, so hosts can tell why they stopped the
+// program with errors.Is.
+func (e *Error) Unwrap() error { return e.Cause }
+
+// StackTrace formats e followed by its stack trace, one frame per line.
+// Long runs of the same frame, as deep recursion leaves, are shown once.
+func (e *Error) StackTrace() string {
+	var out strings.Builder
+	out.WriteString(e.Error())
+
+	for i := 0; i < len(e.Trace); {
+		frame := e.Trace[i]
+
+		run := 1
+		for i+run < len(e.Trace) && e.Trace[i+run] == frame {
+			run++
+		}
+		i += run
+
+		if run > 3 {
+			fmt.Fprintf(&out, "\n    %s\n    [the frame above repeated %d more times]", frame, run-1)
+			continue
+		}
+		for ; run > 0; run-- {
+			out.WriteString("\n    ")
+			out.WriteString(frame.String())
+		}
+	}
+
+	return out.String()
+}
+
+// Locate sets the position of e unless it already has one, since an error
+// is raised where it is first located.
+func (e *Error) Locate(file string, line, column int) {
+	if e.Line > 0 {
+		return
+	}
+	e.File = file
+	e.Line = line
+	e.Column = column
+}
+
+// formatPosition formats a position like compile errors do, with the file
+// first if it is known.
+func formatPosition(file string, line, column int) string {
+	if file == "" {
+		return fmt.Sprintf("%d:%d", line, column)
+	}
+	return fmt.Sprintf("%s:%d:%d", file, line, column)
+}
+
+// Throw returns the exception raised by `throw value`.
+func Throw(value Object) *Error {
+	return &Error{Kind: Exception, Message: value.Inspect(), Value: value}
+}
+
+// Payload returns the value a catch clause binds: the thrown value, or for
+// a runtime error a hash holding its kind, message and position.
+func (e *Error) Payload() Object {
+	if e.Value != nil {
+		return e.Value
+	}
+
+	payload := &Hash{Pairs: map[HashKey]HashPair{}}
+	payload.set(&String{Value: "kind"}, &String{Value: string(e.Kind)})
+	payload.set(&String{Value: "message"}, &String{Value: e.Message})
+	payload.set(&String{Value: "line"}, &Integer{Value: int64(e.Line)})
+	payload.set(&String{Value: "column"}, &Integer{Value: int64(e.Column)})
+	return payload
+}
+
+func newError(kind ErrorKind, format string, a ...interface{}) *Error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
+}
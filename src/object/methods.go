@@ -0,0 +1,198 @@
+package object
+
+import (
+	"sort"
+	"strings"
+)
+
+// Methods maps a receiver type to the builtin methods callable on it with
+// `value.method(args)`. The receiver is passed to the builtin as its first
+// argument. Both the VM and the evaluator dispatch through this table.
+var Methods = map[ObjectType]map[string]*Builtin{
+	STRING_OBJ: {
+		"len": GetBuiltinByName("len"),
+		"upper": {Fn: func(args ...Object) Object {
+			if len(args) != 1 {
+				return newError(ArgumentError, "wrong number of arguments: want=0, got=%d",
+					len(args)-1)
+			}
+			return &String{Value: strings.ToUpper(args[0].(*String).Value)}
+		}},
+		"lower": {Fn: func(args ...Object) Object {
+			if len(args) != 1 {
+				return newError(ArgumentError, "wrong number of arguments: want=0, got=%d",
+					len(args)-1)
+			}
+			return &String{Value: strings.ToLower(args[0].(*String).Value)}
+		}},
+		"trim": {Fn: func(args ...Object) Object {
+			if len(args) != 1 {
+				return newError(ArgumentError, "wrong number of arguments: want=0, got=%d",
+					len(args)-1)
+			}
+			return &String{Value: strings.TrimSpace(args[0].(*String).Value)}
+		}},
+		"split": {Fn: func(args ...Object) Object {
+			if len(args) != 2 {
+				return newError(ArgumentError, "wrong number of arguments: want=1, got=%d",
+					len(args)-1)
+			}
+			sep, ok := args[1].(*String)
+			if !ok {
+				return newError(TypeError, "argument to `split` must be STRING, got %s",
+					args[1].Type())
+			}
+
+			parts := strings.Split(args[0].(*String).Value, sep.Value)
+			elements := make([]Object, len(parts))
+			for i, part := range parts {
+				elements[i] = &String{Value: part}
+			}
+			return &Array{Elements: elements}
+		}},
+		"contains": {Fn: func(args ...Object) Object {
+			if len(args) != 2 {
+				return newError(ArgumentError, "wrong number of arguments: want=1, got=%d",
+					len(args)-1)
+			}
+			sub, ok := args[1].(*String)
+			if !ok {
+				return newError(TypeError, "argument to `contains` must be STRING, got %s",
+					args[1].Type())
+			}
+			return nativeBool(strings.Contains(args[0].(*String).Value, sub.Value))
+		}},
+	},
+	ARRAY_OBJ: {
+		"len":   GetBuiltinByName("len"),
+		"first": GetBuiltinByName("first"),
+		"last":  GetBuiltinByName("last"),
+		"rest":  GetBuiltinByName("rest"),
+		"push":  GetBuiltinByName("push"),
+		"join": {Fn: func(args ...Object) Object {
+			if len(args) != 2 {
+				return newError(ArgumentError, "wrong number of arguments: want=1, got=%d",
+					len(args)-1)
+			}
+			sep, ok := args[1].(*String)
+			if !ok {
+				return newError(TypeError, "argument to `join` must be STRING, got %s",
+					args[1].Type())
+			}
+
+			elements := args[0].(*Array).Elements
+			parts := make([]string, len(elements))
+			for i, el := range elements {
+				parts[i] = el.Inspect()
+			}
+			return &String{Value: strings.Join(parts, sep.Value)}
+		}},
+		"contains": {Fn: func(args ...Object) Object {
+			if len(args) != 2 {
+				return newError(ArgumentError, "wrong number of arguments: want=1, got=%d",
+					len(args)-1)
+			}
+			for _, el := range args[0].(*Array).Elements {
+				if Equal(el, args[1]) {
+					return nativeBool(true)
+				}
+			}
+			return nativeBool(false)
+		}},
+	},
+	HASH_OBJ: {
+		"len": {Fn: func(args ...Object) Object {
+			if len(args) != 1 {
+				return newError(ArgumentError, "wrong number of arguments: want=0, got=%d",
+					len(args)-1)
+			}
+			return &Integer{Value: int64(len(args[0].(*Hash).Pairs))}
+		}},
+		"keys": {Fn: func(args ...Object) Object {
+			if len(args) != 1 {
+				return newError(ArgumentError, "wrong number of arguments: want=0, got=%d",
+					len(args)-1)
+			}
+			pairs := sortedPairs(args[0].(*Hash))
+			elements := make([]Object, len(pairs))
+			for i, pair := range pairs {
+				elements[i] = pair.Key
+			}
+			return &Array{Elements: elements}
+		}},
+		"values": {Fn: func(args ...Object) Object {
+			if len(args) != 1 {
+				return newError(ArgumentError, "wrong number of arguments: want=0, got=%d",
+					len(args)-1)
+			}
+			pairs := sortedPairs(args[0].(*Hash))
+			elements := make([]Object, len(pairs))
+			for i, pair := range pairs {
+				elements[i] = pair.Value
+			}
+			return &Array{Elements: elements}
+		}},
+		"has": {Fn: func(args ...Object) Object {
+			if len(args) != 2 {
+				return newError(ArgumentError, "wrong number of arguments: want=1, got=%d",
+					len(args)-1)
+			}
+			key, ok := args[1].(Hashable)
+			if !ok {
+				return newError(TypeError, "unusable as hash key: %s", args[1].Type())
+			}
+			_, ok = args[0].(*Hash).Pairs[key.HashKey()]
+			return nativeBool(ok)
+		}},
+	},
+}
+
+func init() {
+	for _, methods := range Methods {
+		for name, method := range methods {
+			if method.Name == "" {
+				method.Name = name
+			}
+		}
+	}
+}
+
+// GetMethod returns the builtin method name of receiver's type, if any.
+func GetMethod(receiver Object, name string) (*Builtin, bool) {
+	method, ok := Methods[receiver.Type()][name]
+	return method, ok
+}
+
+// Equal reports whether two objects are equal by value for integers,
+// booleans and strings, and by identity otherwise.
+func Equal(a, b Object) bool {
+	ha, ok := a.(Hashable)
+	if !ok {
+		return a == b
+	}
+	hb, ok := b.(Hashable)
+	if !ok {
+		return false
+	}
+	return ha.HashKey() == hb.HashKey()
+}
+
+// sortedPairs returns the pairs of a hash ordered by their key's Inspect
+// output, so keys() and values() are deterministic.
+func sortedPairs(hash *Hash) []HashPair {
+	pairs := make([]HashPair, 0, len(hash.Pairs))
+	for _, pair := range hash.Pairs {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key.Inspect() < pairs[j].Key.Inspect()
+	})
+	return pairs
+}
+
+func nativeBool(value bool) *Boolean {
+	if value {
+		return TRUE
+	}
+	return FALSE
+}
@@ -31,7 +31,16 @@ const (
 
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ"
 
-	CLOSURE_OBJ = "CLOSURE"
+	QUOTE_OBJ = "QUOTE"
+	MACRO_OBJ = "MACRO"
+)
+
+// Canonical singletons shared by the VM, the evaluator and the builtins, so
+// booleans and null can be compared by identity.
+var (
+	NULL  = &Null{}
+	TRUE  = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
 )
 
 type HashKey struct {
@@ -88,14 +97,14 @@ type ReturnValue struct {
 func (rv *ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJ }
 func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
-type Error struct {
-	Message string
+// AnonymousName is the name of a function that wasn't bound with let,
+// after the position of its literal.
+func AnonymousName(line, column int) string {
+	return fmt.Sprintf("<anonymous:%d:%d>", line, column)
 }
 
-func (e *Error) Type() ObjectType { return ERROR_OBJ }
-func (e *Error) Inspect() string  { return "ERROR: " + e.Message }
-
 type Function struct {
+	Name       string // the name it was bound to with let, or AnonymousName
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
@@ -134,7 +143,8 @@ func (s *String) HashKey() HashKey {
 }
 
 type Builtin struct {
-	Fn BuiltinFunction
+	Name string // set from the Builtins and Methods tables
+	Fn   BuiltinFunction
 }
 
 func (b *Builtin) Type() ObjectType { return BUILTIN_OBJ }
@@ -190,14 +200,40 @@ func (h *Hash) set(key Object, value Object) {
 }
 
 type CompiledFunction struct {
+	Name          string // the name it was bound to with let, or AnonymousName
 	Instructions  code.Instructions
 	NumLocals     int
 	NumParameters int
+
+	// Constants is the constant pool of a function compiled apart from the
+	// program calling it, like the prelude's. It is nil for the program's
+	// own functions, which use the program's pool.
+	Constants []Object
+
+	Handlers []Handler
+
+	// Positions maps the instructions back to the source
+	Positions *PositionTable
+}
+
+// Handler is an entry of a function's exception-handler table. An error
+// raised by the instructions in [Start, End) is handled by cutting the
+// stack back to StackDepth values above the function's locals, pushing the
+// error's payload and jumping to Target. Inner handlers come first.
+//
+// A Rethrow handler runs a finally block and throws the error again, so it
+// gets the error itself rather than its payload.
+type Handler struct {
+	Start      int
+	End        int
+	Target     int
+	StackDepth int
+	Rethrow    bool
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
 func (cf *CompiledFunction) Inspect() string {
-	return fmt.Sprintf("CompiledFunction[%p]", cf)
+	return fmt.Sprintf("CompiledFunction[%s]", cf.Name)
 }
 
 type Closure struct {
@@ -205,7 +241,43 @@ type Closure struct {
 	Free []Object
 }
 
-func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
+// Type is FUNCTION_OBJ, since closures are the VM's functions and programs
+// can't tell them apart from the evaluator's.
+func (c *Closure) Type() ObjectType { return FUNCTION_OBJ }
 func (c *Closure) Inspect() string {
-	return fmt.Sprintf("Closure[%p]", c)
+	return fmt.Sprintf("Closure[%s]", c.Fn.Name)
+}
+
+type Quote struct {
+	Node ast.Node
+}
+
+func (q *Quote) Type() ObjectType { return QUOTE_OBJ }
+func (q *Quote) Inspect() string {
+	return "QUOTE(" + q.Node.String() + ")"
+}
+
+type Macro struct {
+	Parameters []*ast.Identifier
+	Body       *ast.BlockStatement
+	Env        *Environment
+}
+
+func (m *Macro) Type() ObjectType { return MACRO_OBJ }
+func (m *Macro) Inspect() string {
+	var out bytes.Buffer
+
+	params := []string{}
+	for _, p := range m.Parameters {
+		params = append(params, p.String())
+	}
+
+	out.WriteString("macro")
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(") {\n")
+	out.WriteString(m.Body.String())
+	out.WriteString("\n}")
+
+	return out.String()
 }
@@ -1,6 +1,10 @@
 package object
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "Hello World"}
@@ -58,3 +62,145 @@ func TestIntegerHashKey(t *testing.T) {
 		t.Errorf("integers with twoerent content have same hash keys")
 	}
 }
+
+func TestErrorString(t *testing.T) {
+	tests := []struct {
+		err      *Error
+		expected string
+	}{
+		{&Error{Message: "oops"}, "oops"},
+		{&Error{Kind: TypeError, Message: "oops"}, "TypeError: oops"},
+		{&Error{Kind: TypeError, Message: "oops", Line: 2, Column: 5}, "2:5: TypeError: oops"},
+		{&Error{Kind: TypeError, Message: "oops", File: "a.ash", Line: 2, Column: 5}, "a.ash:2:5: TypeError: oops"},
+		{Throw(&String{Value: "oops"}), "Exception: oops"},
+	}
+
+	for _, tt := range tests {
+		if tt.err.Error() != tt.expected {
+			t.Errorf("wrong error string. want=%q, got=%q", tt.expected, tt.err.Error())
+		}
+	}
+}
+
+func TestErrorLocate(t *testing.T) {
+	err := &Error{Kind: TypeError, Message: "oops"}
+
+	err.Locate("a.ash", 2, 5)
+	err.Locate("b.ash", 1, 1)
+
+	if err.File != "a.ash" || err.Line != 2 || err.Column != 5 {
+		t.Errorf("error located again. want=a.ash:2:5, got=%s:%d:%d", err.File, err.Line, err.Column)
+	}
+}
+
+func TestErrorStackTrace(t *testing.T) {
+	err := &Error{
+		Kind:    ZeroDivisionError,
+		Message: "division by zero",
+		File:    "a.ash",
+		Line:    2,
+		Column:  5,
+		Trace: []TraceFrame{
+			{Function: "f", File: "a.ash", Line: 2, Column: 5},
+			{Function: "<anonymous:1:1>", Line: 1, Column: 3},
+			{Function: MainFunction, File: "a.ash", Line: 4, Column: 1},
+		},
+	}
+
+	expected := `a.ash:2:5: ZeroDivisionError: division by zero
+    at f (a.ash:2:5)
+    at <anonymous:1:1> (1:3)
+    at <main> (a.ash:4:1)`
+
+	if err.StackTrace() != expected {
+		t.Errorf("wrong stack trace. want=%q, got=%q", expected, err.StackTrace())
+	}
+
+	recursion := TraceFrame{Function: "f", Line: 1, Column: 17}
+	err = &Error{Kind: RuntimeError, Message: "maximum call depth exceeded", Line: 1, Column: 17}
+	for i := 0; i < 5; i++ {
+		err.Trace = append(err.Trace, recursion)
+	}
+	err.Trace = append(err.Trace, TraceFrame{Function: MainFunction, Line: 2, Column: 2})
+
+	expected = `1:17: RuntimeError: maximum call depth exceeded
+    at f (1:17)
+    [the frame above repeated 4 more times]
+    at <main> (2:2)`
+
+	if err.StackTrace() != expected {
+		t.Errorf("wrong stack trace. want=%q, got=%q", expected, err.StackTrace())
+	}
+}
+
+func TestPositionTable(t *testing.T) {
+	positions := []Position{
+		{Offset: 3, File: "main.ash", Line: 1, Column: 5},
+		{Offset: 7, File: "main.ash", Line: 2, Column: 1},
+		{Offset: 9, File: "lib.ash", Line: 40, Column: 3},
+		{Offset: 300, File: "main.ash", Line: 3, Column: 200},
+	}
+	table := NewPositionTable(positions)
+
+	entries := table.Entries()
+	if len(entries) != len(positions) {
+		t.Fatalf("wrong number of entries. want=%+v, got=%+v", positions, entries)
+	}
+	for i, pos := range positions {
+		if entries[i] != pos {
+			t.Errorf("wrong entry %d. want=%+v, got=%+v", i, pos, entries[i])
+		}
+	}
+
+	if len(table.Files) != 2 {
+		t.Errorf("files not stored once. got=%q", table.Files)
+	}
+
+	tests := []struct {
+		offset   int
+		expected Position
+	}{
+		{0, Position{}},
+		{3, positions[0]},
+		{6, positions[0]},
+		{7, positions[1]},
+		{10, positions[2]},
+		{1000, positions[3]},
+	}
+
+	for _, tt := range tests {
+		pos := table.Lookup(tt.offset)
+		if pos != tt.expected {
+			t.Errorf("wrong position at %d. want=%+v, got=%+v", tt.offset, tt.expected, pos)
+		}
+	}
+
+	var empty *PositionTable
+	if pos := empty.Lookup(3); pos != (Position{}) {
+		t.Errorf("nil table has a position. got=%+v", pos)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := NewBudget(context.Background(), 3, 10)
+	for i := 0; i < 3; i++ {
+		if err := b.Step(); err != nil {
+			t.Fatalf("step %d: unexpected error %s", i, err)
+		}
+	}
+	if err := b.Step(); err == nil || !errors.Is(err, ErrInstructionBudget) {
+		t.Errorf("wrong error. want=%q, got=%v", ErrInstructionBudget, err)
+	}
+
+	if err := b.Allocate(&String{Value: "abc"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := b.Allocate(&Array{Elements: make([]Object, 6)}); err == nil || !errors.Is(err, ErrAllocationBudget) {
+		t.Errorf("wrong error. want=%q, got=%v", ErrAllocationBudget, err)
+	}
+
+	var unlimited *Budget
+	if unlimited.Step() != nil || unlimited.Allocate(&String{}) != nil {
+		t.Errorf("nil budget has limits")
+	}
+}
@@ -0,0 +1,114 @@
+package object
+
+import "encoding/binary"
+
+// Position is the file, line and column of the source of the instructions
+// from Offset on.
+type Position struct {
+	Offset int
+	File   string
+	Line   int
+	Column int
+}
+
+// PositionTable maps the offsets of a function's instructions back to the
+// source. It is shared by everything that needs to know where an
+// instruction came from, like error reporting.
+//
+// The table is kept compact, since every compiled function has one: each
+// entry is encoded as varints relative to the previous one, and the names
+// of the files it refers to are stored once, in Files. An entry holds from
+// its offset until the next one.
+type PositionTable struct {
+	Files []string
+	data  []byte
+}
+
+// NewPositionTable encodes positions, which must be in order of offset.
+func NewPositionTable(positions []Position) *PositionTable {
+	t := &PositionTable{}
+	files := map[string]int{}
+	last := Position{}
+	lastFile := -1
+
+	for _, pos := range positions {
+		file, ok := files[pos.File]
+		if !ok {
+			file = len(t.Files)
+			files[pos.File] = file
+			t.Files = append(t.Files, pos.File)
+		}
+
+		// The lowest bit of the offset delta flags a change of file
+		delta := uint64(pos.Offset-last.Offset) << 1
+		if file != lastFile {
+			delta |= 1
+		}
+		t.data = binary.AppendUvarint(t.data, delta)
+		if file != lastFile {
+			t.data = binary.AppendUvarint(t.data, uint64(file))
+		}
+		t.data = binary.AppendVarint(t.data, int64(pos.Line-last.Line))
+		t.data = binary.AppendUvarint(t.data, uint64(pos.Column))
+
+		last, lastFile = pos, file
+	}
+
+	return t
+}
+
+// Lookup returns the position of the source of the instruction at offset,
+// or the zero Position if it is unknown.
+func (t *PositionTable) Lookup(offset int) Position {
+	found := Position{}
+	t.each(func(pos Position) bool {
+		if pos.Offset > offset {
+			return false
+		}
+		found = pos
+		return true
+	})
+	return found
+}
+
+// Entries decodes all the entries of the table, in order of offset.
+func (t *PositionTable) Entries() []Position {
+	var entries []Position
+	t.each(func(pos Position) bool {
+		entries = append(entries, pos)
+		return true
+	})
+	return entries
+}
+
+// each decodes the entries of the table in order, until f returns false.
+func (t *PositionTable) each(f func(Position) bool) {
+	if t == nil {
+		return
+	}
+
+	pos := Position{}
+	for data := t.data; len(data) > 0; {
+		delta, n := binary.Uvarint(data)
+		data = data[n:]
+		pos.Offset += int(delta >> 1)
+
+		if delta&1 == 1 {
+			file, n := binary.Uvarint(data)
+			data = data[n:]
+			pos.File = t.Files[file]
+		}
+
+		line, n := binary.Varint(data)
+		data = data[n:]
+		pos.Line += int(line)
+
+		column, n := binary.Uvarint(data)
+		data = data[n:]
+		pos.Column = int(column)
+
+		if !f(pos) {
+			return
+		}
+	}
+}
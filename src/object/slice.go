@@ -0,0 +1,121 @@
+package object
+
+// Slice implements `left[start:end:step]` for arrays and strings. It is shared
+// by the VM and the evaluator so both engines slice identically.
+//
+// The semantics follow Python:
+//
+//   - start, end and step are INTEGER or NULL (omitted).
+//   - step defaults to 1 and must not be 0.
+//   - A negative start or end counts from the end, so -1 is the last element.
+//   - Out-of-range bounds are clamped instead of raising an error, so `a[:100]`
+//     on a 3 element array returns the whole array and `a[5:]` returns [].
+//   - With a positive step, start defaults to 0 and end to the length, and
+//     the result holds the elements from start up to, but excluding, end.
+//   - With a negative step, start defaults to the last element and end to
+//     "before the first element", so `a[::-1]` reverses a.
+//
+// Strings are sliced by byte, matching `len`. The result is always a new
+// array or string; the original is never modified.
+func Slice(left, start, end, step Object) Object {
+	var length int
+	switch left := left.(type) {
+	case *Array:
+		length = len(left.Elements)
+	case *String:
+		length = len(left.Value)
+	default:
+		return newError(TypeError, "slice operator not supported: %s", left.Type())
+	}
+
+	var stepValue int64 = 1
+	switch step := step.(type) {
+	case nil, *Null:
+	case *Integer:
+		stepValue = step.Value
+	default:
+		return newError(TypeError, "slice indices must be INTEGER, got %s", step.Type())
+	}
+	if stepValue == 0 {
+		return newError(ValueError, "slice step cannot be zero")
+	}
+
+	// lower and upper are the clamping bounds, which double as the defaults
+	// for omitted bounds. With a negative step, -1 means "before the first
+	// element".
+	var lower, upper, defStart, defEnd int64
+	if stepValue > 0 {
+		lower, upper = 0, int64(length)
+		defStart, defEnd = lower, upper
+	} else {
+		lower, upper = -1, int64(length)-1
+		defStart, defEnd = upper, lower
+	}
+
+	startValue, err := sliceBound(start, defStart, length, lower, upper)
+	if err != nil {
+		return err
+	}
+
+	endValue, err := sliceBound(end, defEnd, length, lower, upper)
+	if err != nil {
+		return err
+	}
+
+	// Bounds are within [-1, length], so counting the elements up front
+	// cannot overflow, unlike stepping an index past a huge step.
+	var count int64
+	if stepValue > 0 && startValue < endValue {
+		count = (endValue-startValue-1)/stepValue + 1
+	} else if stepValue < 0 && startValue > endValue {
+		count = (startValue-endValue-1)/-stepValue + 1
+	}
+
+	indices := make([]int64, count)
+	for i := range indices {
+		indices[i] = startValue + int64(i)*stepValue
+	}
+
+	switch left := left.(type) {
+	case *Array:
+		elements := make([]Object, len(indices))
+		for i, idx := range indices {
+			elements[i] = left.Elements[idx]
+		}
+		return &Array{Elements: elements}
+	default:
+		str := left.(*String).Value
+		bytes := make([]byte, len(indices))
+		for i, idx := range indices {
+			bytes[i] = str[idx]
+		}
+		return &String{Value: string(bytes)}
+	}
+}
+
+// sliceBound returns the value of a slice bound, or def when it was omitted.
+// A negative bound is resolved against length, and the result is clamped to
+// [lower, upper].
+func sliceBound(obj Object, def int64, length int, lower, upper int64) (int64, *Error) {
+	var i int64
+
+	switch obj := obj.(type) {
+	case nil, *Null:
+		return def, nil
+	case *Integer:
+		i = obj.Value
+	default:
+		return 0, newError(TypeError, "slice indices must be INTEGER, got %s", obj.Type())
+	}
+
+	if i < 0 {
+		i += int64(length)
+	}
+	if i < lower {
+		return lower, nil
+	}
+	if i > upper {
+		return upper, nil
+	}
+	return i, nil
+}
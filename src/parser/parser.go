@@ -11,6 +11,9 @@ import (
 const (
 	_ int = iota
 	LOWEST
+	ASSIGN      // =
+	NULLISH     // ??
+	PIPELINE    // |>
 	EQUALS      // ==
 	LESSGREATER // > or <
 	SUM         // +
@@ -21,16 +24,22 @@ const (
 )
 
 var precedences = map[token.TokenType]int{
-	token.EQ:       EQUALS,
-	token.NOT_EQ:   EQUALS,
-	token.LT:       LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.LPAREN:   CALL,
-	token.LBRACKET: INDEX,
+	token.ASSIGN:            ASSIGN,
+	token.NULLISH:           NULLISH,
+	token.PIPE:              PIPELINE,
+	token.EQ:                EQUALS,
+	token.NOT_EQ:            EQUALS,
+	token.LT:                LESSGREATER,
+	token.GT:                LESSGREATER,
+	token.PLUS:              SUM,
+	token.MINUS:             SUM,
+	token.SLASH:             PRODUCT,
+	token.ASTERISK:          PRODUCT,
+	token.LPAREN:            CALL,
+	token.LBRACKET:          INDEX,
+	token.DOT:               INDEX,
+	token.OPTIONAL_DOT:      INDEX,
+	token.OPTIONAL_LBRACKET: INDEX,
 }
 
 type (
@@ -63,9 +72,12 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
 	p.registerPrefix(token.FALSE, p.parseBoolean)
+	p.registerPrefix(token.NULL, p.parseNullLiteral)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.IF, p.parseIfExpression)
+	p.registerPrefix(token.TRY, p.parseTryExpression)
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
+	p.registerPrefix(token.MACRO, p.parseMacroLiteral)
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
 	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
 
@@ -78,9 +90,15 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
+	p.registerInfix(token.NULLISH, p.parseInfixExpression)
 
+	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.PIPE, p.parsePipeExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
+	p.registerInfix(token.DOT, p.parseDotExpression)
+	p.registerInfix(token.OPTIONAL_DOT, p.parseOptionalExpression)
+	p.registerInfix(token.OPTIONAL_LBRACKET, p.parseOptionalExpression)
 
 	// Read two tokens, so curToken and peekToken are both set
 	p.nextToken()
@@ -144,17 +162,23 @@ func (p *Parser) ParseProgram() *ast.Program {
 
 func (p *Parser) parseStatement() ast.Statement {
 	switch p.curToken.Type {
-	case token.LET:
+	case token.LET, token.CONST:
 		return p.parseLetStatement()
+	case token.EXPORT:
+		return p.parseExportStatement()
+	case token.IMPORT:
+		return p.parseImportStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.THROW:
+		return p.parseThrowStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
 }
 
 func (p *Parser) parseLetStatement() *ast.LetStatement {
-	stmt := &ast.LetStatement{Token: p.curToken}
+	stmt := &ast.LetStatement{Token: p.curToken, Const: p.curTokenIs(token.CONST)}
 
 	if !p.expectPeek(token.IDENT) {
 		return nil
@@ -181,6 +205,49 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	return stmt
 }
 
+func (p *Parser) parseExportStatement() ast.Statement {
+	if !p.peekTokenIs(token.LET) && !p.peekTokenIs(token.CONST) {
+		p.peekError(token.LET)
+		return nil
+	}
+
+	p.nextToken()
+
+	stmt := p.parseLetStatement()
+	if stmt == nil {
+		return nil
+	}
+
+	stmt.Exported = true
+	return stmt
+}
+
+func (p *Parser) parseImportStatement() ast.Statement {
+	stmt := &ast.ImportStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.STRING) {
+		return nil
+	}
+
+	stmt.Path = p.curToken.Literal
+
+	if !p.expectPeek(token.AS) {
+		return nil
+	}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+
+	stmt.Alias = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	stmt := &ast.ReturnStatement{Token: p.curToken}
 
@@ -195,6 +262,23 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	return stmt
 }
 
+func (p *Parser) parseThrowStatement() ast.Statement {
+	stmt := &ast.ThrowStatement{Token: p.curToken}
+
+	p.nextToken()
+
+	stmt.Value = p.parseExpression(LOWEST)
+	if stmt.Value == nil {
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 
@@ -246,7 +330,14 @@ func (p *Parser) curPrecedence() int {
 }
 
 func (p *Parser) parseIdentifier() ast.Expression {
-	return &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if p.peekTokenIs(token.ARROW) {
+		p.nextToken()
+		return p.parseArrowFunction([]*ast.Identifier{ident})
+	}
+
+	return ident
 }
 
 func (p *Parser) parseIntegerLiteral() ast.Expression {
@@ -295,22 +386,128 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return expression
 }
 
+// parseAssignExpression parses `name = value`. Assignment is right
+// associative, so `a = b = 1` assigns 1 to both.
+func (p *Parser) parseAssignExpression(left ast.Expression) ast.Expression {
+	ident, ok := left.(*ast.Identifier)
+	if !ok {
+		msg := fmt.Sprintf("%d:%d: cannot assign to %s",
+			p.curToken.Line, p.curToken.Column, left.String())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	expression := &ast.AssignExpression{Token: p.curToken, Name: ident}
+
+	p.nextToken()
+	expression.Value = p.parseExpression(ASSIGN - 1)
+
+	return expression
+}
+
 func (p *Parser) parseBoolean() ast.Expression {
 	return &ast.Boolean{Token: p.curToken, Value: p.curTokenIs(token.TRUE)}
 }
 
+func (p *Parser) parseNullLiteral() ast.Expression {
+	return &ast.NullLiteral{Token: p.curToken}
+}
+
 func (p *Parser) parseGroupedExpression() ast.Expression {
+	// `() => body`
+	if p.peekTokenIs(token.RPAREN) {
+		p.nextToken()
+		if !p.expectPeek(token.ARROW) {
+			return nil
+		}
+		return p.parseArrowFunction([]*ast.Identifier{})
+	}
+
 	p.nextToken()
 
 	exp := p.parseExpression(LOWEST)
 
+	// `(a, b) => body`
+	if p.peekTokenIs(token.COMMA) {
+		return p.parseArrowParameters(exp)
+	}
+
 	if !p.expectPeek(token.RPAREN) {
 		return nil
 	}
 
+	// `(a) => body`
+	if ident, ok := exp.(*ast.Identifier); ok && p.peekTokenIs(token.ARROW) {
+		p.nextToken()
+		return p.parseArrowFunction([]*ast.Identifier{ident})
+	}
+
 	return exp
 }
 
+func (p *Parser) parseArrowParameters(first ast.Expression) ast.Expression {
+	ident, ok := first.(*ast.Identifier)
+	if !ok {
+		msg := fmt.Sprintf("expected arrow function parameter to be %s, got %s instead",
+			token.IDENT, first.TokenLiteral())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	identifiers := []*ast.Identifier{ident}
+
+	for p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		identifiers = append(identifiers, ident)
+	}
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.ARROW) {
+		return nil
+	}
+
+	return p.parseArrowFunction(identifiers)
+}
+
+// parseArrowFunction desugars `params => body` into a regular function
+// literal. A body that is not a block becomes a block containing a single
+// expression statement, so it is implicitly returned.
+func (p *Parser) parseArrowFunction(params []*ast.Identifier) ast.Expression {
+	lit := &ast.FunctionLiteral{
+		Token: token.Token{
+			Type:    token.FUNCTION,
+			Literal: "fn",
+			Line:    p.curToken.Line,
+			Column:  p.curToken.Column,
+		},
+		Parameters: params,
+	}
+
+	p.nextToken()
+
+	if p.curTokenIs(token.LBRACE) {
+		lit.Body = p.parseBlockStatement()
+		return lit
+	}
+
+	stmt := &ast.ExpressionStatement{Token: p.curToken}
+	lit.Body = &ast.BlockStatement{
+		Token:      p.curToken,
+		Statements: []ast.Statement{stmt},
+	}
+
+	stmt.Expression = p.parseExpression(LOWEST)
+
+	return lit
+}
+
 func (p *Parser) parseIfExpression() ast.Expression {
 	expression := &ast.IfExpression{Token: p.curToken}
 
@@ -336,6 +533,51 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	return expression
 }
 
+func (p *Parser) parseTryExpression() ast.Expression {
+	expression := &ast.TryExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	expression.Body = p.parseBlockStatement()
+
+	if p.peekTokenIs(token.CATCH) {
+		p.nextToken()
+
+		if !p.expectPeek(token.LPAREN) || !p.expectPeek(token.IDENT) {
+			return nil
+		}
+
+		expression.Parameter = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+		if !p.expectPeek(token.RPAREN) || !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+
+		expression.Catch = p.parseBlockStatement()
+	}
+
+	if p.peekTokenIs(token.FINALLY) {
+		p.nextToken()
+
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+
+		expression.Finally = p.parseBlockStatement()
+	}
+
+	if expression.Catch == nil && expression.Finally == nil {
+		msg := fmt.Sprintf("%d:%d: try needs a catch or finally block",
+			expression.Token.Line, expression.Token.Column)
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	return expression
+}
+
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	block := &ast.BlockStatement{Token: p.curToken}
 	block.Statements = []ast.Statement{}
@@ -371,6 +613,24 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 	return lit
 }
 
+func (p *Parser) parseMacroLiteral() ast.Expression {
+	lit := &ast.MacroLiteral{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	lit.Parameters = p.parseFunctionParameters()
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	lit.Body = p.parseBlockStatement()
+
+	return lit
+}
+
 func (p *Parser) parseFunctionParameters() []*ast.Identifier {
 	identifiers := []*ast.Identifier{}
 
@@ -404,6 +664,34 @@ func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	return exp
 }
 
+// parsePipeExpression desugars `x |> f(a)` into `f(x, a)` and `x |> f` into
+// `f(x)`, so pipelines need no support from the compiler or evaluator.
+func (p *Parser) parsePipeExpression(left ast.Expression) ast.Expression {
+	tok := p.curToken
+
+	precedence := p.curPrecedence()
+	p.nextToken()
+	right := p.parseExpression(precedence)
+	if right == nil {
+		return nil
+	}
+
+	if call, ok := right.(*ast.CallExpression); ok {
+		args := append([]ast.Expression{left}, call.Arguments...)
+		return &ast.CallExpression{
+			Token:     call.Token,
+			Function:  call.Function,
+			Arguments: args,
+		}
+	}
+
+	return &ast.CallExpression{
+		Token:     tok,
+		Function:  right,
+		Arguments: []ast.Expression{left},
+	}
+}
+
 func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 	list := []ast.Expression{}
 
@@ -437,15 +725,106 @@ func (p *Parser) parseArrayLiteral() ast.Expression {
 }
 
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
-	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
+	tok := p.curToken
+
+	if p.peekTokenIs(token.COLON) {
+		return p.parseSliceExpression(tok, left, nil)
+	}
 
 	p.nextToken()
-	exp.Index = p.parseExpression(LOWEST)
+	index := p.parseExpression(LOWEST)
+
+	if p.peekTokenIs(token.COLON) {
+		return p.parseSliceExpression(tok, left, index)
+	}
 
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
 	}
 
+	return &ast.IndexExpression{Token: tok, Left: left, Index: index}
+}
+
+// parseSliceExpression parses the remainder of `left[start:end:step]`, where
+// the peek token is the first colon and any of the three parts may be omitted.
+func (p *Parser) parseSliceExpression(
+	tok token.Token,
+	left, start ast.Expression,
+) ast.Expression {
+	exp := &ast.SliceExpression{Token: tok, Left: left, Start: start}
+
+	p.nextToken()
+
+	if !p.peekTokenIs(token.COLON) && !p.peekTokenIs(token.RBRACKET) {
+		p.nextToken()
+		exp.End = p.parseExpression(LOWEST)
+	}
+
+	if p.peekTokenIs(token.COLON) {
+		p.nextToken()
+
+		if !p.peekTokenIs(token.RBRACKET) {
+			p.nextToken()
+			exp.Step = p.parseExpression(LOWEST)
+		}
+	}
+
+	if !p.expectPeek(token.RBRACKET) {
+		return nil
+	}
+
+	return exp
+}
+
+// parseDotExpression parses `left.name`, which is sugar for `left["name"]`,
+// and `left.name(args)`, which is a method call.
+func (p *Parser) parseDotExpression(left ast.Expression) ast.Expression {
+	tok := p.curToken
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+
+	name := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if p.peekTokenIs(token.LPAREN) {
+		p.nextToken()
+		return &ast.MethodCallExpression{
+			Token:     tok,
+			Receiver:  left,
+			Method:    name,
+			Arguments: p.parseExpressionList(token.RPAREN),
+		}
+	}
+
+	return &ast.IndexExpression{
+		Token: tok,
+		Left:  left,
+		Index: &ast.StringLiteral{Token: name.Token, Value: name.Value},
+	}
+}
+
+// parseOptionalExpression parses `left?.name`, `left?.name(args)` and
+// `left?[index]`, which evaluate to null instead of failing when left is null.
+func (p *Parser) parseOptionalExpression(left ast.Expression) ast.Expression {
+	var exp ast.Expression
+	if p.curTokenIs(token.OPTIONAL_DOT) {
+		exp = p.parseDotExpression(left)
+	} else {
+		exp = p.parseIndexExpression(left)
+	}
+
+	switch exp := exp.(type) {
+	case *ast.IndexExpression:
+		exp.Optional = true
+	case *ast.SliceExpression:
+		exp.Optional = true
+	case *ast.MethodCallExpression:
+		exp.Optional = true
+	default:
+		return nil
+	}
+
 	return exp
 }
 
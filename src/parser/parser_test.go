@@ -41,6 +41,245 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestConstStatements(t *testing.T) {
+	input := "const x = 5;"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("stmt not *ast.LetStatement. got=%T", program.Statements[0])
+	}
+
+	if !stmt.Const {
+		t.Errorf("stmt.Const is not true")
+	}
+
+	if stmt.String() != input {
+		t.Errorf("stmt.String() wrong. want=%q, got=%q", input, stmt.String())
+	}
+
+	if !testLiteralExpression(t, stmt.Value, 5) {
+		return
+	}
+}
+
+func TestAssignExpressionErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"1 = 2", "1:3: cannot assign to 1"},
+		{"let a = [1];\na[0] = 2", "2:6: cannot assign to (a[0])"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q", tt.input)
+		}
+
+		if errors[0] != tt.expectedError {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expectedError, errors[0])
+		}
+	}
+}
+
+func TestImportStatements(t *testing.T) {
+	input := `import "lib/math.ash" as math;`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ImportStatement)
+	if !ok {
+		t.Fatalf("stmt not *ast.ImportStatement. got=%T", program.Statements[0])
+	}
+
+	if stmt.Path != "lib/math.ash" {
+		t.Errorf("stmt.Path wrong. want=%q, got=%q", "lib/math.ash", stmt.Path)
+	}
+
+	if !testIdentifier(t, stmt.Alias, "math") {
+		return
+	}
+
+	if stmt.String() != input {
+		t.Errorf("stmt.String() wrong. want=%q, got=%q", input, stmt.String())
+	}
+}
+
+func TestImportStatementErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"import math", "expected next token to be STRING, got IDENT instead"},
+		{`import "math"`, "expected next token to be AS, got EOF instead"},
+		{`import "math" as 1`, "expected next token to be IDENT, got INT instead"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q", tt.input)
+		}
+
+		if errors[0] != tt.expectedError {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expectedError, errors[0])
+		}
+	}
+}
+
+func TestExportStatements(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedConst bool
+	}{
+		{"export let x = 5;", false},
+		{"export const x = 5;", true},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt, ok := program.Statements[0].(*ast.LetStatement)
+		if !ok {
+			t.Fatalf("stmt not *ast.LetStatement. got=%T", program.Statements[0])
+		}
+
+		if !stmt.Exported {
+			t.Errorf("stmt.Exported is not true")
+		}
+
+		if stmt.Const != tt.expectedConst {
+			t.Errorf("stmt.Const wrong. want=%t, got=%t", tt.expectedConst, stmt.Const)
+		}
+
+		if stmt.String() != tt.input {
+			t.Errorf("stmt.String() wrong. want=%q, got=%q", tt.input, stmt.String())
+		}
+	}
+}
+
+func TestThrowStatements(t *testing.T) {
+	input := `throw x + 1;`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ThrowStatement)
+	if !ok {
+		t.Fatalf("stmt not *ast.ThrowStatement. got=%T", program.Statements[0])
+	}
+
+	if !testInfixExpression(t, stmt.Value, "x", "+", 1) {
+		return
+	}
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []struct {
+		input             string
+		expectedParameter string
+		expectedCatch     bool
+		expectedFinally   bool
+	}{
+		{"try { x } catch (e) { e }", "e", true, false},
+		{"try { x } finally { y }", "", false, true},
+		{"try { x } catch (err) { err } finally { y }", "err", true, true},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		exp, ok := stmt.Expression.(*ast.TryExpression)
+		if !ok {
+			t.Fatalf("stmt.Expression is not ast.TryExpression. got=%T", stmt.Expression)
+		}
+
+		if len(exp.Body.Statements) != 1 {
+			t.Fatalf("body is not 1 statements. got=%d", len(exp.Body.Statements))
+		}
+
+		if (exp.Catch != nil) != tt.expectedCatch {
+			t.Errorf("exp.Catch wrong. want present=%t, got=%+v", tt.expectedCatch, exp.Catch)
+		}
+
+		if tt.expectedCatch && !testIdentifier(t, exp.Parameter, tt.expectedParameter) {
+			return
+		}
+
+		if (exp.Finally != nil) != tt.expectedFinally {
+			t.Errorf("exp.Finally wrong. want present=%t, got=%+v",
+				tt.expectedFinally, exp.Finally)
+		}
+	}
+}
+
+func TestTryExpressionErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"try { x }", "1:1: try needs a catch or finally block"},
+		{"try { x } catch { y }", "expected next token to be (, got { instead"},
+		{"try { x } catch (1) { y }", "expected next token to be IDENT, got INT instead"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q", tt.input)
+		}
+
+		if errors[0] != tt.expectedError {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expectedError, errors[0])
+		}
+	}
+}
+
 func TestReturnStatements(t *testing.T) {
 	tests := []struct {
 		input         string
@@ -349,6 +588,98 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"add(a * b[2], b[1], 2 * [1, 2][1])",
 			"add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))",
 		},
+		{
+			"person.name",
+			"(person[name])",
+		},
+		{
+			"a.b.c + 1",
+			"(((a[b])[c]) + 1)",
+		},
+		{
+			"a.b(1, 2 * 3).c",
+			"(a.b(1, (2 * 3))[c])",
+		},
+		{
+			"-a.len()",
+			"(-a.len())",
+		},
+		{
+			"a[1:2]",
+			"(a[1:2])",
+		},
+		{
+			"a[:n - 1]",
+			"(a[:(n - 1)])",
+		},
+		{
+			"a[b + 1:]",
+			"(a[(b + 1):])",
+		},
+		{
+			"a[::-1]",
+			"(a[::(-1)])",
+		},
+		{
+			"a[1:2:3][0]",
+			"((a[1:2:3])[0])",
+		},
+		{
+			"a |> f",
+			"f(a)",
+		},
+		{
+			"a |> f(b) |> g",
+			"g(f(a, b))",
+		},
+		{
+			"a + b |> f(c * d)",
+			"f((a + b), (c * d))",
+		},
+		{
+			"xs |> filter(f) |> map(g) |> sum",
+			"sum(map(filter(xs, f), g))",
+		},
+		{
+			"a |> fn(x) { x }",
+			"fn(x) x(a)",
+		},
+		{
+			"a ?? b",
+			"(a ?? b)",
+		},
+		{
+			"x = y = 1",
+			"(x = (y = 1))",
+		},
+		{
+			"x = a ?? b |> f",
+			"(x = (a ?? f(b)))",
+		},
+		{
+			"a ?? b == c",
+			"(a ?? (b == c))",
+		},
+		{
+			"a ?? b |> f",
+			"(a ?? f(b))",
+		},
+		{
+			"a?.b?.c ?? d",
+			"(((a?[b])?[c]) ?? d)",
+		},
+		{
+			"a?[0]?[1:2]",
+			"((a?[0])?[1:2])",
+		},
+		{
+			"a?.len()",
+			"a?.len()",
+		},
+		{
+			"null ?? a?.b.c",
+			"(null ?? ((a?[b])[c]))",
+		},
 	}
 
 	for _, tt := range tests {
@@ -401,6 +732,28 @@ func TestBooleanExpression(t *testing.T) {
 	}
 }
 
+func TestNullLiteral(t *testing.T) {
+	l := lexer.New("null;")
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program has not enough statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	if _, ok := stmt.Expression.(*ast.NullLiteral); !ok {
+		t.Fatalf("exp not *ast.NullLiteral. got=%T", stmt.Expression)
+	}
+}
+
 func TestIfExpression(t *testing.T) {
 	input := `if x < y { x }`
 
@@ -509,6 +862,53 @@ func TestIfElseExpression(t *testing.T) {
 	}
 }
 
+func TestMacroLiteralParsing(t *testing.T) {
+	input := `macro(x, y) { x + y; }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+			1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("statement is not ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	macro, ok := stmt.Expression.(*ast.MacroLiteral)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.MacroLiteral. got=%T",
+			stmt.Expression)
+	}
+
+	if len(macro.Parameters) != 2 {
+		t.Fatalf("macro literal parameters wrong. want 2, got=%d\n",
+			len(macro.Parameters))
+	}
+
+	testLiteralExpression(t, macro.Parameters[0], "x")
+	testLiteralExpression(t, macro.Parameters[1], "y")
+
+	if len(macro.Body.Statements) != 1 {
+		t.Fatalf("macro.Body.Statements has not 1 statements. got=%d\n",
+			len(macro.Body.Statements))
+	}
+
+	bodyStmt, ok := macro.Body.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("macro body stmt is not ast.ExpressionStatement. got=%T",
+			macro.Body.Statements[0])
+	}
+
+	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
+}
+
 func TestFunctionLiteralParsing(t *testing.T) {
 	input := `fn(x, y) { x + y; }`
 
@@ -586,6 +986,67 @@ func TestFunctionParameterParsing(t *testing.T) {
 	}
 }
 
+func TestArrowFunctionParsing(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedParams []string
+		expectedBody   string
+	}{
+		{input: "x => x * 2", expectedParams: []string{"x"}, expectedBody: "(x * 2)"},
+		{input: "(x) => x", expectedParams: []string{"x"}, expectedBody: "x"},
+		{input: "(a, b) => a + b", expectedParams: []string{"a", "b"}, expectedBody: "(a + b)"},
+		{input: "() => 1", expectedParams: []string{}, expectedBody: "1"},
+		{input: "(a, b) => { let c = a; c + b }", expectedParams: []string{"a", "b"}, expectedBody: "let c = a;(c + b)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain %d statements. got=%d\n",
+				1, len(program.Statements))
+		}
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		function, ok := stmt.Expression.(*ast.FunctionLiteral)
+		if !ok {
+			t.Fatalf("stmt.Expression is not ast.FunctionLiteral. got=%T",
+				stmt.Expression)
+		}
+
+		if len(function.Parameters) != len(tt.expectedParams) {
+			t.Fatalf("length parameters wrong. want %d, got=%d\n",
+				len(tt.expectedParams), len(function.Parameters))
+		}
+
+		for i, ident := range tt.expectedParams {
+			testLiteralExpression(t, function.Parameters[i], ident)
+		}
+
+		if function.Body.String() != tt.expectedBody {
+			t.Errorf("function body wrong. want=%q, got=%q",
+				tt.expectedBody, function.Body.String())
+		}
+	}
+}
+
+func TestArrowFunctionInArguments(t *testing.T) {
+	input := `let apply = (f, x) => f(x); apply(x => x + 1, 2)`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	expected := "let apply = fn<apply>(f, x) f(x);apply(fn(x) (x + 1), 2)"
+	if program.String() != expected {
+		t.Errorf("expected=%q, got=%q", expected, program.String())
+	}
+}
+
 func TestCallExpressionParsing(t *testing.T) {
 	input := "add(1, 2 * 3, 4 + 5);"
 
@@ -0,0 +1,54 @@
+// Package prelude holds the standard library written in ash, which both the
+// compiler and the evaluator make available to every program.
+package prelude
+
+import (
+	"ash/ast"
+	"ash/lexer"
+	"ash/parser"
+	_ "embed"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//go:embed prelude.ash
+var Source string
+
+var (
+	parseOnce sync.Once
+	program   *ast.Program
+)
+
+// Program returns the parsed prelude. It is parsed the first time it is
+// needed and must not be modified.
+func Program() *ast.Program {
+	parseOnce.Do(func() {
+		p := parser.New(lexer.NewFile("prelude.ash", Source))
+		program = p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			panic(fmt.Sprintf("prelude: %s", strings.Join(p.Errors(), "\n")))
+		}
+	})
+
+	return program
+}
+
+// Functions returns the top-level let statements of the prelude, which
+// define its functions, in order.
+func Functions() []*ast.LetStatement {
+	functions := []*ast.LetStatement{}
+
+	for _, stmt := range Program().Statements {
+		let, ok := stmt.(*ast.LetStatement)
+		if !ok {
+			panic(fmt.Sprintf("prelude: unexpected statement %s", stmt))
+		}
+		if _, ok := let.Value.(*ast.FunctionLiteral); !ok {
+			panic(fmt.Sprintf("prelude: %s is not a function", let.Name))
+		}
+		functions = append(functions, let)
+	}
+
+	return functions
+}
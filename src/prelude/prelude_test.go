@@ -0,0 +1,27 @@
+package prelude
+
+import "testing"
+
+func TestFunctions(t *testing.T) {
+	functions := Functions()
+	if len(functions) == 0 {
+		t.Fatalf("prelude defines no functions")
+	}
+
+	exported := map[string]bool{}
+	for _, let := range functions {
+		if let.Exported {
+			exported[let.Name.Value] = true
+		}
+	}
+
+	for _, name := range []string{"range", "reduce", "map", "filter", "join"} {
+		if !exported[name] {
+			t.Errorf("prelude does not export %s", name)
+		}
+	}
+
+	if exported["loop"] {
+		t.Errorf("prelude exports its helper loop")
+	}
+}
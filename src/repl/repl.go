@@ -1,8 +1,11 @@
 package repl
 
 import (
+	"ash/ast"
 	"ash/compiler"
+	"ash/evaluator"
 	"ash/lexer"
+	"ash/module"
 	"ash/object"
 	"ash/parser"
 	color "ash/utils"
@@ -12,15 +15,24 @@ import (
 	"io"
 )
 
-func Start(in io.Reader, out io.Writer) {
+// Start runs the REPL, compiling each line at the optimization level.
+func Start(in io.Reader, out io.Writer, level compiler.OptimizationLevel) {
 	scanner := bufio.NewScanner(in)
 
 	constants := []object.Object{}
-	globals := make([]object.Object, vm.GlobalsSize)
+	var globals []object.Object
+	macroEnv := object.NewEnvironment()
+	loader := module.NewLoader(module.SearchPathFromEnv())
+	loader.Transform = func(program *ast.Program) (*ast.Program, error) {
+		return evaluator.Expand(program, object.NewEnvironment())
+	}
 	symbolTable := compiler.NewSymbolTable()
 	for i, v := range object.Builtins {
 		symbolTable.DefineBuiltin(i, v.Name)
 	}
+	for _, s := range compiler.PreludeSymbols() {
+		symbolTable.DefinePrelude(s.Index, s.Name)
+	}
 
 	for {
 		fmt.Printf(color.Format(color.CYAN, ">> "))
@@ -39,8 +51,21 @@ func Start(in io.Reader, out io.Writer) {
 			continue
 		}
 
+		program, err := evaluator.Expand(program, macroEnv)
+		if err != nil {
+			fmt.Fprintf(out, "Macro expansion failed:\n %s\n", err)
+			continue
+		}
+
+		err = loader.Resolve(program, "")
+		if err != nil {
+			fmt.Fprintf(out, "Import failed:\n %s\n", err)
+			continue
+		}
+
 		comp := compiler.NewWithState(symbolTable, constants)
-		err := comp.Compile(program)
+		comp.SetOptimization(level)
+		err = comp.Compile(program)
 		if err != nil {
 			fmt.Fprintf(out, "Compilation failed:\n %s\n", err)
 			continue
@@ -51,8 +76,9 @@ func Start(in io.Reader, out io.Writer) {
 
 		vm := vm.NewWithGlobalsStore(code, globals)
 		err = vm.Run()
+		globals = vm.Globals()
 		if err != nil {
-			fmt.Fprintf(out, "Executing bytecode failed:\n %s\n", err)
+			color.PrintRuntimeError(out, err)
 			continue
 		}
 
@@ -1,6 +1,10 @@
 package utils
 
-import "io"
+import (
+	"ash/object"
+	"fmt"
+	"io"
+)
 
 func PrintParserErrors(out io.Writer, errors []string) {
 	for _, msg := range errors {
@@ -8,3 +12,13 @@ func PrintParserErrors(out io.Writer, errors []string) {
 		io.WriteString(out, msg+"\n")
 	}
 }
+
+// PrintRuntimeError prints the error the VM failed with, followed by its
+// stack trace if it was raised by the program.
+func PrintRuntimeError(out io.Writer, err error) {
+	msg := err.Error()
+	if raised, ok := err.(*object.Error); ok {
+		msg = raised.StackTrace()
+	}
+	fmt.Fprintf(out, "Executing bytecode failed:\n %s\n", msg)
+}
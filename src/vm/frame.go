@@ -24,3 +24,19 @@ func NewFrame(cl *object.Closure, basePointer int) *Frame {
 func (f *Frame) Instructions() code.Instructions {
 	return f.cl.Fn.Instructions
 }
+
+// readOperand reads the operand of width bytes after the frame's ip in ins,
+// its instructions, and moves the ip past it.
+func (f *Frame) readOperand(ins code.Instructions, width int) int {
+	start := f.ip + 1
+	f.ip += width
+
+	switch width {
+	case 1:
+		return int(code.ReadUint8(ins[start:]))
+	case 2:
+		return int(code.ReadUint16(ins[start:]))
+	default:
+		return int(code.ReadUint32(ins[start:]))
+	}
+}
@@ -0,0 +1,109 @@
+package vm
+
+import "ash/object"
+
+// Value is a slot of the VM's stack and globals. Integers, booleans and null
+// are held in the slot itself, so operations on them don't allocate; other
+// values point to their object. Builtins, closures' free variables and the
+// host see values boxed as objects.
+type Value struct {
+	kind valueKind
+	n    int64         // the integer, or 1 for true
+	obj  object.Object // the object of a kindObject value
+}
+
+type valueKind uint8
+
+const (
+	// The zero Value is a nil object, like a global not set yet
+	kindObject valueKind = iota
+	kindInteger
+	kindBoolean
+	kindNull
+)
+
+var (
+	trueValue  = Value{kind: kindBoolean, n: 1}
+	falseValue = Value{kind: kindBoolean}
+	nullValue  = Value{kind: kindNull}
+)
+
+func integerValue(n int64) Value {
+	return Value{kind: kindInteger, n: n}
+}
+
+func booleanValue(b bool) Value {
+	if b {
+		return trueValue
+	}
+	return falseValue
+}
+
+// ValueOf unboxes obj. Integers, booleans and null always become immediate
+// values, so values of the same kind compare alike.
+func ValueOf(obj object.Object) Value {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return integerValue(obj.Value)
+	case *object.Boolean:
+		return booleanValue(obj.Value)
+	case *object.Null:
+		return nullValue
+	default:
+		return Value{kind: kindObject, obj: obj}
+	}
+}
+
+// Object boxes v. Booleans and null box to the shared objects, while each
+// integer boxes to a new one.
+func (v Value) Object() object.Object {
+	switch v.kind {
+	case kindInteger:
+		return &object.Integer{Value: v.n}
+	case kindBoolean:
+		return nativeBoolToBooleanObject(v.n == 1)
+	case kindNull:
+		return Null
+	default:
+		return v.obj
+	}
+}
+
+// Type returns the type of v's object, without boxing it.
+func (v Value) Type() object.ObjectType {
+	switch v.kind {
+	case kindInteger:
+		return object.INTEGER_OBJ
+	case kindBoolean:
+		return object.BOOLEAN_OBJ
+	case kindNull:
+		return object.NULL_OBJ
+	default:
+		return v.obj.Type()
+	}
+}
+
+// hashKey returns the key v hashes to, like its object's HashKey, and
+// whether it can be a hash key at all.
+func hashKey(v Value) (object.HashKey, bool) {
+	if v.kind == kindInteger {
+		return object.HashKey{Type: object.INTEGER_OBJ, Value: uint64(v.n)}, true
+	}
+
+	key, ok := v.Object().(object.Hashable)
+	if !ok {
+		return object.HashKey{}, false
+	}
+	return key.HashKey(), true
+}
+
+func isTruthy(v Value) bool {
+	switch v.kind {
+	case kindBoolean:
+		return v.n == 1
+	case kindNull:
+		return false
+	default:
+		return true
+	}
+}
@@ -4,78 +4,200 @@ import (
 	"ash/code"
 	"ash/compiler"
 	"ash/object"
+	"context"
 	"fmt"
 )
 
-const StackSize = 2048
-const GlobalsSize = 65536
-const MaxFrames = 1024
+// The default maximum sizes of a VM's stack, globals and frames. The VM
+// starts small and grows each of them on demand, up to its maximum.
+const (
+	StackSize   = 1 << 20 // values on the stack
+	GlobalsSize = 65536   // globals; programs with more need a larger MaxGlobals
 
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
-var Null = &object.Null{}
+	// MaxFrames limits the depth of calls, which is the number of frames:
+	// one for the top level, and one per call in progress
+	MaxFrames = 1024
+)
+
+// The sizes a VM starts with, enough for small programs.
+const (
+	initialStackSize   = 64
+	initialGlobalsSize = 16
+	initialFrames      = 8
+)
+
+// Options sets the maximum sizes of a VM. Fields left at zero take the
+// defaults.
+type Options struct {
+	MaxStack   int
+	MaxGlobals int
+	MaxFrames  int
+
+	// The budget of each run, unlimited if 0. See object.Budget.
+	MaxInstructions int64
+	MaxAllocations  int64
+}
+
+var True = object.TRUE
+var False = object.FALSE
+var Null = object.NULL
 
 type VM struct {
 	constants []object.Object
+	prelude   []object.Object
 
-	stack []object.Object
+	stack []Value
 	sp    int // Always points to the next value. Top of stack is stack[sp-1]
 
-	globals []object.Object
+	globals []Value
 
-	frames      []*Frame
+	// args holds the arguments of a builtin call, boxed
+	args []object.Object
+
+	frames      []Frame // held by value, so calls don't allocate them
 	framesIndex int
+
+	options Options
+	budget  *object.Budget // of the current run
 }
 
 func New(bytecode *compiler.Bytecode) *VM {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
+	return NewWithOptions(bytecode, Options{})
+}
+
+// NewWithOptions returns a VM running bytecode with the maximum sizes of
+// options.
+func NewWithOptions(bytecode *compiler.Bytecode, options Options) *VM {
+	mainFn := &object.CompiledFunction{
+		Name:         object.MainFunction,
+		Instructions: bytecode.Instructions,
+		Handlers:     bytecode.Handlers,
+		Positions:    bytecode.Positions,
+	}
 	mainClosure := &object.Closure{Fn: mainFn}
 	mainFrame := NewFrame(mainClosure, 0)
 
-	frames := make([]*Frame, MaxFrames)
-	frames[0] = mainFrame
+	if options.MaxStack == 0 {
+		options.MaxStack = StackSize
+	}
+	if options.MaxGlobals == 0 {
+		options.MaxGlobals = GlobalsSize
+	}
+	if options.MaxFrames == 0 {
+		options.MaxFrames = MaxFrames
+	}
+
+	frames := make([]Frame, min(initialFrames, options.MaxFrames))
+	frames[0] = *mainFrame
 
 	return &VM{
 		constants: bytecode.Constants,
+		prelude:   compiler.Prelude(),
 
-		stack: make([]object.Object, StackSize),
+		stack: make([]Value, min(initialStackSize, options.MaxStack)),
 		sp:    0,
 
-		globals: make([]object.Object, GlobalsSize),
+		globals: make([]Value, min(initialGlobalsSize, options.MaxGlobals)),
 
 		frames:      frames,
 		framesIndex: 1,
+
+		options: options,
 	}
 }
 
+// NewWithGlobalsStore returns a VM that starts with the globals s, which a
+// previous VM left, as returned by its Globals method.
 func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
 	vm := New(bytecode)
-	vm.globals = s
+	vm.globals = make([]Value, len(s))
+	for i, global := range s {
+		vm.globals[i] = ValueOf(global)
+	}
 	return vm
 }
 
+// Globals returns the globals of the program, boxed, to run more code with
+// them.
+func (vm *VM) Globals() []object.Object {
+	globals := make([]object.Object, len(vm.globals))
+	for i, global := range vm.globals {
+		globals[i] = global.Object()
+	}
+	return globals
+}
+
 func (vm *VM) LastPoppedStackElem() object.Object {
-	return vm.stack[vm.sp]
+	return vm.stack[vm.sp].Object()
 }
 
+// Run runs the program. Runtime errors unwind the stack to the innermost
+// handler covering them; Run returns the ones no handler catches.
 func (vm *VM) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+// RunContext runs the program like Run, but stops it when ctx is done or
+// when it runs out of the budget of the VM's options. The error it stops it
+// with wraps ctx.Err(), object.ErrInstructionBudget or
+// object.ErrAllocationBudget, and the program can't catch it.
+func (vm *VM) RunContext(ctx context.Context) (err error) {
+	vm.budget = object.NewBudget(ctx, vm.options.MaxInstructions, vm.options.MaxAllocations)
+
+	// A bug in the VM must not crash the program embedding it
+	defer func() {
+		if r := recover(); r != nil {
+			err = newError(object.RuntimeError, "internal error: %v", r)
+		}
+	}()
+
+	for {
+		err := vm.run()
+		if err == nil {
+			return nil
+		}
+
+		err = vm.throw(err)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (vm *VM) run() error {
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
+	var width int // of the narrowest operands of op
 
 	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
 		vm.currentFrame().ip++
 
+		// The run stops at the instruction it can't afford, so the error is
+		// reported at its position
+		if err := vm.budget.Step(); err != nil {
+			return err
+		}
+
 		ip = vm.currentFrame().ip
 		ins = vm.currentFrame().Instructions()
 		op = code.Opcode(ins[ip])
 
+		// The operands of an instruction prefixed with OpWide are twice as
+		// wide
+		width = 1
+		if op == code.OpWide {
+			vm.currentFrame().ip++
+			ip++
+			op = code.Opcode(ins[ip])
+			width = 2
+		}
+
 		switch op {
 		case code.OpConstant:
-			constIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+			constIndex := vm.currentFrame().readOperand(ins, 2*width)
 
-			err := vm.push(vm.constants[constIndex])
+			err := vm.push(ValueOf(vm.constant(constIndex)))
 			if err != nil {
 				return err
 			}
@@ -84,25 +206,57 @@ func (vm *VM) Run() error {
 			vm.pop()
 
 		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
-			err := vm.executeBinaryOperation(op)
+			right := vm.pop()
+			left := vm.pop()
+
+			err := vm.executeBinaryOperation(op, left, right)
+			if err != nil {
+				return err
+			}
+
+		case code.OpAddConst, code.OpSubConst:
+			constIndex := vm.currentFrame().readOperand(ins, 2*width)
+
+			operation := code.OpAdd
+			if op == code.OpSubConst {
+				operation = code.OpSub
+			}
+
+			err := vm.executeBinaryOperation(operation, vm.pop(), ValueOf(vm.constant(constIndex)))
 			if err != nil {
 				return err
 			}
 
 		case code.OpTrue:
-			err := vm.push(True)
+			err := vm.push(trueValue)
 			if err != nil {
 				return err
 			}
 
 		case code.OpFalse:
-			err := vm.push(False)
+			err := vm.push(falseValue)
 			if err != nil {
 				return err
 			}
 
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
-			err := vm.executeComparison(op)
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan:
+			right := vm.pop()
+			left := vm.pop()
+
+			err := vm.executeComparison(op, left, right)
+			if err != nil {
+				return err
+			}
+
+		case code.OpLessThanConst, code.OpEqualConst:
+			constIndex := vm.currentFrame().readOperand(ins, 2*width)
+
+			comparison := code.OpLessThan
+			if op == code.OpEqualConst {
+				comparison = code.OpEqual
+			}
+
+			err := vm.executeComparison(comparison, vm.pop(), ValueOf(vm.constant(constIndex)))
 			if err != nil {
 				return err
 			}
@@ -120,54 +274,71 @@ func (vm *VM) Run() error {
 			}
 
 		case code.OpJump:
-			pos := int(code.ReadUint16(ins[ip+1:]))
+			pos := vm.currentFrame().readOperand(ins, 2*width)
 			vm.currentFrame().ip = pos - 1
 
 		case code.OpJumpNotTruthy:
-			pos := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+			pos := vm.currentFrame().readOperand(ins, 2*width)
 
 			condition := vm.pop()
 			if !isTruthy(condition) {
 				vm.currentFrame().ip = pos - 1
 			}
 
+		case code.OpJumpNull, code.OpJumpNotNull:
+			pos := vm.currentFrame().readOperand(ins, 2*width)
+
+			isNull := vm.stack[vm.sp-1].kind == kindNull
+			if isNull == (op == code.OpJumpNull) {
+				vm.currentFrame().ip = pos - 1
+			}
+
 		case code.OpNull:
-			err := vm.push(Null)
+			err := vm.push(nullValue)
 			if err != nil {
 				return err
 			}
 
 		case code.OpSetGlobal:
-			globalIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+			globalIndex := vm.currentFrame().readOperand(ins, 2*width)
 
-			vm.globals[globalIndex] = vm.pop()
+			err := vm.setGlobal(globalIndex, vm.pop())
+			if err != nil {
+				return err
+			}
 
 		case code.OpGetGlobal:
-			globalIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+			globalIndex := vm.currentFrame().readOperand(ins, 2*width)
 
-			err := vm.push(vm.globals[globalIndex])
+			var global Value
+			if globalIndex < len(vm.globals) {
+				global = vm.globals[globalIndex]
+			}
+
+			// A function called in the value of a let statement can read
+			// the global before the value is stored in it
+			if global.kind == kindObject && global.obj == nil {
+				return newError(object.NameError, "variable read before it is defined")
+			}
+
+			err := vm.push(global)
 			if err != nil {
 				return err
 			}
 
 		case code.OpArray:
-			numElements := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+			numElements := vm.currentFrame().readOperand(ins, 2*width)
 
 			array := vm.buildArray(vm.sp-numElements, vm.sp)
 			vm.sp -= numElements
 
-			err := vm.push(array)
+			err := vm.pushNew(array)
 			if err != nil {
 				return err
 			}
 
 		case code.OpHash:
-			numElements := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+			numElements := vm.currentFrame().readOperand(ins, 2*width)
 
 			hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
 			if err != nil {
@@ -175,7 +346,7 @@ func (vm *VM) Run() error {
 			}
 			vm.sp -= numElements
 
-			err = vm.push(hash)
+			err = vm.pushNew(hash)
 			if err != nil {
 				return err
 			}
@@ -189,15 +360,54 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		case code.OpSlice:
+			step := vm.pop()
+			end := vm.pop()
+			start := vm.pop()
+			left := vm.pop()
+
+			result := object.Slice(left.Object(), start.Object(), end.Object(), step.Object())
+			if err, ok := result.(*object.Error); ok {
+				return err
+			}
+
+			err := vm.pushNew(result)
+			if err != nil {
+				return err
+			}
+
 		case code.OpCall:
-			numArgs := int(code.ReadUint8(ins[ip+1:]))
-			vm.currentFrame().ip += 1
+			numArgs := vm.currentFrame().readOperand(ins, width)
 
 			err := vm.executeCall(numArgs)
 			if err != nil {
 				return err
 			}
 
+		case code.OpCall0, code.OpCall1, code.OpCall2, code.OpCall3:
+			err := vm.executeCall(int(op - code.OpCall0))
+			if err != nil {
+				return err
+			}
+
+		case code.OpTailCall:
+			numArgs := vm.currentFrame().readOperand(ins, width)
+
+			err := vm.executeTailCall(numArgs)
+			if err != nil {
+				return err
+			}
+
+		case code.OpMethodCall:
+			nameIndex := vm.currentFrame().readOperand(ins, 2*width)
+			numArgs := vm.currentFrame().readOperand(ins, width)
+
+			name := vm.constant(nameIndex).(*object.String)
+			err := vm.executeMethodCall(name, numArgs)
+			if err != nil {
+				return err
+			}
+
 		case code.OpReturnValue:
 			returnValue := vm.pop()
 
@@ -213,45 +423,57 @@ func (vm *VM) Run() error {
 			frame := vm.popFrame()
 			vm.sp = frame.basePointer - 1
 
-			err := vm.push(Null)
+			err := vm.push(nullValue)
 			if err != nil {
 				return err
 			}
 
 		case code.OpSetLocal:
-			localIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+			localIndex := vm.currentFrame().readOperand(ins, width)
 
 			frame := vm.currentFrame()
 
-			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+			vm.stack[frame.basePointer+localIndex] = vm.pop()
 
 		case code.OpGetLocal:
-			localIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+			localIndex := vm.currentFrame().readOperand(ins, width)
+
+			frame := vm.currentFrame()
+
+			err := vm.push(vm.stack[frame.basePointer+localIndex])
+			if err != nil {
+				return err
+			}
 
+		case code.OpGetLocal0, code.OpGetLocal1, code.OpGetLocal2, code.OpGetLocal3:
 			frame := vm.currentFrame()
 
-			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+			err := vm.push(vm.stack[frame.basePointer+int(op-code.OpGetLocal0)])
 			if err != nil {
 				return err
 			}
 
 		case code.OpGetBuiltin:
-			builtinIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+			builtinIndex := vm.currentFrame().readOperand(ins, width)
 
 			definition := object.Builtins[builtinIndex]
 
-			err := vm.push(definition.Builtin)
+			err := vm.push(Value{obj: definition.Builtin})
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetPrelude:
+			preludeIndex := vm.currentFrame().readOperand(ins, width)
+
+			err := vm.push(Value{obj: vm.prelude[preludeIndex]})
 			if err != nil {
 				return err
 			}
 
 		case code.OpClosure:
-			constIndex := int(code.ReadUint16(ins[ip+1:]))
-			numFree := int(code.ReadUint8(ins[ip+3:]))
-			vm.currentFrame().ip += 3
+			constIndex := vm.currentFrame().readOperand(ins, 2*width)
+			numFree := vm.currentFrame().readOperand(ins, width)
 
 			err := vm.pushClosure(constIndex, numFree)
 			if err != nil {
@@ -259,69 +481,141 @@ func (vm *VM) Run() error {
 			}
 
 		case code.OpGetFree:
-			freeIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+			freeIndex := vm.currentFrame().readOperand(ins, width)
 
 			currentClosure := vm.currentFrame().cl
-			err := vm.push(currentClosure.Free[freeIndex])
+			err := vm.push(ValueOf(currentClosure.Free[freeIndex]))
 			if err != nil {
 				return err
 			}
 
 		case code.OpCurrentClosure:
 			currentClosure := vm.currentFrame().cl
-			err := vm.push(currentClosure)
+			err := vm.push(Value{obj: currentClosure})
 			if err != nil {
 				return err
 			}
+
+		case code.OpThrow:
+			// A finally block throwing again gets the error itself
+			value := vm.pop().Object()
+			if err, ok := value.(*object.Error); ok {
+				return err
+			}
+			return object.Throw(value)
+		}
+	}
+
+	return nil
+}
+
+// setGlobal sets the global at index, growing the globals to hold it.
+func (vm *VM) setGlobal(index int, v Value) error {
+	if index >= len(vm.globals) {
+		if index >= vm.options.MaxGlobals {
+			return newError(object.RuntimeError, "too many globals")
 		}
+		vm.globals = grow(vm.globals, index+1, vm.options.MaxGlobals)
+	}
+
+	vm.globals[index] = v
+	return nil
+}
+
+// reserve grows the stack to hold size values.
+func (vm *VM) reserve(size int) error {
+	if size <= len(vm.stack) {
+		return nil
+	}
+	if size > vm.options.MaxStack {
+		return newError(object.RuntimeError, "stack overflow")
 	}
 
+	vm.stack = grow(vm.stack, size, vm.options.MaxStack)
 	return nil
 }
 
-func (vm *VM) push(o object.Object) error {
-	if vm.sp >= StackSize {
-		return fmt.Errorf("stack overflow")
+// grow returns s with its length doubled, or more to reach size, but no more
+// than limit.
+func grow[T any](s []T, size, limit int) []T {
+	n := min(max(2*len(s), size), limit)
+
+	grown := make([]T, n)
+	copy(grown, s)
+	return grown
+}
+
+func (vm *VM) push(v Value) error {
+	err := vm.reserve(vm.sp + 1)
+	if err != nil {
+		return err
 	}
 
-	vm.stack[vm.sp] = o
+	vm.stack[vm.sp] = v
 	vm.sp++
 
 	return nil
 }
 
-func (vm *VM) pop() object.Object {
-	o := vm.stack[vm.sp-1]
-	vm.sp--
-	return o
+// pushNew pushes o, which the VM has just allocated, charging it to the
+// budget of the run.
+func (vm *VM) pushNew(o object.Object) error {
+	if err := vm.budget.Allocate(o); err != nil {
+		return err
+	}
+	return vm.push(ValueOf(o))
 }
 
-func (vm *VM) executeBinaryOperation(op code.Opcode) error {
-	right := vm.pop()
-	left := vm.pop()
+func (vm *VM) pop() Value {
+	v := vm.stack[vm.sp-1]
+	vm.sp--
+	return v
+}
 
-	leftType := left.Type()
-	rightType := right.Type()
+// boxed returns the values of the stack from start to end as objects, in a
+// slice reused by the next call.
+func (vm *VM) boxed(start, end int) []object.Object {
+	vm.args = vm.args[:0]
+	for _, v := range vm.stack[start:end] {
+		vm.args = append(vm.args, v.Object())
+	}
+	return vm.args
+}
 
+func (vm *VM) executeBinaryOperation(op code.Opcode, left, right Value) error {
 	switch {
-	case leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ:
-		return vm.executeBinaryIntegerOperation(op, left, right)
-	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
+	case left.kind == kindInteger && right.kind == kindInteger:
+		return vm.executeBinaryIntegerOperation(op, left.n, right.n)
+	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
 		return vm.executeBinaryStringOperation(op, left, right)
 	default:
-		return fmt.Errorf("unsupported types for binary operation: %s %s",
-			leftType, rightType)
+		return operandsError(op, left, right)
 	}
 }
 
-func (vm *VM) executeBinaryIntegerOperation(
-	op code.Opcode,
-	left, right object.Object,
-) error {
-	leftValue := left.(*object.Integer).Value
-	rightValue := right.(*object.Integer).Value
+// operators maps the opcodes of binary operations to their operators in
+// the source, for error messages.
+var operators = map[code.Opcode]string{
+	code.OpAdd:         "+",
+	code.OpSub:         "-",
+	code.OpMul:         "*",
+	code.OpDiv:         "/",
+	code.OpGreaterThan: ">",
+	code.OpLessThan:    "<",
+}
 
+// operandsError returns the error for a binary operation op doesn't
+// support on left and right, worded like the evaluator's.
+func operandsError(op code.Opcode, left, right Value) error {
+	if left.Type() != right.Type() {
+		return newError(object.TypeError, "type mismatch: %s %s %s",
+			left.Type(), operators[op], right.Type())
+	}
+	return newError(object.TypeError, "unknown operator: %s %s %s",
+		left.Type(), operators[op], right.Type())
+}
+
+func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, leftValue, rightValue int64) error {
 	var result int64
 
 	switch op {
@@ -332,97 +626,99 @@ func (vm *VM) executeBinaryIntegerOperation(
 	case code.OpMul:
 		result = leftValue * rightValue
 	case code.OpDiv:
+		if rightValue == 0 {
+			return newError(object.ZeroDivisionError, "division by zero")
+		}
 		result = leftValue / rightValue
 	default:
 		return fmt.Errorf("unknown integer operator: %d", op)
 	}
 
-	return vm.push(&object.Integer{Value: result})
+	return vm.push(integerValue(result))
 }
 
-func (vm *VM) executeComparison(op code.Opcode) error {
-	right := vm.pop()
-	left := vm.pop()
+func (vm *VM) executeComparison(op code.Opcode, left, right Value) error {
+	if left.kind == kindInteger && right.kind == kindInteger {
+		return vm.executeIntegerComparison(op, left.n, right.n)
+	}
 
-	if left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ {
-		return vm.executeIntegerComparison(op, left, right)
+	if left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ {
+		return vm.executeStringComparison(op, left, right)
 	}
 
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(right == left))
+		return vm.push(booleanValue(right == left))
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(right != left))
+		return vm.push(booleanValue(right != left))
 	default:
-		return fmt.Errorf("unknown operator: %d (%s %s)",
-			op, left.Type(), right.Type())
+		return operandsError(op, left, right)
 	}
 }
 
-func (vm *VM) executeIntegerComparison(
-	op code.Opcode,
-	left, right object.Object,
-) error {
-	leftValue := left.(*object.Integer).Value
-	rightValue := right.(*object.Integer).Value
-
+func (vm *VM) executeIntegerComparison(op code.Opcode, leftValue, rightValue int64) error {
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(rightValue == leftValue))
+		return vm.push(booleanValue(rightValue == leftValue))
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
+		return vm.push(booleanValue(rightValue != leftValue))
 	case code.OpGreaterThan:
-		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+		return vm.push(booleanValue(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(booleanValue(leftValue < rightValue))
 	default:
 		return fmt.Errorf("unknown operator: %d", op)
 	}
 }
 
-func (vm *VM) executeBangOperator() error {
-	operand := vm.pop()
+// executeStringComparison compares strings by value, unlike other objects,
+// which are equal only to themselves.
+func (vm *VM) executeStringComparison(op code.Opcode, left, right Value) error {
+	leftValue := left.obj.(*object.String).Value
+	rightValue := right.obj.(*object.String).Value
 
-	switch operand {
-	case True:
-		return vm.push(False)
-	case False:
-		return vm.push(True)
-	case Null:
-		return vm.push(True)
+	switch op {
+	case code.OpEqual:
+		return vm.push(booleanValue(leftValue == rightValue))
+	case code.OpNotEqual:
+		return vm.push(booleanValue(leftValue != rightValue))
 	default:
-		return vm.push(False)
+		return operandsError(op, left, right)
 	}
 }
 
+func (vm *VM) executeBangOperator() error {
+	operand := vm.pop()
+
+	return vm.push(booleanValue(!isTruthy(operand)))
+}
+
 func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
 
-	if operand.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+	if operand.kind != kindInteger {
+		return newError(object.TypeError, "unknown operator: -%s", operand.Type())
 	}
 
-	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
+	return vm.push(integerValue(-operand.n))
 }
 
-func (vm *VM) executeBinaryStringOperation(
-	op code.Opcode,
-	left, right object.Object,
-) error {
+func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right Value) error {
 	if op != code.OpAdd {
-		return fmt.Errorf("unknown string operator: %d", op)
+		return operandsError(op, left, right)
 	}
 
-	leftValue := left.(*object.String).Value
-	rightValue := right.(*object.String).Value
+	leftValue := left.obj.(*object.String).Value
+	rightValue := right.obj.(*object.String).Value
 
-	return vm.push(&object.String{Value: leftValue + rightValue})
+	return vm.pushNew(&object.String{Value: leftValue + rightValue})
 }
 
 func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
 	elements := make([]object.Object, endIndex-startIndex)
 
 	for i := startIndex; i < endIndex; i++ {
-		elements[i-startIndex] = vm.stack[i]
+		elements[i-startIndex] = vm.stack[i].Object()
 	}
 
 	return &object.Array{Elements: elements}
@@ -432,14 +728,14 @@ func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 	hashedPairs := make(map[object.HashKey]object.HashPair)
 
 	for i := startIndex; i < endIndex; i += 2 {
-		key := vm.stack[i]
-		value := vm.stack[i+1]
+		key := vm.stack[i].Object()
+		value := vm.stack[i+1].Object()
 
 		pair := object.HashPair{Key: key, Value: value}
 
 		hashKey, ok := key.(object.Hashable)
 		if !ok {
-			return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
+			return nil, newError(object.TypeError, "unusable as hash key: %s", key.Type())
 		}
 
 		hashedPairs[hashKey.HashKey()] = pair
@@ -448,102 +744,267 @@ func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 	return &object.Hash{Pairs: hashedPairs}, nil
 }
 
-func (vm *VM) executeIndexExpression(left, index object.Object) error {
+func (vm *VM) executeIndexExpression(left, index Value) error {
 	switch {
-	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
-		return vm.executeArrayIndex(left, index)
+	case left.Type() == object.ARRAY_OBJ && index.kind == kindInteger:
+		return vm.executeArrayIndex(left.obj.(*object.Array), index.n)
+	case left.Type() == object.STRING_OBJ && index.kind == kindInteger:
+		return vm.executeStringIndex(left.obj.(*object.String), index.n)
 	case left.Type() == object.HASH_OBJ:
-		return vm.executeHashIndex(left, index)
+		return vm.executeHashIndex(left.obj.(*object.Hash), index)
 	default:
-		return fmt.Errorf("index operator not supported: %s", left.Type())
+		return newError(object.TypeError, "index operator not supported: %s", left.Type())
 	}
 }
 
-func (vm *VM) executeArrayIndex(array, index object.Object) error {
-	arrayObject := array.(*object.Array)
-	i := index.(*object.Integer).Value
+func (vm *VM) executeArrayIndex(arrayObject *object.Array, i int64) error {
 	max := int64(len(arrayObject.Elements) - 1)
 
+	if i < 0 {
+		i += max + 1
+	}
+
+	if i < 0 || i > max {
+		return vm.push(nullValue)
+	}
+
+	return vm.push(ValueOf(arrayObject.Elements[i]))
+}
+
+func (vm *VM) executeStringIndex(str *object.String, i int64) error {
+	value := str.Value
+	max := int64(len(value) - 1)
+
+	if i < 0 {
+		i += max + 1
+	}
+
 	if i < 0 || i > max {
-		return vm.push(Null)
+		return vm.push(nullValue)
 	}
 
-	return vm.push(arrayObject.Elements[i])
+	return vm.pushNew(&object.String{Value: value[i : i+1]})
 }
 
-func (vm *VM) executeHashIndex(hash, index object.Object) error {
-	hashObject := hash.(*object.Hash)
+func (vm *VM) executeHashIndex(hashObject *object.Hash, index Value) error {
+	key, ok := hashKey(index)
+	if !ok {
+		return newError(object.TypeError, "unusable as hash key: %s", index.Type())
+	}
 
-	key, ok := index.(object.Hashable)
+	pair, ok := hashObject.Pairs[key]
 	if !ok {
-		return fmt.Errorf("unusable as hash key: %s", index.Type())
+		return vm.push(nullValue)
 	}
 
-	pair, ok := hashObject.Pairs[key.HashKey()]
+	return vm.push(ValueOf(pair.Value))
+}
+
+// throw unwinds the stack to the innermost handler covering the current
+// instruction of a frame, and resumes at the handler with err's payload on
+// the stack. It returns err if no handler catches it. Errors are located at
+// the instruction that raised them.
+func (vm *VM) throw(err error) error {
+	raised, ok := err.(*object.Error)
 	if !ok {
-		return vm.push(Null)
+		raised = &object.Error{Kind: object.RuntimeError, Message: err.Error()}
+	}
+
+	if raised.Trace == nil {
+		frame := vm.currentFrame()
+		pos := frame.cl.Fn.Positions.Lookup(frame.ip)
+		raised.Locate(pos.File, pos.Line, pos.Column)
+		raised.Trace = vm.stackTrace(raised)
+	}
+	if raised.Cause != nil {
+		return raised // the run is aborted, no handler catches it
+	}
+
+	for {
+		frame := vm.currentFrame()
+
+		for _, h := range frame.cl.Fn.Handlers {
+			if frame.ip >= h.Start && frame.ip < h.End {
+				vm.sp = frame.basePointer + frame.cl.Fn.NumLocals + h.StackDepth
+				frame.ip = h.Target - 1
+				if h.Rethrow {
+					return vm.push(Value{obj: raised})
+				}
+				return vm.push(ValueOf(raised.Payload()))
+			}
+		}
+
+		if vm.framesIndex == 1 {
+			return raised
+		}
+		vm.popFrame()
+	}
+}
+
+// stackTrace walks the frames to return the stack trace of err, raised in
+// the current frame. The frames of the callers are at their calls.
+func (vm *VM) stackTrace(err *object.Error) []object.TraceFrame {
+	trace := make([]object.TraceFrame, 0, vm.framesIndex)
+
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		pos := frame.cl.Fn.Positions.Lookup(frame.ip)
+		if i == vm.framesIndex-1 {
+			pos = object.Position{File: err.File, Line: err.Line, Column: err.Column}
+		}
+
+		trace = append(trace, object.TraceFrame{
+			Function: frame.cl.Fn.Name, File: pos.File, Line: pos.Line, Column: pos.Column,
+		})
 	}
 
-	return vm.push(pair.Value)
+	return trace
 }
 
+// currentFrame returns the frame being run. It moves when the frames grow,
+// so it is only valid until the next call.
 func (vm *VM) currentFrame() *Frame {
-	return vm.frames[vm.framesIndex-1]
+	return &vm.frames[vm.framesIndex-1]
 }
 
-func (vm *VM) pushFrame(f *Frame) {
-	vm.frames[vm.framesIndex] = f
+func (vm *VM) pushFrame(cl *object.Closure, basePointer int) *Frame {
+	if vm.framesIndex == len(vm.frames) {
+		vm.frames = grow(vm.frames, vm.framesIndex+1, vm.options.MaxFrames)
+	}
+	vm.frames[vm.framesIndex] = Frame{cl: cl, ip: -1, basePointer: basePointer}
 	vm.framesIndex++
+	return vm.currentFrame()
 }
 
 func (vm *VM) popFrame() *Frame {
 	vm.framesIndex--
-	return vm.frames[vm.framesIndex]
+	return &vm.frames[vm.framesIndex]
 }
 
 func (vm *VM) executeCall(numArgs int) error {
 	callee := vm.stack[vm.sp-1-numArgs]
-	switch callee := callee.(type) {
+	switch fn := callee.obj.(type) {
 	case *object.Closure:
-		return vm.callClosure(callee, numArgs)
+		return vm.callClosure(fn, numArgs)
 	case *object.Builtin:
-		return vm.callBuiltin(callee, numArgs)
+		return vm.callBuiltin(fn, numArgs)
 	default:
-		return fmt.Errorf("calling non-closure and non-builtin")
+		return newError(object.TypeError, "not a function: %s", callee.Type())
 	}
 }
 
+// executeMethodCall calls name on the receiver below the arguments on the
+// stack. A hash field holding a function takes precedence over the builtin
+// methods, so hashes can be used as namespaces.
+func (vm *VM) executeMethodCall(name *object.String, numArgs int) error {
+	receiver := vm.stack[vm.sp-1-numArgs]
+
+	if hash, ok := receiver.obj.(*object.Hash); ok {
+		if pair, ok := hash.Pairs[name.HashKey()]; ok {
+			vm.stack[vm.sp-1-numArgs] = ValueOf(pair.Value)
+			return vm.executeCall(numArgs)
+		}
+	}
+
+	method, ok := object.GetMethod(receiver.Object(), name.Value)
+	if !ok {
+		return newError(object.NameError, "undefined method %s for %s",
+			name.Value, receiver.Type())
+	}
+
+	// The receiver becomes the method's first argument
+	args := vm.boxed(vm.sp-1-numArgs, vm.sp)
+
+	result := method.Fn(args...)
+	vm.sp = vm.sp - numArgs - 1
+
+	if err, ok := result.(*object.Error); ok {
+		return err
+	}
+	if result != nil {
+		return vm.pushNew(result)
+	}
+	return vm.push(nullValue)
+}
+
 func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
 	if numArgs != cl.Fn.NumParameters {
-		return fmt.Errorf("wrong number of arguments: want=%d, got=%d",
-			cl.Fn.NumParameters, numArgs)
+		return newError(object.ArgumentError, "wrong number of arguments to %s: want=%d, got=%d",
+			cl.Fn.Name, cl.Fn.NumParameters, numArgs)
 	}
 
-	frame := NewFrame(cl, vm.sp-numArgs)
-	vm.pushFrame(frame)
+	if vm.framesIndex >= vm.options.MaxFrames {
+		return newError(object.RuntimeError, "maximum call depth exceeded")
+	}
+
+	basePointer := vm.sp - numArgs
+	err := vm.reserve(basePointer + cl.Fn.NumLocals)
+	if err != nil {
+		return err
+	}
 
+	frame := vm.pushFrame(cl, basePointer)
+
+	vm.sp = frame.basePointer + cl.Fn.NumLocals
+
+	return nil
+}
+
+// executeTailCall makes a call whose value the current function returns.
+// A closure is called in the current frame, which the call replaces, so
+// recursion in tail position runs in constant space. The compiler doesn't
+// emit tail calls in try blocks, so no handler of the frame is lost.
+func (vm *VM) executeTailCall(numArgs int) error {
+	cl, ok := vm.stack[vm.sp-1-numArgs].obj.(*object.Closure)
+	if !ok {
+		return vm.executeCall(numArgs)
+	}
+	if numArgs != cl.Fn.NumParameters {
+		return newError(object.ArgumentError, "wrong number of arguments to %s: want=%d, got=%d",
+			cl.Fn.Name, cl.Fn.NumParameters, numArgs)
+	}
+
+	// Move the callee and its arguments over those of the current call
+	frame := vm.currentFrame()
+	err := vm.reserve(frame.basePointer + cl.Fn.NumLocals)
+	if err != nil {
+		return err
+	}
+	copy(vm.stack[frame.basePointer-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+
+	frame.cl = cl
+	frame.ip = -1
 	vm.sp = frame.basePointer + cl.Fn.NumLocals
 
 	return nil
 }
 
 func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
-	args := vm.stack[vm.sp-numArgs : vm.sp]
+	args := vm.boxed(vm.sp-numArgs, vm.sp)
 
 	result := builtin.Fn(args...)
-	vm.sp -= numArgs
+	vm.sp = vm.sp - numArgs - 1
 
+	if err, ok := result.(*object.Error); ok {
+		return err
+	}
 	if result != nil {
-		vm.push(result)
-	} else {
-		vm.push(Null)
+		return vm.pushNew(result)
 	}
+	return vm.push(nullValue)
+}
 
-	return nil
+// constant returns the constant at index in the pool of the function being
+// run, which is the program's unless the function was compiled apart from it.
+func (vm *VM) constant(index int) object.Object {
+	if constants := vm.currentFrame().cl.Fn.Constants; constants != nil {
+		return constants[index]
+	}
+	return vm.constants[index]
 }
 
 func (vm *VM) pushClosure(constIndex int, numFree int) error {
-	constant := vm.constants[constIndex]
+	constant := vm.constant(constIndex)
 	fn, ok := constant.(*object.CompiledFunction)
 	if !ok {
 		return fmt.Errorf("not a function: %+v", constant)
@@ -551,11 +1012,16 @@ func (vm *VM) pushClosure(constIndex int, numFree int) error {
 
 	free := make([]object.Object, numFree)
 	for i := 0; i < numFree; i++ {
-		free[i] = vm.stack[vm.sp-numFree+i]
+		free[i] = vm.stack[vm.sp-numFree+i].Object()
 	}
+	vm.sp = vm.sp - numFree
 
 	closure := &object.Closure{Fn: fn, Free: free}
-	return vm.push(closure)
+	return vm.pushNew(closure)
+}
+
+func newError(kind object.ErrorKind, format string, a ...interface{}) *object.Error {
+	return &object.Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
 }
 
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
@@ -564,17 +1030,3 @@ func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	}
 	return False
 }
-
-func isTruthy(obj object.Object) bool {
-	switch obj := obj.(type) {
-
-	case *object.Boolean:
-		return obj.Value
-
-	case *object.Null:
-		return false
-
-	default:
-		return true
-	}
-}
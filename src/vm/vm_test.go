@@ -2,12 +2,23 @@ package vm
 
 import (
 	"ash/ast"
+	"ash/code"
 	"ash/compiler"
+	"ash/evaluator"
 	"ash/lexer"
+	"ash/module"
 	"ash/object"
 	"ash/parser"
+	"ash/prelude"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestIntegerArithmetic(t *testing.T) {
@@ -51,6 +62,9 @@ func TestBooleanExpressions(t *testing.T) {
 		{"true == false", false},
 		{"true != false", true},
 		{"false != true", true},
+		{`"a" == "a"`, true},
+		{`"a" != "a"`, false},
+		{`"a" == "b"`, false},
 		{"(1 < 2) == true", true},
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
@@ -94,6 +108,456 @@ func TestGlobalLetStatements(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestAssignments(t *testing.T) {
+	tests := []vmTestCase{
+		{"let x = 1; x = 2; x", 2},
+		{"let x = 1; x = x + 1", 2},
+		{"let x = 1; let y = 2; x = y = 3; x + y", 6},
+		{"const x = 1; let y = x; y = 2; x + y", 3},
+		{"let n = 0; let inc = fn() { n = n + 1 }; inc(); inc(); n", 2},
+		{"let f = fn() { let x = 1; x = x + 1; x }; f()", 2},
+		{"let f = fn(x) { x = x * 2; x }; f(4)", 8},
+		{"let f = fn() { 1 }; f = fn() { 2 }; f()", 2},
+		{"let f = fn() { f = 2; 1 }; f() + f", 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBlockScopes(t *testing.T) {
+	tests := []vmTestCase{
+		{"let x = 1; if (true) { let x = 2; }; x", 1},
+		{"let x = 1; if (true) { x = 2 }; x", 2},
+		{"let x = 1; if (true) { let x = x + 1; x }", 2},
+		{"let x = 1; let x = x + 1; x", 2},
+		{"let f = fn() { let a = 1; if (true) { let a = 2; a = 3 }; a }; f()", 1},
+		{"let f = fn() { if (true) { let a = 1; a } + if (true) { let b = 2; b } }; f()", 3},
+		{"let g = if (true) { let v = 5; fn() { v } }; g()", 5},
+		{"let f = fn() { let g = if (true) { let v = 5; fn() { v } }; let w = 6; g() + w }; f()", 11},
+		{"let f = fn(x) { let x = x * 2; x }; f(2)", 4},
+		{"if (true) { let a = 1 }", Null},
+		{"if (false) { 1 } else { }", Null},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestMacros(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			`let unless = macro(cond, cons, alt) {
+				quote(if (!(unquote(cond))) { unquote(cons) } else { unquote(alt) })
+			};
+			unless(10 > 5, 1, 2)`,
+			2,
+		},
+		{
+			`let withTmp = macro(x) { quote(fn() { let tmp = 100; unquote(x) }()) };
+			let tmp = 7;
+			withTmp(tmp)`,
+			7,
+		},
+		{
+			`let source = macro(x) { quote(unquote(str(x))) };
+			source(a + b * 2)`,
+			"(a + (b * 2))",
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		env := object.NewEnvironment()
+		evaluator.DefineMacros(program, env)
+		expanded, err := evaluator.ExpandMacros(program, env)
+		if err != nil {
+			t.Fatalf("macro expansion failed: %s", err)
+		}
+
+		comp := compiler.New()
+		err = comp.Compile(expanded)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestModules(t *testing.T) {
+	dir := t.TempDir()
+	writeModules(t, dir, map[string]string{
+		"math.ash": `
+			let secret = 42;
+			export let add = fn(a, b) { a + b };
+			export let addSecret = fn(x) { x + secret };
+			export const pi = 3;
+		`,
+		"lib/util.ash": `
+			import "../math" as m;
+			export let twice = fn(x) { m.add(x, x) };
+			export let math = m;
+		`,
+	})
+
+	tests := []vmTestCase{
+		{`import "math" as math; math.add(1, 2)`, 3},
+		{`import "math.ash" as math; math.pi`, 3},
+		{`import "math" as math; math.addSecret(1)`, 43},
+		{`import "math" as math; math.secret`, Null},
+		{`let secret = 1; import "math" as math; math.addSecret(secret) + secret`, 44},
+		{`import "lib/util" as util; util.twice(4)`, 8},
+		{`import "math" as a; import "math" as b; a == b`, true},
+		{`import "math" as a; import "lib/util" as util; a == util.math`, true},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		loader := module.NewLoader(nil)
+		err := loader.Resolve(program, filepath.Join(dir, "main.ash"))
+		if err != nil {
+			t.Fatalf("import error: %s", err)
+		}
+
+		comp := compiler.New()
+		err = comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestPrelude(t *testing.T) {
+	tests := []vmTestCase{
+		{"range(0, 5)", []int{0, 1, 2, 3, 4}},
+		{"range(3, 3)", []int{}},
+		{"len(range(0, 5000))", 5000},
+		{"reduce([1, 2, 3], 10, fn(acc, x) { acc * 2 + x })", 91},
+		{"map([1, 2, 3], fn(x) { x * 2 })", []int{2, 4, 6}},
+		{"filter(range(0, 10), fn(x) { x > 6 })", []int{7, 8, 9}},
+		{`join([1, "a", true], ", ")`, "1, a, true"},
+		{`join([], ", ")`, ""},
+		{"sum(range(1, 101))", 5050},
+		{"reverse([1, 2, 3])", []int{3, 2, 1}},
+		{"len(map(range(0, 10000), fn(x) { x }))", 10000},
+		{"len(filter(range(0, 10000), fn(x) { x < 500 }))", 500},
+		{"reverse(range(0, 10000))[0]", 9999},
+		{"any([1, 2, 3], fn(x) { x > 2 })", true},
+		{"all([1, 2, 3], fn(x) { x > 2 })", false},
+		{"[1, 2, 3] |> map(x => x + 1) |> sum", 9},
+		{"let map = fn(x) { x }; map(1)", 1},
+		{"let f = fn() { let filter = 2; filter }; f()", 2},
+	}
+
+	runVmTests(t, tests)
+
+	// The prelude must behave the same in the evaluator
+	for _, tt := range tests {
+		evaluated := evaluator.Eval(parse(tt.input), object.NewEnvironment())
+		testExpectedObject(t, tt.expected, evaluated)
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	tests := []vmTestCase{
+		{"try { 1 } catch (e) { 2 }", 1},
+		{"try { throw 1; 2 } catch (e) { e + 10 }", 11},
+		{`try { len(1) } catch (e) { e.message }`, "argument to `len` not supported, got INTEGER"},
+		{`try { 1 + "a" } catch (e) { 5 }`, 5},
+		{"let f = fn(x) { if (x > 2) { throw x }; x }; try { f(1) + f(5) } catch (e) { e }", 5},
+		{"let f = fn(n) { if (n == 0) { throw 0 }; 1 + f(n - 1) }; try { f(20) } catch (e) { e - 1 }", -1},
+		{"[1, try { throw 2 } catch (e) { e * 10 }, 3]", []int{1, 20, 3}},
+		{"try { try { throw 1 } catch (e) { throw e + 1 } } catch (e) { e + 1 }", 3},
+		{"let x = 0; try { x = 1 } finally { x = x + 1 }; x", 2},
+		{"let x = 0; try { try { throw 1 } finally { x = 5 } } catch (e) { x + e }", 6},
+		{"let x = 0; let f = fn() { try { return 1 } finally { x = 2 } }; f() + x", 3},
+		{"let f = fn() { try { throw 1 } catch (e) { return e } finally { 2 } }; f()", 1},
+		{"let f = fn() { try { throw 1 } finally { return 2 } }; f()", 2},
+		{"let f = fn() { try { 1 } catch (e) { 2 } }; f() + try { 3 } catch (e) { 4 }", 4},
+		{"try { throw [1, 2] } catch (e) { e[1] }", 2},
+		{
+			`throw "oops"`,
+			&object.Error{Kind: object.Exception, Message: "oops"},
+		},
+		{
+			"try { throw 1 } catch (e) { throw 2 }",
+			&object.Error{Kind: object.Exception, Message: "2"},
+		},
+		{
+			"try { 1 } finally { len(1) }",
+			&object.Error{Kind: object.TypeError, Message: "argument to `len` not supported, got INTEGER"},
+		},
+	}
+
+	runVmTests(t, tests)
+
+	// Exceptions must behave the same in the evaluator
+	for _, tt := range tests {
+		evaluated := evaluator.Eval(parse(tt.input), object.NewEnvironment())
+		testExpectedObject(t, tt.expected, evaluated)
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"5 + true", "1:3: TypeError: type mismatch: INTEGER + BOOLEAN"},
+		{"true + false", "1:6: TypeError: unknown operator: BOOLEAN + BOOLEAN"},
+		{`"a" - "b"`, "1:5: TypeError: unknown operator: STRING - STRING"},
+		{"1 < true", "1:3: TypeError: type mismatch: INTEGER < BOOLEAN"},
+		{`"a" > "b"`, "1:5: TypeError: unknown operator: STRING > STRING"},
+		{"-true", "1:1: TypeError: unknown operator: -BOOLEAN"},
+		{"1 / 0", "1:3: ZeroDivisionError: division by zero"},
+		{"let f = fn(x) {\n  x / 0\n};\nf(1)", "2:5: ZeroDivisionError: division by zero"},
+		{"1[0]", "1:2: TypeError: index operator not supported: INTEGER"},
+		{"{[1]: 2}", "1:1: TypeError: unusable as hash key: ARRAY"},
+		{`{"a": 1}[fn(x) { x }]`, "1:9: TypeError: unusable as hash key: FUNCTION"},
+		{"1()", "1:2: TypeError: not a function: INTEGER"},
+		{"fn(a) { a }()", "1:12: ArgumentError: wrong number of arguments to <anonymous:1:1>: want=1, got=0"},
+		{"len(1)", "1:4: TypeError: argument to `len` not supported, got INTEGER"},
+		{"len()", "1:4: ArgumentError: wrong number of arguments: want=1, got=0"},
+		{"1.foo()", "1:2: NameError: undefined method foo for INTEGER"},
+		{`"a".split(1)`, "1:4: TypeError: argument to `split` must be STRING, got INTEGER"},
+		{"[1, 2][::0]", "1:7: ValueError: slice step cannot be zero"},
+		{"throw 1", "1:1: Exception: 1"},
+		{"try { 1 + true } finally { 2 }", "1:9: TypeError: type mismatch: INTEGER + BOOLEAN"},
+		{"try { throw 1 } catch (e) { throw e + 1 }", "1:29: Exception: 2"},
+		{"map(1, fn(x) { x })", preludePosition(t, "reduce", "len") + ": TypeError: argument to `len` not supported, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err = New(comp.Bytecode()).Run()
+		if err == nil {
+			t.Errorf("expected VM error for %q", tt.input)
+		} else if err.Error() != tt.expected {
+			t.Errorf("wrong VM error. want=%q, got=%q", tt.expected, err)
+		}
+
+		// The evaluator must raise the same error at the same position
+		evaluated := evaluator.Eval(parse(tt.input), object.NewEnvironment())
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("expected evaluator error for %q. got=%T (%+v)",
+				tt.input, evaluated, evaluated)
+		} else if errObj.Error() != tt.expected {
+			t.Errorf("wrong evaluator error. want=%q, got=%q", tt.expected, errObj)
+		}
+	}
+}
+
+func TestReadsBeforeDefinition(t *testing.T) {
+	// A binding can't be read in its own value, except by the functions the
+	// value defines. The compiler reports the undefined names the evaluator
+	// raises NameErrors for
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x = x; print(x)", "1:9: undefined variable x"},
+		{"let y = y + 1", "1:9: undefined variable y"},
+		{"let f = fn() { let y = [y]; y }; f()", "1:25: undefined variable y"},
+	}
+
+	for _, tt := range tests {
+		err := compiler.New().Compile(parse(tt.input))
+		if err == nil {
+			t.Errorf("expected compiler error for %q", tt.input)
+		} else if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+
+		evaluated := evaluator.Eval(parse(tt.input), object.NewEnvironment())
+		expected := strings.Replace(tt.expected, ": ", ": NameError: ", 1)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("expected evaluator error for %q. got=%T (%+v)",
+				tt.input, evaluated, evaluated)
+		} else if errObj.Error() != expected {
+			t.Errorf("wrong evaluator error. want=%q, got=%q", expected, errObj)
+		}
+	}
+
+	// A function the value calls can still read the global before it is set
+	runVmTests(t, []vmTestCase{
+		{
+			"let x = fn() { x }(); x",
+			&object.Error{Kind: object.NameError, Message: "variable read before it is defined"},
+		},
+	})
+}
+
+// preludePosition returns the position in the prelude of the first call to
+// callee in the definition of the prelude function fn, where errors raised
+// by the call are reported.
+func preludePosition(t *testing.T, fn, callee string) string {
+	t.Helper()
+
+	lines := strings.Split(prelude.Source, "\n")
+	definition := "export let " + fn + " = "
+	for i, line := range lines {
+		if !strings.HasPrefix(line, definition) {
+			continue
+		}
+		for j, line := range lines[i+1:] {
+			if column := strings.Index(line, callee+"("); column >= 0 {
+				return fmt.Sprintf("prelude.ash:%d:%d", i+j+2, column+len(callee)+1)
+			}
+			if line == "};" {
+				break
+			}
+		}
+	}
+
+	t.Fatalf("no call to %s in prelude function %s", callee, fn)
+	return ""
+}
+
+func TestStackTraces(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 / 0", "1:3: ZeroDivisionError: division by zero\n    at <main> (1:3)"},
+		{
+			// Raised by a superinstruction at the optimization levels with them
+			"let f = fn(x) {\n  x - 1\n};\nf(\"a\")",
+			"2:5: TypeError: type mismatch: STRING - INTEGER\n    at f (2:5)\n    at <main> (4:2)",
+		},
+		{
+			"let f = fn(n) {\n  if (n == 0) { 1 / n } else { 1 + f(n - 1) }\n};\nf(2)",
+			`2:19: ZeroDivisionError: division by zero
+    at f (2:19)
+    at f (2:37)
+    at f (2:37)
+    at <main> (4:2)`,
+		},
+		{
+			"let g = fn() { fn() { throw 1 }() };\ng()",
+			`1:23: Exception: 1
+    at <anonymous:1:16> (1:23)
+    at <main> (2:2)`,
+		},
+		{
+			"let f = fn(n) {\n  if (n == 0) { return 1 / n };\n  f(n - 1)\n};\nf(3)",
+			`2:26: ZeroDivisionError: division by zero
+    at f (2:26)
+    at <main> (5:2)`,
+		},
+		{
+			"let g = fn() { 1 / 0 };\nlet f = fn() { try { return g() } finally { 2 } };\nf()",
+			`1:18: ZeroDivisionError: division by zero
+    at g (1:18)
+    at f (2:30)
+    at <main> (3:2)`,
+		},
+		{
+			"let g = fn() { 1 / 0 };\nlet f = fn() { try { throw 1 } catch (e) { return g() } };\nf()",
+			`1:18: ZeroDivisionError: division by zero
+    at g (1:18)
+    at <main> (3:2)`,
+		},
+		{
+			"let g = fn() { 1 / 0 };\nlet f = fn() { try { 1 } finally { return g() } };\nf()",
+			`1:18: ZeroDivisionError: division by zero
+    at g (1:18)
+    at <main> (3:2)`,
+		},
+		{
+			"let f = fn() { f() + 1 };\nf()",
+			`1:17: RuntimeError: maximum call depth exceeded
+    at f (1:17)
+    [the frame above repeated 1022 more times]
+    at <main> (2:2)`,
+		},
+		{
+			"let f = fn() { try { 1 / 0 } finally { 2 } };\nf()",
+			`1:24: ZeroDivisionError: division by zero
+    at f (1:24)
+    at <main> (2:2)`,
+		},
+		{
+			`let m = {"f": fn() { len(1) }}; m.f()`,
+			"1:25: TypeError: argument to `len` not supported, got INTEGER\n    at <anonymous:1:15> (1:25)\n    at <main> (1:34)",
+		},
+		{
+			"map(1, fn(x) { x })",
+			preludePosition(t, "reduce", "len") + ": TypeError: argument to `len` not supported, got INTEGER\n" +
+				"    at reduce (" + preludePosition(t, "reduce", "len") + ")\n" +
+				"    at map (" + preludePosition(t, "map", "reduce") + ")\n    at <main> (1:4)",
+		},
+	}
+
+	for _, tt := range tests {
+		for _, level := range []compiler.OptimizationLevel{compiler.NoOptimization, compiler.MaxOptimization} {
+			comp := compiler.New()
+			comp.SetOptimization(level)
+			err := comp.Compile(parse(tt.input))
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			err = New(comp.Bytecode()).Run()
+			raised, ok := err.(*object.Error)
+			if !ok {
+				t.Errorf("expected VM error for %q. got=%T (%+v)", tt.input, err, err)
+			} else if raised.StackTrace() != tt.expected {
+				t.Errorf("wrong VM stack trace at optimization level %d. want=%q, got=%q",
+					level, tt.expected, raised.StackTrace())
+			}
+		}
+
+		// The evaluator's calls must match the VM's frames
+		evaluated := evaluator.Eval(parse(tt.input), object.NewEnvironment())
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("expected evaluator error for %q. got=%T (%+v)",
+				tt.input, evaluated, evaluated)
+		} else if errObj.StackTrace() != tt.expected {
+			t.Errorf("wrong evaluator stack trace. want=%q, got=%q", tt.expected, errObj.StackTrace())
+		}
+	}
+}
+
+func TestCaughtRuntimeErrors(t *testing.T) {
+	tests := []vmTestCase{
+		{"try { 1 / 0 } catch (e) { e.kind }", "ZeroDivisionError"},
+		{"try { 1 / 0 } catch (e) { e.message }", "division by zero"},
+		{"try {\n  1 / 0\n} catch (e) { [e.line, e.column] }", []int{2, 5}},
+		{"try { throw 1 } catch (e) { e }", 1},
+		{"let f = fn() { try { [][0:1:0] } finally { 1 } }; try { f() } catch (e) { e.kind }", "ValueError"},
+	}
+
+	runVmTests(t, tests)
+
+	for _, tt := range tests {
+		evaluated := evaluator.Eval(parse(tt.input), object.NewEnvironment())
+		testExpectedObject(t, tt.expected, evaluated)
+	}
+}
+
 func TestStringExpressions(t *testing.T) {
 	tests := []vmTestCase{
 		{`"foobar"`, "foobar"},
@@ -145,7 +609,12 @@ func TestIndexExpressions(t *testing.T) {
 		{"[[1, 1, 1]][0][0]", 1},
 		{"[][0]", Null},
 		{"[1, 2, 3][99]", Null},
-		{"[1][-1]", Null},
+		{"[1][-1]", 1},
+		{"[1, 2, 3][-2]", 2},
+		{"[1][-2]", Null},
+		{`"abc"[1]`, "b"},
+		{`"abc"[-1]`, "c"},
+		{`"abc"[3]`, Null},
 		{"{1: 1, 2: 2}[1]", 1},
 		{"{1: 1, 2: 2}[2]", 2},
 		{"{1: 1}[0]", Null},
@@ -155,6 +624,105 @@ func TestIndexExpressions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestSliceExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2, 3, 4][1:3]", []int{2, 3}},
+		{"[1, 2, 3, 4][:2]", []int{1, 2}},
+		{"[1, 2, 3, 4][2:]", []int{3, 4}},
+		{"[1, 2, 3, 4][:]", []int{1, 2, 3, 4}},
+		{"[1, 2, 3, 4][-2:]", []int{3, 4}},
+		{"[1, 2, 3, 4][:-1]", []int{1, 2, 3}},
+		{"[1, 2, 3, 4][::2]", []int{1, 3}},
+		{"[1, 2, 3, 4][1::2]", []int{2, 4}},
+		{"[1, 2, 3, 4][::-1]", []int{4, 3, 2, 1}},
+		{"[1, 2, 3, 4][2::-1]", []int{3, 2, 1}},
+		{"[1, 2, 3, 4][-100:100]", []int{1, 2, 3, 4}},
+		{"[1, 2, 3, 4][3:1]", []int{}},
+		{"let n = 2; [1, 2, 3, 4][:n]", []int{1, 2}},
+		{`"hello"[1:3]`, "el"},
+		{`"hello"[2:]`, "llo"},
+		{`"hello"[::-1]`, "olleh"},
+		{`"hello"[10:]`, ""},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDotExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{`let person = {"name": "ash", "age": 1}; person.name`, "ash"},
+		{`let person = {"name": "ash", "age": 1}; person.age + 1`, 2},
+		{`let config = {"db": {"port": 5432}}; config.db.port`, 5432},
+		{`{"a": 1}.b`, Null},
+		{`"abc".upper()`, "ABC"},
+		{`"ABC".lower()`, "abc"},
+		{`"  abc ".trim().len()`, 3},
+		{`"a,b,c".split(",").len()`, 3},
+		{`"abc".contains("b")`, true},
+		{`[1, 2].push(3)`, []int{1, 2, 3}},
+		{`[1, 2, 3].rest().first()`, 2},
+		{`[1, 2, 3].join("-")`, "1-2-3"},
+		{`[1, 2, 3].contains(4)`, false},
+		{`{"a": 1, "b": 2}.keys().join(",")`, "a,b"},
+		{`{"a": 1, "b": 2}.values()`, []int{1, 2}},
+		{`{"a": 1}.has("a")`, true},
+		{`let math = {"double": x => x * 2}; math.double(4)`, 8},
+		{`let m = {"len": fn() { 42 }}; m.len()`, 42},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestNullishAndOptionalExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{`1 ?? 2`, 1},
+		{`{}.a ?? 2`, 2},
+		{`false ?? 2`, false},
+		{`{}.a ?? {}.b ?? 3`, 3},
+		{`let cfg = {"db": {"port": 1}}; cfg?.db?.port ?? 0`, 1},
+		{`let cfg = {"db": {}}; cfg?.db?.port ?? 0`, 0},
+		{`let cfg = {}; cfg.db?.port`, Null},
+		{`let cfg = {}; cfg.db?["port"] ?? 80`, 80},
+		{`let xs = {}; xs.items?[1:]`, Null},
+		{`let s = {}; s.name?.upper()`, Null},
+		{`let s = {"name": "ash"}; s.name?.upper()`, "ASH"},
+		{`1 ?? 1.foo()`, 1},
+		{`let f = fn(x) { x?.y ?? "default" }; f({"y": "set"}) + f({})`, "setdefault"},
+		{`null`, Null},
+		{`let x = null; x ?? 5`, 5},
+		{`let h = null; h?.a.b`, Null},
+		{`let h = null; h?.a.b()`, Null},
+		{`let h = null; h?["f"](1)[0]`, Null},
+		{`let h = {"a": {}}; h?.a.b`, Null},
+		{`let h = {"a": null}; h.a?.b.c ?? 5`, 5},
+		{`let f = fn(h) { h?.g(1) }; f(null)`, Null},
+		{`let f = fn(h) { return h?["g"](1) }; f(null)`, Null},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestUndefinedMethod(t *testing.T) {
+	program := parse(`1.foo()`)
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	expected := "1:2: NameError: undefined method foo for INTEGER"
+	if err.Error() != expected {
+		t.Fatalf("wrong VM error: want=%q, got=%q", expected, err)
+	}
+}
+
 func TestCallingFunctionsWithoutArguments(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -377,19 +945,333 @@ func TestCallingFunctionsWithArgumentsAndBindings(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestFunctionNames(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn() { 1 }; name(f)", "f"},
+		{"let f = fn() { fn() { 1 } }; name(f())", "<anonymous:1:16>"},
+		{"name(fn(x) { x })", "<anonymous:1:6>"},
+		{"name(len)", "len"},
+		{"name(map)", "map"},
+		{"name(1)", &object.Error{Kind: object.TypeError, Message: "argument to `name` must be FUNCTION, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+
+	for _, tt := range tests {
+		evaluated := evaluator.Eval(parse(tt.input), object.NewEnvironment())
+		testExpectedObject(t, tt.expected, evaluated)
+	}
+
+	comp := compiler.New()
+	if err := comp.Compile(parse("let add = fn(a, b) { a + b }; add")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if inspected := vm.LastPoppedStackElem().Inspect(); inspected != "Closure[add]" {
+		t.Errorf("wrong inspection. want=%q, got=%q", "Closure[add]", inspected)
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{"let loop = fn(n, acc) { if (n == 0) { return acc }; loop(n - 1, acc + n) }; loop(100000, 0)", 5000050000},
+		{"let count = fn(n) { if (n > 0) { return count(n - 1) }; n }; count(100000)", 0},
+		{"let f = fn(a) { len(a) }; f([1, 2])", 2},
+		{"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; f(5000)", 0},
+		{"let f = fn(n) { if (n > 0) { let m = n - 1; f(m) } else { len([n]) } }; f(5000)", 1},
+		{"let fail = fn() { 1 / 0 }; let f = fn() { try { return fail() } catch (e) { e.kind } }; f()", "ZeroDivisionError"},
+		{"let g = fn() { 7 }; let f = fn() { [if (true) { return g() }] }; f()", 7},
+		{"let g = fn() { 7 }; fn() { print(if (true) { return g() } else { 2 }) }()", 7},
+		{"let g = fn() { 7 }; fn() { 1 + if (true) { return g() } else { 2 } }()", 7},
+		{"let g = fn() { 7 }; let f = fn() { let x = if (true) { return g() } else { 2 }; x + 1 }; f()", 7},
+		{
+			"let f = fn(a) { a }; let g = fn() { f() }; g()",
+			&object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to f: want=1, got=0"},
+		},
+	}
+
+	runVmTests(t, tests)
+
+	for _, tt := range tests {
+		evaluated := evaluator.Eval(parse(tt.input), object.NewEnvironment())
+		testExpectedObject(t, tt.expected, evaluated)
+	}
+}
+
+func TestMaxFrames(t *testing.T) {
+	input := `let f = fn(n) { if (n == 0) { return 0 }; f(n - 1) + 1 };
+	[f(8), try { f(9) } catch (e) { e.message }]`
+	expected := []interface{}{8, "maximum call depth exceeded"}
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := NewWithOptions(comp.Bytecode(), Options{MaxFrames: 10})
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, expected, vm.LastPoppedStackElem())
+
+	options := evaluator.Options{MaxFrames: 10}
+	evaluated := evaluator.EvalContext(context.Background(), parse(input), object.NewEnvironment(), options)
+	testExpectedObject(t, expected, evaluated)
+}
+
+func TestGrowing(t *testing.T) {
+	elements := strings.Repeat("1, ", 4999) + "1"
+	lets := strings.Repeat("let x = 1; ", 100)
+	tests := []vmTestCase{
+		{"len([" + elements + "])", 5000},
+		{lets + "x", 1},
+		{"let f = fn(n) { if (n == 0) { return 0 }; f(n - 1) + 1 }; f(1000)", 1000},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestWideOperands(t *testing.T) {
+	var elements, params, args []string
+	for i := 0; i < 70000; i++ {
+		elements = append(elements, fmt.Sprint(i))
+	}
+	for i := 0; i < 300; i++ {
+		params = append(params, identifier(i))
+		args = append(args, fmt.Sprint(i+1))
+	}
+
+	array := "[" + strings.Join(elements, ", ") + "]"
+	f := "let f = fn(" + strings.Join(params, ", ") + ") { " + identifier(299) + " - " + identifier(0) + " }; "
+	call := "(" + strings.Join(args, ", ") + ")"
+
+	tests := []vmTestCase{
+		{"let a = " + array + "; a[69999] + len(a)", 139999},
+		{"let x = false; if (x) { " + array + "; 1 } else { 2 }", 2},
+		{"let x = true; if (x) { " + array + "; 1 } else { 2 }", 1},
+		{"fn(x) { if (x) { " + array + "; 1 } else { 2 } }(false)", 2},
+		{f + "f" + call, 299},
+		{f + "let g = fn() { f" + call + " }; g()", 299},
+		{"fn(" + strings.Join(params, ", ") + ") { fn() { " + strings.Join(params, " + ") + " } }" + call + "()", 45150},
+	}
+
+	runVmTests(t, tests)
+}
+
+// identifier returns a distinct identifier for i, which spells its digits
+// in letters since identifiers can't have digits.
+func identifier(i int) string {
+	return "p" + strings.Map(func(r rune) rune { return r - '0' + 'a' }, fmt.Sprint(i))
+}
+
+func TestWideForms(t *testing.T) {
+	// The compiler only prefixes instructions with OpWide when their
+	// operands need it, so these are encoded by hand.
+	var length, sum int
+	for i, b := range object.Builtins {
+		if b.Name == "len" {
+			length = i
+		}
+	}
+	for _, s := range compiler.PreludeSymbols() {
+		if s.Name == "sum" {
+			sum = s.Index
+		}
+	}
+
+	tests := []struct {
+		instructions []code.Instructions
+		constants    []object.Object
+		expected     interface{}
+	}{
+		{
+			[]code.Instructions{
+				wide(code.OpGetBuiltin, length),
+				wide(code.OpConstant, 0),
+				wide(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+			[]object.Object{&object.String{Value: "abc"}},
+			3,
+		},
+		{
+			[]code.Instructions{
+				wide(code.OpGetPrelude, sum),
+				wide(code.OpConstant, 0),
+				wide(code.OpConstant, 1),
+				wide(code.OpArray, 2),
+				wide(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+			[]object.Object{&object.Integer{Value: 1}, &object.Integer{Value: 2}},
+			3,
+		},
+		{
+			[]code.Instructions{
+				wide(code.OpConstant, 0),
+				wide(code.OpSetGlobal, 0),
+				wide(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+			[]object.Object{&object.Integer{Value: 5}},
+			5,
+		},
+	}
+
+	for _, tt := range tests {
+		var instructions code.Instructions
+		for _, ins := range tt.instructions {
+			instructions = append(instructions, ins...)
+		}
+
+		vm := New(&compiler.Bytecode{Instructions: instructions, Constants: tt.constants})
+		err := vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+// wide encodes op and its operands prefixed with OpWide, even if the
+// operands would fit their narrow widths.
+func wide(op code.Opcode, operands ...int) code.Instructions {
+	def, err := code.Lookup(byte(op))
+	if err != nil {
+		panic(err)
+	}
+
+	ins := code.Instructions{byte(code.OpWide), byte(op)}
+	for i, o := range operands {
+		switch 2 * def.OperandWidths[i] {
+		case 2:
+			ins = binary.BigEndian.AppendUint16(ins, uint16(o))
+		case 4:
+			ins = binary.BigEndian.AppendUint32(ins, uint32(o))
+		}
+	}
+	return ins
+}
+
+func TestOptions(t *testing.T) {
+	tests := []struct {
+		input    string
+		options  Options
+		expected string
+	}{
+		{"[1, 2, 3, 4]", Options{MaxStack: 3}, "RuntimeError: stack overflow"},
+		{"let a = 1; let b = 2; let c = 3", Options{MaxGlobals: 2}, "RuntimeError: too many globals"},
+		{"let f = fn() { f() + 1 }; f()", Options{MaxFrames: 3}, "1:17: RuntimeError: maximum call depth exceeded"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err := NewWithOptions(comp.Bytecode(), tt.options).Run()
+		if err == nil {
+			t.Errorf("expected VM error for %q", tt.input)
+		} else if err.Error() != tt.expected {
+			t.Errorf("wrong VM error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestBudgets(t *testing.T) {
+	loop := "let f = fn() { f() }; f()"
+	tests := []struct {
+		input   string
+		options Options
+		cause   error
+	}{
+		{loop, Options{MaxInstructions: 10000}, object.ErrInstructionBudget},
+		{"try { " + loop + " } catch (e) { 1 } finally { 2 }", Options{MaxInstructions: 10000}, object.ErrInstructionBudget},
+		{`let f = fn(s) { f(s + "x") }; f("")`, Options{MaxAllocations: 10000}, object.ErrAllocationBudget},
+		{"let f = fn(a) { f([a]) }; try { f([]) } catch (e) { 1 }", Options{MaxAllocations: 100}, object.ErrAllocationBudget},
+		{"let f = fn(n) { f(n + 1) }; f(0)", Options{MaxInstructions: 1000}, object.ErrInstructionBudget},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		err := NewWithOptions(comp.Bytecode(), tt.options).Run()
+		if !errors.Is(err, tt.cause) {
+			t.Errorf("wrong VM error for %q. want=%q, got=%v", tt.input, tt.cause, err)
+		}
+
+		// Like other errors, they are raised at a position in the program
+		if raised, ok := err.(*object.Error); !ok || raised.Line == 0 {
+			t.Errorf("VM error for %q has no position: %v", tt.input, err)
+		}
+
+		options := evaluator.Options{MaxInstructions: tt.options.MaxInstructions, MaxAllocations: tt.options.MaxAllocations}
+		result := evaluator.EvalContext(context.Background(), parse(tt.input), object.NewEnvironment(), options)
+		if err, ok := result.(error); !ok || !errors.Is(err, tt.cause) {
+			t.Errorf("wrong evaluator error for %q. want=%q, got=%s", tt.input, tt.cause, result.Inspect())
+		}
+		if raised, ok := result.(*object.Error); !ok || raised.Line == 0 {
+			t.Errorf("evaluator error for %q has no position: %s", tt.input, result.Inspect())
+		}
+	}
+
+	// Within budget, programs run as usual
+	comp := compiler.New()
+	if err := comp.Compile(parse("let f = fn(n) { if (n == 0) { return [] }; f(n - 1) }; f(10)")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := NewWithOptions(comp.Bytecode(), Options{MaxInstructions: 1000, MaxAllocations: 10})
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	input := "let f = fn() { f() }; try { f() } catch (e) { 1 }"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	err := New(comp.Bytecode()).RunContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wrong VM error. want=%q, got=%v", context.DeadlineExceeded, err)
+	}
+
+	result := evaluator.EvalContext(ctx, parse(input), object.NewEnvironment(), evaluator.Options{})
+	if err, ok := result.(error); !ok || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wrong evaluator error. want=%q, got=%s", context.DeadlineExceeded, result.Inspect())
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = New(comp.Bytecode()).RunContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong VM error. want=%q, got=%v", context.Canceled, err)
+	}
+}
+
 func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 	tests := []vmTestCase{
 		{
 			input:    `fn() { 1; }(1);`,
-			expected: `wrong number of arguments: want=0, got=1`,
+			expected: `1:12: ArgumentError: wrong number of arguments to <anonymous:1:1>: want=0, got=1`,
 		},
 		{
 			input:    `fn(a) { a; }();`,
-			expected: `wrong number of arguments: want=1, got=0`,
+			expected: `1:13: ArgumentError: wrong number of arguments to <anonymous:1:1>: want=1, got=0`,
 		},
 		{
-			input:    `fn(a, b) { a + b; }(1);`,
-			expected: `wrong number of arguments: want=2, got=1`,
+			input:    `let add = fn(a, b) { a + b; }; add(1);`,
+			expected: `1:35: ArgumentError: wrong number of arguments to add: want=2, got=1`,
 		},
 	}
 
@@ -419,21 +1301,31 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("")`, 0},
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
-		{`len(1)`, &object.Error{Message: "argument to `len` not supported, got INTEGER"}},
-		{`len("one", "two")`, &object.Error{Message: "wrong number of arguments. got=2, want=1"}},
+		{`len(1)`, &object.Error{Kind: object.TypeError, Message: "argument to `len` not supported, got INTEGER"}},
+		{`len("one", "two")`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments: want=1, got=2"}},
 		{`len([1, 2, 3])`, 3},
 		{`len([])`, 0},
 		{`print("hello", "world!")`, Null},
 		{`first([1, 2, 3])`, 1},
 		{`first([])`, Null},
-		{`first(1)`, &object.Error{Message: "argument to `first` must be ARRAY, got INTEGER"}},
+		{`first(1)`, &object.Error{Kind: object.TypeError, Message: "argument to `first` must be ARRAY, got INTEGER"}},
 		{`last([1, 2, 3])`, 3},
 		{`last([])`, Null},
-		{`last(1)`, &object.Error{Message: "argument to `last` must be ARRAY, got INTEGER"}},
+		{`last(1)`, &object.Error{Kind: object.TypeError, Message: "argument to `last` must be ARRAY, got INTEGER"}},
 		{`rest([1, 2, 3])`, []int{2, 3}},
 		{`rest([])`, Null},
 		{`push([], 1)`, []int{1}},
-		{`push(1, 1)`, &object.Error{Message: "argument to `push` must be ARRAY, got INTEGER"}},
+		{`push(1, 1)`, &object.Error{Kind: object.TypeError, Message: "argument to `push` must be ARRAY, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestNestedBuiltinCalls(t *testing.T) {
+	// A builtin call leaves only its result on the stack, not the builtin
+	tests := []vmTestCase{
+		{`first(rest([1, 2, 3]))`, 2},
+		{`len([1]) + len([2, 3])`, 3},
 	}
 
 	runVmTests(t, tests)
@@ -472,6 +1364,14 @@ func TestClosures(t *testing.T) {
             `,
 			expected: 11,
 		},
+		{
+			input: `
+            let call = fn(f, x) { f(x) };
+            let addTo = fn(a) { call(fn(b) { a + b }, 2) };
+            addTo(3);
+            `,
+			expected: 5,
+		},
 	}
 
 	runVmTests(t, tests)
@@ -556,45 +1456,152 @@ func TestRecursiveFibonacci(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestArrowFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let double = x => x * 2; double(4)", 8},
+		{"let add = (a, b) => a + b; add(1, 2)", 3},
+		{"let one = () => 1; one()", 1},
+		{"let apply = (f, x) => f(x); apply(x => x - 1, 10)", 9},
+		{"let adder = a => b => a + b; adder(1)(2)", 3},
+		{"let sum = (a, b) => { let c = a + b; c * 2 }; sum(1, 2)", 6},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestPipelineExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2, 3] |> len", 3},
+		{"[1, 2] |> push(3)", []int{1, 2, 3}},
+		{"[1, 2] |> push(3) |> rest |> first", 2},
+		{"let add = (a, b) => a + b; 1 |> add(2) |> add(3)", 6},
+		{"5 |> x => x * 2", 10},
+	}
+
+	runVmTests(t, tests)
+}
+
 type vmTestCase struct {
 	input    string
 	expected interface{}
 }
 
-func runVmTests(t *testing.T, tests []vmTestCase) {
-	t.Helper()
+func BenchmarkFibonacci(b *testing.B) {
+	benchmarkProgram(b, `
+	let fib = fn(n) { if (n < 2) { return n }; fib(n - 1) + fib(n - 2) };
+	fib(20)
+	`)
+}
 
-	for _, tt := range tests {
-		program := parse(tt.input)
+func BenchmarkTailCalls(b *testing.B) {
+	benchmarkProgram(b, `
+	let sum = fn(n, acc) { if (n == 0) { return acc }; sum(n - 1, acc + n) };
+	sum(100000, 0)
+	`)
+}
 
-		comp := compiler.New()
-		err := comp.Compile(program)
-		if err != nil {
-			t.Fatalf("compiler error: %s", err)
+func BenchmarkArrays(b *testing.B) {
+	benchmarkProgram(b, `
+	let fill = fn(a, n) { if (n == 0) { return a }; fill(push(a, n * 2), n - 1) };
+	let total = fn(a, i, acc) { if (i == len(a)) { return acc }; total(a, i + 1, acc + a[i]) };
+	total(fill([], 1000), 0, 0)
+	`)
+}
+
+// benchmarkProgram measures running input, compiled at the highest
+// optimization level.
+func benchmarkProgram(b *testing.B, input string) {
+	comp := compiler.New()
+	comp.SetOptimization(compiler.MaxOptimization)
+	if err := comp.Compile(parse(input)); err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := New(bytecode).Run(); err != nil {
+			b.Fatalf("vm error: %s", err)
 		}
+	}
+}
 
-		// for i, constant := range comp.Bytecode().Constants {
-		// 	fmt.Printf("CONSTANT %d %p (%T):\n", i, constant, constant)
-		//
-		// 	switch constant := constant.(type) {
-		// 	case *object.CompiledFunction:
-		// 		fmt.Printf(" Instructions:\n%s", constant.Instructions)
-		// 	case *object.Integer:
-		// 		fmt.Printf(" Value: %d\n", constant.Value)
-		// 	}
-		//
-		// 	fmt.Printf("\n")
-		// }
+func runVmTests(t *testing.T, tests []vmTestCase) {
+	t.Helper()
 
-		vm := New(comp.Bytecode())
-		err = vm.Run()
-		if err != nil {
-			t.Fatalf("vm error: %s", err)
+	// Optimized programs must run like they are written
+	for _, level := range []compiler.OptimizationLevel{compiler.NoOptimization, compiler.MaxOptimization} {
+		for _, tt := range tests {
+			runVmTest(t, tt, level)
 		}
+	}
+}
+
+func runVmTest(t *testing.T, tt vmTestCase, level compiler.OptimizationLevel) {
+	t.Helper()
+
+	program := parse(tt.input)
+
+	comp := compiler.New()
+	comp.SetOptimization(level)
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// for i, constant := range comp.Bytecode().Constants {
+	// 	fmt.Printf("CONSTANT %d %p (%T):\n", i, constant, constant)
+	//
+	// 	switch constant := constant.(type) {
+	// 	case *object.CompiledFunction:
+	// 		fmt.Printf(" Instructions:\n%s", constant.Instructions)
+	// 	case *object.Integer:
+	// 		fmt.Printf(" Value: %d\n", constant.Value)
+	// 	}
+	//
+	// 	fmt.Printf("\n")
+	// }
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+
+	// Expected errors are raised rather than left on the stack
+	if _, ok := tt.expected.(*object.Error); ok {
+		testExpectedObject(t, tt.expected, raisedError(err))
+		return
+	}
+
+	if err != nil {
+		t.Fatalf("vm error at optimization level %d: %s", level, err)
+	}
+
+	stackElem := vm.LastPoppedStackElem()
+
+	testExpectedObject(t, tt.expected, stackElem)
+}
+
+// raisedError returns the runtime error returned by vm.Run, if any.
+func raisedError(err error) object.Object {
+	if raised, ok := err.(*object.Error); ok {
+		return raised
+	}
+	return nil
+}
 
-		stackElem := vm.LastPoppedStackElem()
+// writeModules writes files, keyed by their path, to dir.
+func writeModules(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
 
-		testExpectedObject(t, tt.expected, stackElem)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
 	}
 }
 
@@ -686,6 +1693,10 @@ func testExpectedObject(
 			t.Errorf("object is not Error. got=%T (%+v)", actual, actual)
 			return
 		}
+		if errObj.Kind != expected.Kind {
+			t.Errorf("wrong error kind. expected=%q, got=%q",
+				expected.Kind, errObj.Kind)
+		}
 		if errObj.Message != expected.Message {
 			t.Errorf("wrong error message. expected=%q, got=%q",
 				expected.Message, errObj.Message)